@@ -0,0 +1,494 @@
+package provider
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/klog/v2"
+)
+
+// History versions older than the retention period are moved out of the local
+// store. With an archive configured they are first packed into gzipped NDJSON
+// segments, one per hour they were observed in, and uploaded as
+//
+//	history/2006/01/02/15/<first unixnano>-<last unixnano>.ndjson.gz
+//
+// Segments hold full documents rather than patches, so each one is readable on
+// its own. When the store has a keyring, segments are sealed with its primary
+// key like stored values, and sealed again with a new primary key by
+// ReencryptArchive. The newest version of an object is always kept locally, as the base
+// later versions are patched against, and the oldest version kept is rewritten
+// as a snapshot when its base was archived, so local delta chains stay intact.
+const archiveIndexPrefix = "/archive/segment/"
+
+const segmentPartition = time.Hour
+
+// SegmentInfo describes an archived segment. The local index of segments lets
+// reads skip those not covering the requested objects and time range.
+type SegmentInfo struct {
+	Name    string    `json:"name"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Records int       `json:"records"`
+	Objects []string  `json:"objects"`
+}
+
+// RetentionResult reports what a retention pass moved out of the local store.
+type RetentionResult struct {
+	Cutoff   time.Time     `json:"cutoff"`
+	Archived int           `json:"archived"`
+	Deleted  int           `json:"deleted"`
+	Rebased  int           `json:"rebased"`
+	Segments []SegmentInfo `json:"segments,omitempty"`
+}
+
+// SetRetention sets how long history versions are kept locally. Zero keeps
+// them forever.
+func (s *Store) SetRetention(retention time.Duration) {
+	s.retention = retention
+}
+
+// SetArchive sets the object store aged-out history is archived to instead of
+// being deleted.
+func (s *Store) SetArchive(archive ObjectStore) {
+	s.archive = archive
+}
+
+func segmentName(partition, from, to time.Time) string {
+	return fmt.Sprintf("history/%s/%019d-%019d.ndjson.gz", partition.Format("2006/01/02/15"), from.UnixNano(), to.UnixNano())
+}
+
+// segmentWriter gzips the versions of one partition as NDJSON.
+type segmentWriter struct {
+	info    SegmentInfo
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	objects map[string]bool
+}
+
+func newSegmentWriter() *segmentWriter {
+	w := &segmentWriter{objects: map[string]bool{}}
+	w.gz = gzip.NewWriter(&w.buf)
+	w.enc = json.NewEncoder(w.gz)
+	return w
+}
+
+func (w *segmentWriter) add(line exportLine, t time.Time) error {
+	if w.info.Records == 0 || t.Before(w.info.From) {
+		w.info.From = t
+	}
+	if t.After(w.info.To) {
+		w.info.To = t
+	}
+	w.info.Records++
+	w.objects[historyObjectPrefix(line.Key)] = true
+	return w.enc.Encode(line)
+}
+
+func (w *segmentWriter) close(partition time.Time) ([]byte, error) {
+	if err := w.gz.Close(); err != nil {
+		return nil, err
+	}
+	w.info.Name = segmentName(partition, w.info.From, w.info.To)
+	w.info.Objects = keys(w.objects)
+	return w.buf.Bytes(), nil
+}
+
+// ApplyRetention archives, or deletes without an archive, the history versions
+// observed before now minus the retention period. Segments are uploaded before
+// anything is removed locally, and the removal is a single atomic batch.
+func (s *Store) ApplyRetention(ctx context.Context, now time.Time) (RetentionResult, error) {
+	result := RetentionResult{}
+	if s.retention <= 0 {
+		return result, nil
+	}
+	cutoff := now.Add(-s.retention).UTC()
+	result.Cutoff = cutoff
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return result, err
+	}
+	defer snap.Release()
+
+	type version struct {
+		key string
+		t   time.Time
+		rec versionRecord
+		doc []byte
+	}
+	var pending []version
+	docs := map[string][]byte{}
+	partitions := map[time.Time]*segmentWriter{}
+	batch := new(leveldb.Batch)
+
+	// retire moves the aged-out versions of the object in pending
+	retire := func() error {
+		kept := 0
+		for kept < len(pending)-1 && pending[kept].t.Before(cutoff) {
+			kept++
+		}
+		for _, v := range pending[:kept] {
+			if s.archive != nil {
+				partition := v.t.Truncate(segmentPartition)
+				if partitions[partition] == nil {
+					partitions[partition] = newSegmentWriter()
+				}
+				if err := partitions[partition].add(exportLine{Key: v.key, Value: v.doc, Hash: v.rec.Hash, Prev: v.rec.Prev}, v.t); err != nil {
+					return err
+				}
+				result.Archived++
+			} else {
+				result.Deleted++
+			}
+			batch.Delete([]byte(v.key))
+		}
+		if kept > 0 && pending[kept].rec.Snapshot == nil {
+			v := pending[kept]
+			value, err := s.encode(versionRecord{Snapshot: v.doc, Hash: v.rec.Hash, Prev: v.rec.Prev})
+			if err != nil {
+				return err
+			}
+			batch.Put([]byte(pending[kept].key), value)
+			result.Rebased++
+		}
+		pending = pending[:0]
+		return nil
+	}
+
+	iter := snap.NewIterator(util.BytesPrefix([]byte("/history/")), nil)
+	defer iter.Release()
+	object := ""
+	for iter.Next() {
+		key := string(iter.Key())
+		if o := historyObjectPrefix(key); o != object {
+			if err := retire(); err != nil {
+				return result, err
+			}
+			delete(docs, object)
+			object = o
+		}
+
+		t, ok := versionTime(key)
+		if !ok {
+			continue
+		}
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			klog.Errorf("retention: skipping %s: %v", key, err)
+			continue
+		}
+		doc, err := versionDoc(object, rec, docs)
+		if err != nil {
+			klog.Errorf("retention: skipping %s: %v", key, err)
+			continue
+		}
+		pending = append(pending, version{key: key, t: t, rec: rec, doc: doc})
+	}
+	if err := iter.Error(); err != nil {
+		return result, err
+	}
+	if err := retire(); err != nil {
+		return result, err
+	}
+
+	var order []time.Time
+	for partition := range partitions {
+		order = append(order, partition)
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].Before(order[j]) })
+
+	for _, partition := range order {
+		w := partitions[partition]
+		data, err := w.close(partition)
+		if err != nil {
+			return result, err
+		}
+		if data, err = s.seal(data); err != nil {
+			return result, err
+		}
+		if err := s.archive.Put(ctx, w.info.Name, data); err != nil {
+			return result, fmt.Errorf("error uploading segment %s: %v", w.info.Name, err)
+		}
+		value, err := s.encode(w.info)
+		if err != nil {
+			return result, err
+		}
+		batch.Put([]byte(archiveIndexPrefix+w.info.Name), value)
+		result.Segments = append(result.Segments, w.info)
+	}
+
+	if batch.Len() == 0 {
+		return result, nil
+	}
+	if err := s.writeBatch(batch); err != nil {
+		return result, err
+	}
+	klog.Infof("retention: archived %d, deleted %d and rebased %d versions observed before %s",
+		result.Archived, result.Deleted, result.Rebased, cutoff.Format(time.RFC3339))
+	return result, nil
+}
+
+// RunRetention applies retention every interval until ctx is done.
+func (s *Store) RunRetention(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := s.ApplyRetention(ctx, time.Now()); err != nil {
+			klog.Errorf("retention: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// GetSegments returns the index of archived segments, oldest first.
+func (s *Store) GetSegments() ([]SegmentInfo, error) {
+	var segments []SegmentInfo
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(archiveIndexPrefix)), nil)
+	for iter.Next() {
+		info := SegmentInfo{}
+		if err := s.unmarshal(iter.Value(), &info); err != nil {
+			klog.Errorf("error decoding segment index %s: %v", iter.Key(), err)
+			continue
+		}
+		segments = append(segments, info)
+	}
+	iter.Release()
+	return segments, iter.Error()
+}
+
+// RebuildArchiveIndex indexes the segments in the archive missing from the
+// local index, such as after the local store was lost, and returns how many
+// it added.
+func (s *Store) RebuildArchiveIndex(ctx context.Context) (int, error) {
+	if s.archive == nil {
+		return 0, nil
+	}
+	names, err := s.archive.List(ctx, "history/")
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, name := range names {
+		key := []byte(archiveIndexPrefix + name)
+		if ok, err := s.db.Has(key, nil); err != nil || ok {
+			continue
+		}
+		lines, err := s.readSegment(ctx, name)
+		if err != nil {
+			klog.Errorf("error reading segment %s: %v", name, err)
+			continue
+		}
+
+		info := SegmentInfo{Name: name}
+		objects := map[string]bool{}
+		for _, line := range lines {
+			t, ok := versionTime(line.Key)
+			if !ok {
+				continue
+			}
+			if info.Records == 0 || t.Before(info.From) {
+				info.From = t
+			}
+			if t.After(info.To) {
+				info.To = t
+			}
+			info.Records++
+			objects[historyObjectPrefix(line.Key)] = true
+		}
+		info.Objects = keys(objects)
+
+		value, err := s.encode(info)
+		if err != nil {
+			return added, err
+		}
+		if err := s.put(key, value); err != nil {
+			return added, err
+		}
+		added++
+	}
+	return added, nil
+}
+
+func (info SegmentInfo) covers(keyPrefix string, since, until time.Time) bool {
+	if !until.IsZero() && !info.From.Before(until) {
+		return false
+	}
+	if !since.IsZero() && info.To.Before(since) {
+		return false
+	}
+	for _, object := range info.Objects {
+		if strings.HasPrefix(object, keyPrefix) || strings.HasPrefix(keyPrefix, object) {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedVersions returns the archived versions under a history key prefix
+// observed within [since, until), ordered by key.
+func (s *Store) archivedVersions(keyPrefix string, since, until time.Time) ([]exportLine, error) {
+	if s.archive == nil {
+		return nil, nil
+	}
+	segments, err := s.GetSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []exportLine
+	for _, info := range segments {
+		if !info.covers(keyPrefix, since, until) {
+			continue
+		}
+		lines, err := s.readSegment(context.Background(), info.Name)
+		if err != nil {
+			return versions, fmt.Errorf("error reading segment %s: %v", info.Name, err)
+		}
+		for _, line := range lines {
+			if !strings.HasPrefix(line.Key, keyPrefix) {
+				continue
+			}
+			if t, ok := versionTime(line.Key); ok && inRange(t, since, until) {
+				versions = append(versions, line)
+			}
+		}
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Key < versions[j].Key })
+	unique := versions[:0]
+	for i, line := range versions {
+		if i == 0 || line.Key != versions[i-1].Key {
+			unique = append(unique, line)
+		}
+	}
+	return unique, nil
+}
+
+const segmentCacheSize = 8
+
+// segmentCache keeps the most recently read segments, which never change once
+// uploaded.
+type segmentCache struct {
+	mu    sync.Mutex
+	names []string
+	lines map[string][]exportLine
+}
+
+func (s *Store) readSegment(ctx context.Context, name string) ([]exportLine, error) {
+	c := &s.segments
+	c.mu.Lock()
+	lines, ok := c.lines[name]
+	c.mu.Unlock()
+	if ok {
+		return lines, nil
+	}
+
+	data, err := s.getArchived(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		line := exportLine{}
+		if err := dec.Decode(&line); err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lines == nil {
+		c.lines = map[string][]exportLine{}
+	}
+	if _, ok := c.lines[name]; !ok {
+		if len(c.names) == segmentCacheSize {
+			delete(c.lines, c.names[0])
+			c.names = c.names[1:]
+		}
+		c.names = append(c.names, name)
+		c.lines[name] = lines
+	}
+	return lines, nil
+}
+
+// getArchived reads an object of the archive, opening it if it is sealed.
+func (s *Store) getArchived(ctx context.Context, name string) ([]byte, error) {
+	data, err := s.archive.Get(ctx, name)
+	if err != nil || !isSealed(data) {
+		return data, err
+	}
+	if s.keys == nil {
+		id, _ := sealedWith(data)
+		return nil, fmt.Errorf("%s is sealed with key %q and the store has no keys", name, id)
+	}
+	return s.keys.open(data)
+}
+
+// ReencryptArchive seals every archived segment and published checkpoint that
+// is plain or sealed with another key with the primary key, and returns how
+// many were rewritten.
+func (s *Store) ReencryptArchive(ctx context.Context) (int, error) {
+	if s.keys == nil || s.archive == nil {
+		return 0, nil
+	}
+	rewritten := 0
+	for _, prefix := range []string{"history/", checkpointObjectPrefix} {
+		names, err := s.archive.List(ctx, prefix)
+		if err != nil {
+			return rewritten, err
+		}
+		for _, name := range names {
+			data, err := s.archive.Get(ctx, name)
+			if err != nil {
+				return rewritten, err
+			}
+			if id, ok := sealedWith(data); ok && id == s.keys.primary {
+				continue
+			}
+			if isSealed(data) {
+				if data, err = s.keys.open(data); err != nil {
+					klog.Errorf("reencrypt: skipping archived %s: %v", name, err)
+					continue
+				}
+			}
+			if data, err = s.keys.seal(data); err != nil {
+				return rewritten, err
+			}
+			if err := s.archive.Put(ctx, name, data); err != nil {
+				return rewritten, err
+			}
+			rewritten++
+			if ctx.Err() != nil {
+				return rewritten, ctx.Err()
+			}
+		}
+	}
+	return rewritten, nil
+}
@@ -0,0 +1,306 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// fakeS3 is an in-memory stand-in for an S3-compatible service, serving the
+// path-style PutObject, GetObject and ListObjectsV2 calls of one bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T, bucket string) *S3ObjectStore {
+	t.Helper()
+	fake := &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	objects, err := NewS3ObjectStore(S3Config{
+		Endpoint:  server.URL,
+		Bucket:    bucket,
+		Prefix:    "drift/",
+		AccessKey: "test",
+		SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("x-amz-content-sha256") != sha256Hex(body) {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/"+f.bucket)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodPut:
+		f.objects[strings.TrimPrefix(path, "/")] = body
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r.URL.Query().Get("prefix"), r.URL.Query().Get("continuation-token"))
+	case r.Method == http.MethodGet:
+		data, ok := f.objects[strings.TrimPrefix(path, "/")]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+// list pages two keys at a time, to exercise continuation.
+func (f *fakeS3) list(w http.ResponseWriter, prefix, token string) {
+	var names []string
+	for name := range f.objects {
+		if strings.HasPrefix(name, prefix) && name > token {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := listBucketResult{}
+	for i, name := range names {
+		if i == 2 {
+			result.IsTruncated = true
+			result.NextContinuationToken = names[1]
+			break
+		}
+		result.Contents = append(result.Contents, struct {
+			Key string `xml:"Key"`
+		}{name})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// saveVersionsAt writes n versions of a pod observed every ten minutes from base.
+func saveVersionsAt(t *testing.T, store *Store, base time.Time, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.Status.ContainerStatuses[0].RestartCount = int32(i)
+		drift := *New(pod, "update")
+		drift.ObservedAt = base.Add(time.Duration(i) * 10 * time.Minute)
+		doc, err := json.Marshal(drift)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch := new(leveldb.Batch)
+		if err := store.saveVersion(batch, drift, doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.db.Write(batch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func restartCounts(t *testing.T, versions []KubeDrift) []int32 {
+	t.Helper()
+	var counts []int32
+	for _, v := range versions {
+		status, err := podStatus(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts = append(counts, status.ContainerStatuses[0].RestartCount)
+	}
+	return counts
+}
+
+func TestArchiveAgedHistory(t *testing.T) {
+	objects := newFakeS3(t, "drift")
+	store := newTestStore(t)
+	store.SetArchive(objects)
+	store.SetRetention(time.Hour)
+
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	saveVersionsAt(t, store, base, 20)
+
+	result, err := store.ApplyRetention(context.Background(), base.Add(200*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// versions observed before 14:20 are archived, in the 12:00, 13:00 and 14:00 partitions
+	if result.Archived != 14 || len(result.Segments) != 3 || result.Rebased != 1 {
+		t.Fatalf("unexpected retention result %+v", result)
+	}
+	if !strings.HasPrefix(result.Segments[0].Name, "history/2021/10/01/12/") {
+		t.Errorf("unexpected segment name %s", result.Segments[0].Name)
+	}
+
+	local := 0
+	iter := store.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if strings.HasPrefix(string(iter.Key()), "/history/") {
+			if local == 0 {
+				rec, _ := store.decodeVersion(iter.Value())
+				if rec.Snapshot == nil {
+					t.Errorf("oldest local version %s is not a snapshot", iter.Key())
+				}
+			}
+			local++
+		}
+	}
+	iter.Release()
+	if local != 6 {
+		t.Errorf("expected 6 local versions, got %d", local)
+	}
+
+	history, err := store.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := restartCounts(t, history)
+	if len(counts) != 20 {
+		t.Fatalf("expected 20 versions, got %d", len(counts))
+	}
+	for i, c := range counts {
+		if c != int32(i) {
+			t.Fatalf("version %d: expected restart count %d, got %d", i, i, c)
+		}
+	}
+
+	ranged, err := store.GetHistoryRange("pod", "default", "web-1", base.Add(50*time.Minute), base.Add(150*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restartCounts(t, ranged); len(got) != 10 || got[0] != 5 || got[9] != 14 {
+		t.Errorf("unexpected ranged history %v", got)
+	}
+
+	// new versions still patch against the newest local version
+	saveVersionsAt(t, store, base.Add(200*time.Minute), 1)
+	if history, _ = store.GetHistory("pod", "default", "web-1"); len(history) != 21 {
+		t.Errorf("expected 21 versions, got %d", len(history))
+	}
+
+	// a store replacing a lost one finds the archived history again
+	replacement := newTestStore(t)
+	replacement.SetArchive(objects)
+	added, err := replacement.RebuildArchiveIndex(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 3 {
+		t.Errorf("expected 3 segments indexed, got %d", added)
+	}
+	history, err = replacement.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 14 {
+		t.Errorf("expected 14 archived versions, got %d", len(history))
+	}
+}
+
+func TestRetentionWithoutArchive(t *testing.T) {
+	store := newTestStore(t)
+	store.SetRetention(time.Hour)
+
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	saveVersionsAt(t, store, base, 20)
+
+	result, err := store.ApplyRetention(context.Background(), base.Add(200*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 14 || result.Archived != 0 {
+		t.Fatalf("unexpected retention result %+v", result)
+	}
+
+	history, err := store.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restartCounts(t, history); len(got) != 6 || got[0] != 14 {
+		t.Errorf("unexpected remaining history %v", got)
+	}
+}
+
+func TestArchiveSealedWithKeyring(t *testing.T) {
+	objects := newFakeS3(t, "drift")
+	store := newTestStore(t)
+	keys, err := NewKeyring(map[string][]byte{"k1": testKey(1)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetKeyring(keys)
+	store.SetArchive(objects)
+	store.SetRetention(time.Hour)
+
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	saveVersionsAt(t, store, base, 20)
+	result, err := store.ApplyRetention(context.Background(), base.Add(200*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range result.Segments {
+		data, err := objects.Get(context.Background(), info.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id, ok := sealedWith(data); !ok || id != "k1" {
+			t.Fatalf("segment %s is not sealed with k1", info.Name)
+		}
+	}
+
+	// rotating the primary key seals the archive again
+	rotated, err := NewKeyring(map[string][]byte{"k1": testKey(1), "k2": testKey(2)}, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetKeyring(rotated)
+	if n, err := store.ReencryptArchive(context.Background()); err != nil || n != 3 {
+		t.Fatalf("expected 3 segments sealed again, got %d, %v", n, err)
+	}
+	if n, _ := store.ReencryptArchive(context.Background()); n != 0 {
+		t.Errorf("expected nothing left to seal again, got %d", n)
+	}
+
+	replacement := newTestStore(t)
+	replacement.SetArchive(objects)
+	if _, err := replacement.RebuildArchiveIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if history, _ := replacement.GetHistory("pod", "default", "web-1"); len(history) != 0 {
+		t.Errorf("expected sealed segments to be unreadable without keys, got %d versions", len(history))
+	}
+	k2, err := NewKeyring(map[string][]byte{"k2": testKey(2)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replacement.SetKeyring(k2)
+	if _, err := replacement.RebuildArchiveIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if history, err := replacement.GetHistory("pod", "default", "web-1"); err != nil || len(history) != 14 {
+		t.Errorf("expected 14 archived versions, got %d, %v", len(history), err)
+	}
+}
@@ -0,0 +1,274 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// Sources of a change of the replicas of a deployment.
+const (
+	ScaleSourceHPA     = "hpa"
+	ScaleSourceManual  = "manual"
+	ScaleSourceGitOps  = "gitops"
+	ScaleSourceUnknown = "unknown"
+)
+
+// hpaManager is the field manager of replicas scaled by an autoscaler.
+const hpaManager = "kube-controller-manager"
+
+// gitopsManagers are prefixes of the field managers of GitOps controllers.
+var gitopsManagers = []string{"argocd", "kustomize-controller", "helm-controller", "flux", "fleet"}
+
+func (p *KubeDrift) newHorizontalPodAutoscaler(eventType string, o *autoscalingv2beta2.HorizontalPodAutoscaler) {
+	p.Type = "horizontalpodautoscaler"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+// replicasManager returns the field manager that last set spec.replicas of an
+// object, or "" when its managed fields do not say.
+func replicasManager(o metav1.ObjectMeta) string {
+	manager, latest := "", time.Time{}
+	for _, entry := range o.ManagedFields {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var fields struct {
+			Spec map[string]interface{} `json:"f:spec"`
+		}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		if _, ok := fields.Spec["f:replicas"]; !ok {
+			continue
+		}
+		if entry.Time == nil || !entry.Time.Time.Before(latest) {
+			manager = entry.Manager
+			if entry.Time != nil {
+				latest = entry.Time.Time
+			}
+		}
+	}
+	return manager
+}
+
+// scaleSource attributes a change of the replicas of a deployment to the
+// field manager that made it or, when that is unknown, to an autoscaler
+// that desired the new count.
+func scaleSource(manager string, autoscaled bool) string {
+	switch {
+	case manager == hpaManager:
+		return ScaleSourceHPA
+	case manager != "":
+		for _, prefix := range gitopsManagers {
+			if strings.HasPrefix(manager, prefix) {
+				return ScaleSourceGitOps
+			}
+		}
+		return ScaleSourceManual
+	case autoscaled:
+		return ScaleSourceHPA
+	}
+	return ScaleSourceUnknown
+}
+
+// ReplicaChange is an entry of the replica timeline of a deployment: a change
+// of the replicas of the deployment or of an autoscaler targeting it.
+type ReplicaChange struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	Name string    `json:"name"`
+
+	// deployment replicas
+	SpecReplicas  *int32 `json:"specReplicas,omitempty"`
+	Replicas      int32  `json:"replicas,omitempty"`
+	ReadyReplicas int32  `json:"readyReplicas,omitempty"`
+	Source        string `json:"source,omitempty"`
+	Manager       string `json:"manager,omitempty"`
+
+	// autoscaler replicas
+	MinReplicas     *int32   `json:"minReplicas,omitempty"`
+	MaxReplicas     int32    `json:"maxReplicas,omitempty"`
+	CurrentReplicas int32    `json:"currentReplicas,omitempty"`
+	DesiredReplicas int32    `json:"desiredReplicas,omitempty"`
+	Metrics         []string `json:"metrics,omitempty"`
+}
+
+// GetReplicaTimeline returns the changes of the replicas of a deployment and
+// of the autoscalers targeting it observed within [since, until), oldest
+// first. Changes of the desired replicas of the deployment carry their source.
+func (s *Store) GetReplicaTimeline(namespace, name string, since, until time.Time) ([]ReplicaChange, error) {
+	hpas, err := s.autoscalerChanges(namespace, name, since, until)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := s.GetHistoryRange("deployment", namespace, name, since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeline []ReplicaChange
+	var last *ReplicaChange
+	for _, version := range versions {
+		spec, status := appsv1.DeploymentSpec{}, appsv1.DeploymentStatus{}
+		if err := convert(version.Spec, &spec); err != nil {
+			klog.Errorf("error decoding deployment %s: %v", version.GetKey(), err)
+			continue
+		}
+		if err := convert(version.Status, &status); err != nil {
+			klog.Errorf("error decoding deployment %s: %v", version.GetKey(), err)
+			continue
+		}
+		change := ReplicaChange{
+			Time:          version.ObservedAt,
+			Kind:          "Deployment",
+			Name:          version.MetaData.Name,
+			SpecReplicas:  spec.Replicas,
+			Replicas:      status.Replicas,
+			ReadyReplicas: status.ReadyReplicas,
+			Manager:       version.ReplicasManager,
+		}
+		if last != nil && int32Equal(last.SpecReplicas, change.SpecReplicas) &&
+			last.Replicas == change.Replicas && last.ReadyReplicas == change.ReadyReplicas {
+			continue
+		}
+		if last != nil && !int32Equal(last.SpecReplicas, change.SpecReplicas) {
+			change.Source = scaleSource(change.Manager, desiredBy(hpas, change.Time, change.SpecReplicas))
+		}
+		timeline = append(timeline, change)
+		last = &change
+	}
+
+	timeline = append(timeline, hpas...)
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Time.Before(timeline[j].Time)
+	})
+	return timeline, nil
+}
+
+// autoscalerChanges returns the changes of the replicas of the autoscalers of
+// a namespace targeting a deployment.
+func (s *Store) autoscalerChanges(namespace, deployment string, since, until time.Time) ([]ReplicaChange, error) {
+	if namespace == "" {
+		namespace = "none"
+	}
+	versions, err := s.getHistoryRange(fmt.Sprintf("/history/horizontalpodautoscaler/%s/", namespace), since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []ReplicaChange
+	last := map[string]ReplicaChange{}
+	for _, version := range versions {
+		spec := autoscalingv2beta2.HorizontalPodAutoscalerSpec{}
+		status := autoscalingv2beta2.HorizontalPodAutoscalerStatus{}
+		if err := convert(version.Spec, &spec); err != nil {
+			klog.Errorf("error decoding autoscaler %s: %v", version.GetKey(), err)
+			continue
+		}
+		if err := convert(version.Status, &status); err != nil {
+			klog.Errorf("error decoding autoscaler %s: %v", version.GetKey(), err)
+			continue
+		}
+		if spec.ScaleTargetRef.Kind != "Deployment" || spec.ScaleTargetRef.Name != deployment {
+			continue
+		}
+		change := ReplicaChange{
+			Time:            version.ObservedAt,
+			Kind:            "HorizontalPodAutoscaler",
+			Name:            version.MetaData.Name,
+			MinReplicas:     spec.MinReplicas,
+			MaxReplicas:     spec.MaxReplicas,
+			CurrentReplicas: status.CurrentReplicas,
+			DesiredReplicas: status.DesiredReplicas,
+			Metrics:         describeMetrics(status.CurrentMetrics),
+		}
+		// metrics change on every sync, so only changes of replicas are kept
+		if prev, ok := last[change.Name]; ok && int32Equal(prev.MinReplicas, change.MinReplicas) &&
+			prev.MaxReplicas == change.MaxReplicas && prev.CurrentReplicas == change.CurrentReplicas &&
+			prev.DesiredReplicas == change.DesiredReplicas {
+			continue
+		}
+		last[change.Name] = change
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// autoscalerSlack is how long after a deployment was observed scaled the
+// status of the autoscaler that scaled it may be observed.
+const autoscalerSlack = 30 * time.Second
+
+// desiredBy reports whether the latest change of an autoscaler observed by t,
+// give or take autoscalerSlack, desired replicas.
+func desiredBy(hpas []ReplicaChange, t time.Time, replicas *int32) bool {
+	if replicas == nil {
+		return false
+	}
+	latest := map[string]int32{}
+	for _, hpa := range hpas {
+		if hpa.Time.After(t.Add(autoscalerSlack)) {
+			break
+		}
+		latest[hpa.Name] = hpa.DesiredReplicas
+	}
+	for _, desired := range latest {
+		if desired == *replicas {
+			return true
+		}
+	}
+	return false
+}
+
+func int32Equal(a, b *int32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// describeMetrics formats the current metrics of an autoscaler, e.g.
+// "cpu=85%" or "requests_per_second=120".
+func describeMetrics(metrics []autoscalingv2beta2.MetricStatus) []string {
+	var described []string
+	for _, m := range metrics {
+		switch {
+		case m.Resource != nil:
+			described = append(described, fmt.Sprintf("%s=%s", m.Resource.Name, describeMetricValue(m.Resource.Current)))
+		case m.ContainerResource != nil:
+			described = append(described, fmt.Sprintf("%s/%s=%s", m.ContainerResource.Container,
+				m.ContainerResource.Name, describeMetricValue(m.ContainerResource.Current)))
+		case m.Pods != nil:
+			described = append(described, fmt.Sprintf("%s=%s", m.Pods.Metric.Name, describeMetricValue(m.Pods.Current)))
+		case m.Object != nil:
+			described = append(described, fmt.Sprintf("%s on %s/%s=%s", m.Object.Metric.Name,
+				m.Object.DescribedObject.Kind, m.Object.DescribedObject.Name, describeMetricValue(m.Object.Current)))
+		case m.External != nil:
+			described = append(described, fmt.Sprintf("%s=%s", m.External.Metric.Name, describeMetricValue(m.External.Current)))
+		}
+	}
+	return described
+}
+
+func describeMetricValue(v autoscalingv2beta2.MetricValueStatus) string {
+	switch {
+	case v.AverageUtilization != nil:
+		return fmt.Sprintf("%d%%", *v.AverageUtilization)
+	case v.AverageValue != nil:
+		return v.AverageValue.String()
+	case v.Value != nil:
+		return v.Value.String()
+	}
+	return "unknown"
+}
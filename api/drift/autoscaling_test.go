@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func scaledDeployment(replicas int32, manager string) *appsv1.Deployment {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-deploy"},
+		Spec:       appsv1.DeploymentSpec{Replicas: &replicas, Template: podTemplate("nginx:1.21")},
+		Status:     appsv1.DeploymentStatus{Replicas: replicas, ReadyReplicas: replicas},
+	}
+	if manager != "" {
+		deployment.ManagedFields = []metav1.ManagedFieldsEntry{{
+			Manager:  manager,
+			Time:     &metav1.Time{Time: time.Now()},
+			FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:spec":{"f:replicas":{}}}`)},
+		}}
+	}
+	return deployment
+}
+
+func autoscaler(desired int32, cpu int32) *autoscalingv2beta2.HorizontalPodAutoscaler {
+	min := int32(2)
+	return &autoscalingv2beta2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-hpa"},
+		Spec: autoscalingv2beta2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2beta2.CrossVersionObjectReference{Kind: "Deployment", Name: "web"},
+			MinReplicas:    &min,
+			MaxReplicas:    10,
+		},
+		Status: autoscalingv2beta2.HorizontalPodAutoscalerStatus{
+			CurrentReplicas: 2,
+			DesiredReplicas: desired,
+			CurrentMetrics: []autoscalingv2beta2.MetricStatus{{
+				Type: autoscalingv2beta2.ResourceMetricSourceType,
+				Resource: &autoscalingv2beta2.ResourceMetricStatus{
+					Name:    v1.ResourceCPU,
+					Current: autoscalingv2beta2.MetricValueStatus{AverageUtilization: &cpu},
+				},
+			}},
+		},
+	}
+}
+
+func TestReplicaTimeline(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store,
+		scaledDeployment(2, "kubectl-client-side-apply"),
+		autoscaler(2, 40),
+		// metrics alone do not make a change
+		autoscaler(2, 55),
+		autoscaler(4, 90),
+		scaledDeployment(4, ""),
+		scaledDeployment(6, "kubectl-scale"),
+		scaledDeployment(3, "argocd-controller"),
+		scaledDeployment(4, "kube-controller-manager"),
+	)
+
+	timeline, err := store.GetReplicaTimeline("default", "web", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, change := range timeline {
+		switch change.Kind {
+		case "Deployment":
+			got = append(got, fmt.Sprintf("%s %d %s", change.Kind, *change.SpecReplicas, change.Source))
+		case "HorizontalPodAutoscaler":
+			got = append(got, fmt.Sprintf("%s %d %s", change.Kind, change.DesiredReplicas, change.Metrics[0]))
+		}
+	}
+	want := []string{
+		"Deployment 2 ",
+		"HorizontalPodAutoscaler 2 cpu=40%",
+		"HorizontalPodAutoscaler 4 cpu=90%",
+		"Deployment 4 hpa",
+		"Deployment 6 manual",
+		"Deployment 3 gitops",
+		"Deployment 4 hpa",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected timeline %q", got)
+	}
+}
+
+func TestScaleSource(t *testing.T) {
+	for _, tc := range []struct {
+		manager    string
+		autoscaled bool
+		want       string
+	}{
+		{"kube-controller-manager", false, ScaleSourceHPA},
+		{"", true, ScaleSourceHPA},
+		{"kustomize-controller", true, ScaleSourceGitOps},
+		{"kubectl-edit", true, ScaleSourceManual},
+		{"", false, ScaleSourceUnknown},
+	} {
+		if got := scaleSource(tc.manager, tc.autoscaled); got != tc.want {
+			t.Errorf("scaleSource(%q, %v) = %s, want %s", tc.manager, tc.autoscaled, got, tc.want)
+		}
+	}
+}
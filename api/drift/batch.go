@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// batchWriter queues writes, on a LevelDB batch or on a batch of the store.
+type batchWriter interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+}
+
+// pendingWrite is a write queued on a batch, not yet committed.
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// batch queues writes for a single atomic commit and serves reads of the keys
+// queued on it, or on the batch it was started from, so that everything a
+// write records, including what its detectors derive from other records, is
+// committed or retried as one, and builds on the writes committed with it.
+type batch struct {
+	leveldb.Batch
+	parent  *batch
+	pending map[string]pendingWrite
+}
+
+// newBatch starts a batch reading through the writes of parent, which may be nil.
+func newBatch(parent *batch) *batch {
+	return &batch{parent: parent, pending: map[string]pendingWrite{}}
+}
+
+func (b *batch) Put(key, value []byte) {
+	b.Batch.Put(key, value)
+	b.pending[string(key)] = pendingWrite{value: append([]byte(nil), value...)}
+}
+
+func (b *batch) Delete(key []byte) {
+	b.Batch.Delete(key)
+	b.pending[string(key)] = pendingWrite{deleted: true}
+}
+
+func (b *batch) Reset() {
+	b.Batch.Reset()
+	b.pending = map[string]pendingWrite{}
+}
+
+// appendTo queues the writes of b on parent.
+func (b *batch) appendTo(parent *batch) error {
+	return b.Batch.Replay(parent)
+}
+
+// lookup returns the write queued for key on b or the batches it was started
+// from, the latest first.
+func (b *batch) lookup(key string) (pendingWrite, bool) {
+	for ; b != nil; b = b.parent {
+		if w, ok := b.pending[key]; ok {
+			return w, true
+		}
+	}
+	return pendingWrite{}, false
+}
+
+// get reads the value of key through b, which may be nil.
+func (s *Store) get(b *batch, key string) ([]byte, error) {
+	if w, ok := b.lookup(key); ok {
+		if w.deleted {
+			return nil, leveldb.ErrNotFound
+		}
+		return w.value, nil
+	}
+	return s.db.Get([]byte(key), nil)
+}
+
+// set queues a write of key on b, or writes it without a batch.
+func (s *Store) set(b *batch, key string, value []byte) error {
+	if b == nil {
+		return s.put([]byte(key), value)
+	}
+	b.Put([]byte(key), value)
+	return nil
+}
+
+// remove queues the deletion of key on b, or deletes it without a batch.
+func (s *Store) remove(b *batch, key string) error {
+	if b == nil {
+		return s.delete([]byte(key))
+	}
+	b.Delete([]byte(key))
+	return nil
+}
+
+// scan calls fn with the key and value of every entry under prefix, read
+// through b, in key order.
+func (s *Store) scan(b *batch, prefix string, fn func(key string, value []byte)) error {
+	pending := map[string]pendingWrite{}
+	for p := b; p != nil; p = p.parent {
+		for key, w := range p.pending {
+			if _, ok := pending[key]; !ok && strings.HasPrefix(key, prefix) {
+				pending[key] = w
+			}
+		}
+	}
+	var queued []string
+	for key, w := range pending {
+		if !w.deleted {
+			queued = append(queued, key)
+		}
+	}
+	sort.Strings(queued)
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := string(iter.Key())
+		for len(queued) > 0 && queued[0] < key {
+			fn(queued[0], pending[queued[0]].value)
+			queued = queued[1:]
+		}
+		if _, ok := pending[key]; ok {
+			continue
+		}
+		fn(key, iter.Value())
+	}
+	for _, key := range queued {
+		fn(key, pending[key].value)
+	}
+	return iter.Error()
+}
+
+// getDriftByKeyPrefix returns the records under a key prefix, read through b.
+func (s *Store) getDriftByKeyPrefix(b *batch, keyPrefix string) ([]KubeDrift, error) {
+	var drifts []KubeDrift
+	err := s.scan(b, keyPrefix, func(key string, value []byte) {
+		drift := KubeDrift{}
+		s.unmarshal(value, &drift)
+		drifts = append(drifts, drift)
+	})
+	return drifts, err
+}
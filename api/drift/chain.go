@@ -0,0 +1,524 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/klog/v2"
+)
+
+// Every history version carries a hash over the hash of the version before it,
+// its key and its document, chaining the versions of an object so that editing,
+// inserting or removing a version breaks every later link. The hash covers the
+// reconstructed document in canonical form, so it is unaffected by the codec,
+// delta encoding, archival or export the version goes through.
+//
+// The latest hash of each object is kept at
+//
+//	/chain/head<history prefix of the object>
+//
+// and checkpoints at /chain/checkpoint/<unixnano> periodically record every
+// head, chained to the checkpoint before them.
+//
+// The hashes are unkeyed and kept in the same store as the history, so on
+// their own they only detect accidental corruption and edits that do not
+// recompute the chain: whoever can write the store can rewrite a history
+// along with its hashes and checkpoints. A checkpoint published outside the
+// store commits to all history recorded up to it. With an archive, every
+// checkpoint is published to the bucket at checkpoints/<unixnano>.json, sealed
+// like archived segments when the store has a keyring, and VerifyChain checks
+// the store against them; otherwise only the hashes logged by the operator
+// are kept outside it.
+const (
+	chainHeadPrefix       = "/chain/head"
+	chainCheckpointPrefix = "/chain/checkpoint/"
+
+	checkpointObjectPrefix = "checkpoints/"
+)
+
+// canonicalJSON re-encodes a JSON document with sorted keys and normalized
+// numbers, the form every codec reproduces.
+func canonicalJSON(doc []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// chainHash returns the hash linking the version at key to the version hashed prev.
+func chainHash(prev, key string, doc []byte) (string, error) {
+	canonical, err := canonicalJSON(doc)
+	if err != nil {
+		return "", err
+	}
+	return hashValue([]byte(prev + "\n" + key + "\n" + string(canonical))), nil
+}
+
+// chainHead returns the hash of the latest version of the object with the given
+// history prefix, or "" before its first chained version.
+func (s *Store) chainHead(object string) (string, error) {
+	data, err := s.db.Get([]byte(chainHeadPrefix+object), nil)
+	if err == leveldb.ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	head := ""
+	err = s.unmarshal(data, &head)
+	return head, err
+}
+
+// setChainHead queues on batch the new head of an object's chain.
+func (s *Store) setChainHead(batch batchWriter, object, hash string) error {
+	value, err := s.encode(hash)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(chainHeadPrefix+object), value)
+	return nil
+}
+
+// Checkpoint records the head of every object's chain at a point in time.
+type Checkpoint struct {
+	Time  time.Time         `json:"time"`
+	Prev  string            `json:"prev"`
+	Heads map[string]string `json:"heads"`
+	Hash  string            `json:"hash"`
+}
+
+func (c Checkpoint) hash() string {
+	var b strings.Builder
+	b.WriteString(c.Prev + "\n" + c.Time.UTC().Format(time.RFC3339Nano) + "\n")
+	for _, object := range sortedKeys(c.Heads) {
+		b.WriteString(object + " " + c.Heads[object] + "\n")
+	}
+	return hashValue([]byte(b.String()))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetCheckpoints returns the stored checkpoints, oldest first.
+func (s *Store) GetCheckpoints() ([]Checkpoint, error) {
+	var checkpoints []Checkpoint
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(chainCheckpointPrefix)), nil)
+	for iter.Next() {
+		c := Checkpoint{}
+		if err := s.unmarshal(iter.Value(), &c); err != nil {
+			klog.Errorf("error decoding checkpoint %s: %v", iter.Key(), err)
+			continue
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	iter.Release()
+	return checkpoints, iter.Error()
+}
+
+// CreateCheckpoint records the current head of every chain, unless no head
+// changed since the last checkpoint, and returns the latest checkpoint.
+func (s *Store) CreateCheckpoint(now time.Time) (Checkpoint, error) {
+	c := Checkpoint{Time: now.UTC(), Heads: map[string]string{}}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return c, err
+	}
+	defer snap.Release()
+
+	iter := snap.NewIterator(util.BytesPrefix([]byte(chainHeadPrefix)), nil)
+	for iter.Next() {
+		head := ""
+		if err := s.unmarshal(iter.Value(), &head); err != nil {
+			iter.Release()
+			return c, fmt.Errorf("error decoding chain head %s: %v", iter.Key(), err)
+		}
+		c.Heads[strings.TrimPrefix(string(iter.Key()), chainHeadPrefix)] = head
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return c, err
+	}
+
+	last := Checkpoint{}
+	iter = snap.NewIterator(util.BytesPrefix([]byte(chainCheckpointPrefix)), nil)
+	if iter.Last() {
+		if err := s.unmarshal(iter.Value(), &last); err != nil {
+			iter.Release()
+			return c, fmt.Errorf("error decoding checkpoint %s: %v", iter.Key(), err)
+		}
+	}
+	iter.Release()
+	if last.Hash != "" && equalHeads(last.Heads, c.Heads) {
+		return last, nil
+	}
+
+	c.Prev = last.Hash
+	c.Hash = c.hash()
+	value, err := s.encode(c)
+	if err != nil {
+		return c, err
+	}
+	if err := s.put([]byte(fmt.Sprintf("%s%019d", chainCheckpointPrefix, c.Time.UnixNano())), value); err != nil {
+		return c, err
+	}
+	klog.Infof("chain checkpoint %s at %s over %d objects", c.Hash, c.Time.Format(time.RFC3339), len(c.Heads))
+	return c, nil
+}
+
+func equalHeads(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// RunCheckpoints creates a checkpoint every interval until ctx is done, and
+// publishes it to the archive, if any.
+func (s *Store) RunCheckpoints(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if _, err := s.CreateCheckpoint(time.Now()); err != nil {
+				klog.Errorf("chain checkpoint: %v", err)
+				continue
+			}
+			if s.archive == nil {
+				continue
+			}
+			if _, err := s.PublishCheckpoints(ctx); err != nil {
+				klog.Errorf("publishing chain checkpoints: %v", err)
+			}
+		}
+	}
+}
+
+func checkpointObjectName(c Checkpoint) string {
+	return fmt.Sprintf("%s%019d.json", checkpointObjectPrefix, c.Time.UnixNano())
+}
+
+// PublishCheckpoints uploads the checkpoints not yet in the archive, oldest
+// first, and returns how many it uploaded. A checkpoint failing to upload is
+// uploaded by the next call.
+func (s *Store) PublishCheckpoints(ctx context.Context) (int, error) {
+	if s.archive == nil {
+		return 0, fmt.Errorf("no archive configured")
+	}
+	names, err := s.archive.List(ctx, checkpointObjectPrefix)
+	if err != nil {
+		return 0, err
+	}
+	published := map[string]bool{}
+	for _, name := range names {
+		published[name] = true
+	}
+
+	checkpoints, err := s.GetCheckpoints()
+	if err != nil {
+		return 0, err
+	}
+	uploaded := 0
+	for _, c := range checkpoints {
+		name := checkpointObjectName(c)
+		if published[name] {
+			continue
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return uploaded, err
+		}
+		// the heads name every object recorded
+		if data, err = s.seal(data); err != nil {
+			return uploaded, err
+		}
+		if err := s.archive.Put(ctx, name, data); err != nil {
+			return uploaded, err
+		}
+		uploaded++
+	}
+	return uploaded, nil
+}
+
+// publishedCheckpoints reads the checkpoints published to the archive, keyed
+// by object name.
+func (s *Store) publishedCheckpoints(ctx context.Context) (map[string]Checkpoint, error) {
+	published := map[string]Checkpoint{}
+	if s.archive == nil {
+		return published, nil
+	}
+	names, err := s.archive.List(ctx, checkpointObjectPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := s.getArchived(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		c := Checkpoint{}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("error decoding published checkpoint %s: %v", name, err)
+		}
+		published[name] = c
+	}
+	return published, nil
+}
+
+// ChainBreak is a link of a chain that does not verify.
+type ChainBreak struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// ChainReport is the result of verifying the hash chains.
+type ChainReport struct {
+	Objects     int      `json:"objects"`
+	Versions    int      `json:"versions"`
+	Unchained   int      `json:"unchained"`
+	Checkpoints int      `json:"checkpoints"`
+	Truncated   []string `json:"truncated,omitempty"`
+	// LatestCheckpoint is the hash of the newest checkpoint verified.
+	LatestCheckpoint string       `json:"latestCheckpoint,omitempty"`
+	Breaks           []ChainBreak `json:"breaks"`
+}
+
+// VerifyChain recomputes the chain of every object over its local and archived
+// versions, checks it ends at the recorded head, and checks every checkpoint
+// links to the one before it and names versions still in the chains. Every
+// checkpoint published to the archive must be stored unchanged.
+//
+// Versions written before chaining are counted as unchained. An object whose
+// oldest version links to a version no longer stored, because retention deleted
+// it without an archive, is reported as truncated rather than broken.
+func (s *Store) VerifyChain() (ChainReport, error) {
+	report := ChainReport{}
+	broken := func(key, format string, args ...interface{}) {
+		report.Breaks = append(report.Breaks, ChainBreak{Key: key, Problem: fmt.Sprintf(format, args...)})
+	}
+
+	objects := map[string]bool{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(chainHeadPrefix)), nil)
+	for iter.Next() {
+		objects[strings.TrimPrefix(string(iter.Key()), chainHeadPrefix)] = true
+	}
+	iter.Release()
+	iter = s.db.NewIterator(util.BytesPrefix([]byte("/history/")), nil)
+	for iter.Next() {
+		objects[historyObjectPrefix(string(iter.Key()))] = true
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return report, err
+	}
+
+	// hashes of every verified version, and the objects missing their start
+	hashes := map[string]map[string]bool{}
+	truncated := map[string]bool{}
+
+	for _, object := range keys(objects) {
+		report.Objects++
+		versions, err := s.chainVersions(object)
+		if err != nil {
+			broken(object, "error reading versions: %v", err)
+			continue
+		}
+
+		hashes[object] = map[string]bool{}
+		expected := ""
+		for i, v := range versions {
+			report.Versions++
+			if v.Hash == "" {
+				report.Unchained++
+				expected = ""
+				continue
+			}
+			if v.Prev != expected {
+				if i == 0 || versions[i-1].Hash == "" {
+					truncated[object] = true
+					report.Truncated = append(report.Truncated, object)
+				} else {
+					broken(v.Key, "links to %s, expected %s", v.Prev, expected)
+				}
+			}
+			hash, err := chainHash(v.Prev, v.Key, v.Value)
+			if err != nil {
+				broken(v.Key, "undecodable version: %v", err)
+			} else if hash != v.Hash {
+				broken(v.Key, "content does not match its hash")
+			}
+			hashes[object][v.Hash] = true
+			expected = v.Hash
+		}
+
+		head, err := s.chainHead(object)
+		if err != nil {
+			broken(chainHeadPrefix+object, "undecodable head: %v", err)
+		} else if head != expected {
+			broken(chainHeadPrefix+object, "head %s does not match the last version %s", head, expected)
+		}
+	}
+
+	checkpoints, err := s.GetCheckpoints()
+	if err != nil {
+		return report, err
+	}
+	published, err := s.publishedCheckpoints(context.Background())
+	if err != nil {
+		return report, err
+	}
+	prev := ""
+	for _, c := range checkpoints {
+		report.Checkpoints++
+		key := fmt.Sprintf("%s%019d", chainCheckpointPrefix, c.Time.UnixNano())
+		if p, ok := published[checkpointObjectName(c)]; ok {
+			delete(published, checkpointObjectName(c))
+			if p.Hash != c.Hash {
+				broken(key, "hash %s does not match the published checkpoint %s", c.Hash, p.Hash)
+			}
+		}
+		if c.Prev != prev {
+			broken(key, "links to %s, expected %s", c.Prev, prev)
+		}
+		if c.hash() != c.Hash {
+			broken(key, "content does not match its hash")
+		}
+		for _, object := range sortedKeys(c.Heads) {
+			if !hashes[object][c.Heads[object]] && !truncated[object] {
+				broken(key, "checkpointed version %s of %s is missing or altered", c.Heads[object], object)
+			}
+		}
+		prev = c.Hash
+		report.LatestCheckpoint = c.Hash
+	}
+	for _, name := range sortedCheckpointNames(published) {
+		broken(name, "published checkpoint %s is missing from the store", published[name].Hash)
+	}
+	return report, nil
+}
+
+func sortedCheckpointNames(m map[string]Checkpoint) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// chainVersions returns every version of an object, archived and local, with
+// its document reconstructed, ordered by key.
+func (s *Store) chainVersions(object string) ([]exportLine, error) {
+	archived, err := s.archivedVersions(object, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var local []exportLine
+	docs := map[string][]byte{}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(object)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if rec.Patch != nil && docs[object] == nil && len(archived) > 0 {
+			// the base of a delta written while it was being archived
+			docs[object] = archived[len(archived)-1].Value
+		}
+		doc, err := versionDoc(object, rec, docs)
+		if err != nil {
+			iter.Release()
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		local = append(local, exportLine{Key: key, Value: doc, Hash: rec.Hash, Prev: rec.Prev})
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+
+	versions := append(archived, local...)
+	sort.SliceStable(versions, func(i, j int) bool { return versions[i].Key < versions[j].Key })
+	unique := versions[:0]
+	for i, v := range versions {
+		if i == 0 || v.Key != versions[i-1].Key {
+			unique = append(unique, v)
+		}
+	}
+	return unique, nil
+}
+
+func migrateChain(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	docs := map[string][]byte{}
+	object, head := "", ""
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("/history/")), nil)
+	defer iter.Release()
+	for iter.Next() {
+		key := string(iter.Key())
+		if o := historyObjectPrefix(key); o != object {
+			delete(docs, object)
+			object = o
+			var err error
+			if head, err = s.chainHead(object); err != nil {
+				return changed, err
+			}
+		}
+
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			klog.Errorf("migration: skipping undecodable version %s: %v", key, err)
+			continue
+		}
+		doc, err := versionDoc(object, rec, docs)
+		if err != nil {
+			klog.Errorf("migration: skipping version %s: %v", key, err)
+			continue
+		}
+		if rec.Hash != "" {
+			head = rec.Hash
+			continue
+		}
+
+		rec.Prev = head
+		if rec.Hash, err = chainHash(head, key, doc); err != nil {
+			return changed, err
+		}
+		value, err := s.encode(rec)
+		if err != nil {
+			return changed, err
+		}
+		batch.Put([]byte(key), value)
+		if err := s.setChainHead(batch, object, rec.Hash); err != nil {
+			return changed, err
+		}
+		head = rec.Hash
+		changed++
+	}
+	return changed, iter.Error()
+}
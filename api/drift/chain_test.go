@@ -0,0 +1,200 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func saveRestarts(t *testing.T, store *Store, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.Status.ContainerStatuses[0].RestartCount = int32(i)
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func historyKeys(t *testing.T, store *Store) []string {
+	t.Helper()
+	var keys []string
+	iter := store.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if strings.HasPrefix(string(iter.Key()), "/history/") {
+			keys = append(keys, string(iter.Key()))
+		}
+	}
+	iter.Release()
+	return keys
+}
+
+func TestVerifyChainDetectsTampering(t *testing.T) {
+	store := newTestStore(t)
+	saveRestarts(t, store, 5)
+	checkpoint, err := store.CreateCheckpoint(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := store.CreateCheckpoint(time.Now()); again.Hash != checkpoint.Hash {
+		t.Error("expected no new checkpoint without new versions")
+	}
+
+	report, err := store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 || report.Versions != 5 || report.LatestCheckpoint != checkpoint.Hash {
+		t.Fatalf("unexpected report of an untouched store %+v", report)
+	}
+
+	// rewrite the third version with different content, keeping its hash
+	keys := historyKeys(t, store)
+	versions, _ := store.GetHistory("pod", "default", "web-1")
+	data, _ := store.db.Get([]byte(keys[2]), nil)
+	rec, _ := store.decodeVersion(data)
+	versions[2].EventType = "forged"
+	rec.Snapshot, _ = json.Marshal(versions[2])
+	rec.Patch = nil
+	value, _ := store.encode(rec)
+	store.db.Put([]byte(keys[2]), value, nil)
+
+	report, err = store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// later deltas apply on top of the forged content, so they break too
+	if len(report.Breaks) != 3 || report.Breaks[0].Key != keys[2] {
+		t.Errorf("expected the chain to break from the forged version on, got %+v", report.Breaks)
+	}
+
+	// removing the latest version leaves the head and checkpoint dangling
+	store.db.Delete([]byte(keys[4]), nil)
+	report, err = store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 4 {
+		t.Errorf("expected the forged versions, head and checkpoint to break, got %+v", report.Breaks)
+	}
+}
+
+func TestVerifyChainAgainstPublishedCheckpoints(t *testing.T) {
+	store := newTestStore(t)
+	store.SetArchive(newFakeS3(t, "drift"))
+	saveRestarts(t, store, 3)
+	checkpoint, err := store.CreateCheckpoint(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []int{1, 0} {
+		if n, err := store.PublishCheckpoints(context.Background()); err != nil || n != want {
+			t.Fatalf("publish %d: expected %d checkpoints uploaded, got %d, %v", i, want, n, err)
+		}
+	}
+
+	report, err := store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 || report.LatestCheckpoint != checkpoint.Hash {
+		t.Fatalf("unexpected report of an untouched store %+v", report)
+	}
+
+	// a history rewritten with its checkpoints no longer matches the bucket
+	store.db.Delete([]byte(fmt.Sprintf("%s%019d", chainCheckpointPrefix, checkpoint.Time.UnixNano())), nil)
+	report, err = store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 1 || !strings.Contains(report.Breaks[0].Problem, "missing from the store") {
+		t.Errorf("expected the published checkpoint to be reported missing, got %+v", report.Breaks)
+	}
+}
+
+func TestChainSurvivesArchiveAndExport(t *testing.T) {
+	src := newTestStore(t)
+	if _, err := src.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	src.SetArchive(newFakeS3(t, "drift"))
+	src.SetRetention(time.Hour)
+
+	base := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	saveVersionsAt(t, src, base, 20)
+	if _, err := src.ApplyRetention(context.Background(), base.Add(200*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := src.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 || report.Versions != 20 || report.Unchained != 0 {
+		t.Fatalf("unexpected report after archival %+v", report)
+	}
+
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive, ExportFilter{}, false); err != nil {
+		t.Fatal(err)
+	}
+	dst := newTestStore(t)
+	if _, err := dst.Import(&archive); err != nil {
+		t.Fatal(err)
+	}
+	// only the local versions are exported; they link to the archived ones
+	report, err = dst.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 || report.Versions != 6 || len(report.Truncated) != 1 {
+		t.Errorf("unexpected report after import %+v", report)
+	}
+}
+
+func TestMigrateChain(t *testing.T) {
+	store := newTestStore(t)
+	saveRestarts(t, store, 3)
+
+	// strip the chain, as in a store written before versions were hashed
+	batch := new(leveldb.Batch)
+	for _, key := range historyKeys(t, store) {
+		data, _ := store.db.Get([]byte(key), nil)
+		rec, _ := store.decodeVersion(data)
+		rec.Hash, rec.Prev = "", ""
+		value, _ := store.encode(rec)
+		batch.Put([]byte(key), value)
+	}
+	batch.Delete([]byte(chainHeadPrefix + historyPrefix("pod", "default", "web-1")))
+	store.db.Write(batch, nil)
+
+	if report, _ := store.VerifyChain(); report.Unchained != 3 {
+		t.Fatalf("expected 3 unchained versions, got %+v", report)
+	}
+
+	batch = new(leveldb.Batch)
+	changed, err := migrateChain(store, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+	if changed != 3 {
+		t.Errorf("expected 3 versions chained, got %d", changed)
+	}
+	report, err := store.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 || report.Unchained != 0 {
+		t.Errorf("unexpected report after migration %+v", report)
+	}
+}
@@ -0,0 +1,389 @@
+package provider
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ConfigRef is a ConfigMap or Secret a pod mounts or reads environment from.
+type ConfigRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// ConfigChange records which keys of a ConfigMap or Secret changed and when.
+type ConfigChange struct {
+	Kind        string    `json:"kind"`
+	Namespace   string    `json:"namespace"`
+	Name        string    `json:"name"`
+	ChangedKeys []string  `json:"changedKeys"`
+	ChangedAt   time.Time `json:"changedAt"`
+}
+
+func (c *ConfigChange) GetKey() string {
+	return fmt.Sprintf("%s%019d", configChangePrefix(c.Kind, c.Namespace, c.Name), c.ChangedAt.UnixNano())
+}
+
+func configChangePrefix(kind, namespace, name string) string {
+	return fmt.Sprintf("/configchange/%s/%s/%s/", kind, namespace, name)
+}
+
+// StaleConfig is a pod whose containers started before the latest change of a
+// ConfigMap or Secret it references.
+type StaleConfig struct {
+	Namespace   string    `json:"namespace"`
+	Pod         string    `json:"pod"`
+	StartedAt   time.Time `json:"startedAt"`
+	ConfigRef   ConfigRef `json:"configRef"`
+	ChangedKeys []string  `json:"changedKeys"`
+	ChangedAt   time.Time `json:"changedAt"`
+}
+
+func hashValue(v []byte) string {
+	sum := sha256.Sum256(v)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// secretHashKeyKey holds the key Secret values are hashed with when no key is
+// given from outside the store.
+const secretHashKeyKey = "/meta/secret-hash-key"
+
+// secretHashKey keys the HMAC Secret values are recorded as, so that the
+// hashes of low entropy values, such as passwords, cannot be brute-forced
+// without it.
+var secretHashKey []byte
+
+// SetSecretHashKey sets the key Secret values are hashed with. It is called
+// before any object is recorded.
+func SetSecretHashKey(key []byte) {
+	secretHashKey = key
+}
+
+// LoadSecretHashKey hashes Secret values with the key kept in the store,
+// generating it on first use, and encrypted with the store when it has a
+// keyring. The key is only as safe as the store: a key
+// given with SetSecretHashKey from outside it also protects the hashes from
+// readers of the store.
+func (s *Store) LoadSecretHashKey() error {
+	var key []byte
+	data, err := s.db.Get([]byte(secretHashKeyKey), nil)
+	switch {
+	case err == nil:
+		err = s.unmarshal(data, &key)
+	case err == leveldb.ErrNotFound:
+		key = make([]byte, 32)
+		if _, err = rand.Read(key); err != nil {
+			return err
+		}
+		if data, err = s.encode(key); err == nil {
+			err = s.put([]byte(secretHashKeyKey), data)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	SetSecretHashKey(key)
+	return nil
+}
+
+func hashSecret(v []byte) string {
+	mac := hmac.New(sha256.New, secretHashKey)
+	mac.Write(v)
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func withoutLastApplied(annotations map[string]string) map[string]string {
+	if _, ok := annotations[v1.LastAppliedConfigAnnotation]; !ok {
+		return annotations
+	}
+	a := map[string]string{}
+	for k, v := range annotations {
+		if k != v1.LastAppliedConfigAnnotation {
+			a[k] = v
+		}
+	}
+	return a
+}
+
+func configRefs(o v1.Pod) []ConfigRef {
+	seen := map[ConfigRef]bool{}
+	var refs []ConfigRef
+	add := func(kind, name string) {
+		ref := ConfigRef{Kind: kind, Name: name}
+		if name == "" || seen[ref] {
+			return
+		}
+		seen[ref] = true
+		refs = append(refs, ref)
+	}
+
+	for _, vol := range o.Spec.Volumes {
+		if vol.ConfigMap != nil {
+			add("configmap", vol.ConfigMap.Name)
+		}
+		if vol.Secret != nil {
+			add("secret", vol.Secret.SecretName)
+		}
+		if vol.Projected != nil {
+			for _, src := range vol.Projected.Sources {
+				if src.ConfigMap != nil {
+					add("configmap", src.ConfigMap.Name)
+				}
+				if src.Secret != nil {
+					add("secret", src.Secret.Name)
+				}
+			}
+		}
+	}
+
+	containers := make([]v1.Container, 0, len(o.Spec.InitContainers)+len(o.Spec.Containers))
+	containers = append(containers, o.Spec.InitContainers...)
+	containers = append(containers, o.Spec.Containers...)
+	for _, c := range containers {
+		for _, from := range c.EnvFrom {
+			if from.ConfigMapRef != nil {
+				add("configmap", from.ConfigMapRef.Name)
+			}
+			if from.SecretRef != nil {
+				add("secret", from.SecretRef.Name)
+			}
+		}
+		for _, env := range c.Env {
+			if env.ValueFrom == nil {
+				continue
+			}
+			if env.ValueFrom.ConfigMapKeyRef != nil {
+				add("configmap", env.ValueFrom.ConfigMapKeyRef.Name)
+			}
+			if env.ValueFrom.SecretKeyRef != nil {
+				add("secret", env.ValueFrom.SecretKeyRef.Name)
+			}
+		}
+	}
+	return refs
+}
+
+func changedKeys(prev, cur map[string]string) []string {
+	var changed []string
+	for k, v := range cur {
+		if pv, ok := prev[k]; !ok || pv != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range prev {
+		if _, ok := cur[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// podStatus decodes the status of a pod drift, which is a v1.PodStatus when
+// freshly built and a generic map when read back from the store.
+func podStatus(drift KubeDrift) (v1.PodStatus, error) {
+	status := v1.PodStatus{}
+	if s, ok := drift.Status.(v1.PodStatus); ok {
+		return s, nil
+	}
+	data, err := json.Marshal(drift.Status)
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(data, &status)
+	return status, err
+}
+
+// podStartedAt returns the start time of the oldest running container of a pod,
+// which is when it last loaded its configuration.
+func podStartedAt(drift KubeDrift) (time.Time, error) {
+	status, err := podStatus(drift)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var started time.Time
+	for _, cs := range status.ContainerStatuses {
+		if cs.State.Running == nil {
+			continue
+		}
+		t := cs.State.Running.StartedAt.Time
+		if started.IsZero() || t.Before(started) {
+			started = t
+		}
+	}
+	if started.IsZero() && status.StartTime != nil {
+		started = status.StartTime.Time
+	}
+	return started, nil
+}
+
+// trackConfig records a ConfigChange when a ConfigMap or Secret changed since
+// it was last stored and re-evaluates the pods that reference it.
+func (s *Store) trackConfig(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if prev == nil {
+		return nil
+	}
+
+	changed := changedKeys(prev.Data, drift.Data)
+	if len(changed) == 0 {
+		return nil
+	}
+
+	change := ConfigChange{
+		Kind:        drift.Type,
+		Namespace:   drift.MetaData.Namespace,
+		Name:        drift.MetaData.Name,
+		ChangedKeys: changed,
+		ChangedAt:   time.Now().UTC(),
+	}
+	data, err := s.encode(change)
+	if err != nil {
+		return err
+	}
+	if err := s.set(b, change.GetKey(), data); err != nil {
+		return err
+	}
+	klog.Infof("config change %s: %s", change.GetKey(), strings.Join(changed, ", "))
+
+	pods, err := s.getDriftByKeyPrefix(b, fmt.Sprintf("/pod/%s/", change.Namespace))
+	if err != nil {
+		return err
+	}
+	ref := ConfigRef{Kind: change.Kind, Name: change.Name}
+	for _, pod := range pods {
+		if pod.EventType == EventTypeDeleted || !hasConfigRef(pod, ref) {
+			continue
+		}
+		if err := s.checkPodConfig(b, pod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hasConfigRef(pod KubeDrift, ref ConfigRef) bool {
+	for _, r := range pod.ConfigRefs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// GetLatestConfigChange returns the most recent change of a ConfigMap or Secret.
+func (s *Store) GetLatestConfigChange(kind, namespace, name string) (ConfigChange, error) {
+	return s.latestConfigChange(nil, kind, namespace, name)
+}
+
+func (s *Store) latestConfigChange(b *batch, kind, namespace, name string) (ConfigChange, error) {
+	change := ConfigChange{}
+	var latest []byte
+	err := s.scan(b, configChangePrefix(kind, namespace, name), func(key string, value []byte) {
+		latest = value
+	})
+	if err != nil {
+		return change, err
+	}
+	if latest == nil {
+		return change, leveldb.ErrNotFound
+	}
+	err = s.unmarshal(latest, &change)
+	return change, err
+}
+
+// staleConfigs returns the configuration a pod is running with that changed
+// after it started. A deleted pod runs with none.
+func (s *Store) staleConfigs(b *batch, pod KubeDrift) ([]StaleConfig, error) {
+	if pod.EventType == EventTypeDeleted {
+		return nil, nil
+	}
+	started, err := podStartedAt(pod)
+	if err != nil || started.IsZero() {
+		return nil, err
+	}
+
+	var stale []StaleConfig
+	for _, ref := range pod.ConfigRefs {
+		change, err := s.latestConfigChange(b, ref.Kind, pod.MetaData.Namespace, ref.Name)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if started.Before(change.ChangedAt) {
+			stale = append(stale, StaleConfig{
+				Namespace:   pod.MetaData.Namespace,
+				Pod:         pod.MetaData.Name,
+				StartedAt:   started,
+				ConfigRef:   ref,
+				ChangedKeys: change.ChangedKeys,
+				ChangedAt:   change.ChangedAt,
+			})
+		}
+	}
+	return stale, nil
+}
+
+// checkPodConfig raises a StaleConfig finding for a pod running with outdated
+// configuration, and clears it once the pod has been restarted or deleted.
+func (s *Store) checkPodConfig(b *batch, pod KubeDrift) error {
+	stale, err := s.staleConfigs(b, pod)
+	if err != nil {
+		return err
+	}
+
+	finding := Finding{
+		Type:      "StaleConfig",
+		Severity:  SeverityWarning,
+		Kind:      "Pod",
+		Namespace: pod.MetaData.Namespace,
+		Name:      pod.MetaData.Name,
+		UID:       pod.MetaData.UID,
+	}
+	if len(stale) == 0 {
+		return s.clearFinding(b, finding.GetKey())
+	}
+
+	var refs []string
+	for _, sc := range stale {
+		refs = append(refs, fmt.Sprintf("%s/%s (changed %s)", sc.ConfigRef.Kind, sc.ConfigRef.Name, sc.ChangedAt.Format(time.RFC3339)))
+	}
+	finding.Message = fmt.Sprintf("pod started %s is running with stale config: %s", stale[0].StartedAt.Format(time.RFC3339), strings.Join(refs, ", "))
+	return s.saveFinding(b, finding)
+}
+
+// GetStaleConfigs returns the live pods, optionally limited to a namespace,
+// that reference a ConfigMap or Secret changed after they started.
+func (s *Store) GetStaleConfigs(namespace string) ([]StaleConfig, error) {
+	prefix := "/pod/"
+	if namespace != "" {
+		prefix = fmt.Sprintf("/pod/%s/", namespace)
+	}
+	pods, err := s.GetDriftByKeyPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var stale []StaleConfig
+	for _, pod := range pods {
+		sc, err := s.staleConfigs(nil, pod)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, sc...)
+	}
+	return stale, nil
+}
@@ -0,0 +1,161 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func withSecretHashKey(t *testing.T, key string) {
+	t.Helper()
+	prev := secretHashKey
+	SetSecretHashKey([]byte(key))
+	t.Cleanup(func() { SetSecretHashKey(prev) })
+}
+
+func testSecret(password string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default", UID: "uid-secret"},
+		Data:       map[string][]byte{"password": []byte(password)},
+	}
+}
+
+func testConfigMap(level string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "default", UID: "uid-settings"},
+		Data:       map[string]string{"level": level},
+	}
+}
+
+func TestSecretValuesKeyedHash(t *testing.T) {
+	withSecretHashKey(t, "install-a")
+	hashed := New(testSecret("hunter2"), "update").Data["password"]
+	if !strings.HasPrefix(hashed, "hmac-sha256:") || strings.Contains(hashed, "hunter2") {
+		t.Fatalf("expected a keyed hash of the value, got %q", hashed)
+	}
+	if hashed == hashValue([]byte("hunter2")) {
+		t.Errorf("expected the hash not to be the plain sha256 of the value")
+	}
+	if again := New(testSecret("hunter2"), "update").Data["password"]; again != hashed {
+		t.Errorf("expected the same value to hash the same, got %q and %q", hashed, again)
+	}
+
+	SetSecretHashKey([]byte("install-b"))
+	if other := New(testSecret("hunter2"), "update").Data["password"]; other == hashed {
+		t.Errorf("expected another key to hash the value differently")
+	}
+}
+
+func TestConfigMapBinaryDataHashed(t *testing.T) {
+	cm := testConfigMap("info")
+	cm.BinaryData = map[string][]byte{"cert": []byte("binary")}
+	data := New(cm, "update").Data
+	if data["level"] != "info" || data["cert"] != hashValue([]byte("binary")) {
+		t.Errorf("expected text data kept and binary data hashed, got %v", data)
+	}
+}
+
+func TestLoadSecretHashKeyPersists(t *testing.T) {
+	withSecretHashKey(t, "")
+	dir := t.TempDir()
+	store := &Store{}
+	if err := store.New(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.LoadSecretHashKey(); err != nil {
+		t.Fatal(err)
+	}
+	first := append([]byte(nil), secretHashKey...)
+	store.Close()
+
+	if err := store.New(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.LoadSecretHashKey(); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 || !reflect.DeepEqual(first, secretHashKey) {
+		t.Errorf("expected the generated key to be reused, got %x and %x", first, secretHashKey)
+	}
+}
+
+func TestTrackConfig(t *testing.T) {
+	withSecretHashKey(t, "install-a")
+	store := newTestStore(t)
+	saveAll(t, store, testConfigMap("info"), testConfigMap("info"), testConfigMap("debug"))
+
+	change, err := store.GetLatestConfigChange("configmap", "default", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(change.ChangedKeys, []string{"level"}) {
+		t.Errorf("expected level to have changed, got %v", change.ChangedKeys)
+	}
+
+	saveAll(t, store, testSecret("hunter2"), testSecret("correct horse"))
+	if change, err := store.GetLatestConfigChange("secret", "default", "db"); err != nil || change.ChangedKeys[0] != "password" {
+		t.Errorf("expected the password change to be recorded, got %+v, %v", change, err)
+	}
+}
+
+func configPod(started time.Time) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api-0", Namespace: "default", UID: types.UID("uid-api-0")},
+		Spec: v1.PodSpec{Containers: []v1.Container{{
+			Name:    "api",
+			EnvFrom: []v1.EnvFromSource{{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}}},
+		}}},
+		Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+			Name:  "api",
+			State: v1.ContainerState{Running: &v1.ContainerStateRunning{StartedAt: metav1.NewTime(started)}},
+		}}},
+	}
+}
+
+func TestStaleConfigLifecycle(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store, testConfigMap("info"), configPod(time.Now().Add(-time.Hour)), testConfigMap("debug"))
+
+	findings, _ := store.GetFindings("/StaleConfig/")
+	if len(findings) != 1 || findings[0].Name != "api-0" || !strings.Contains(findings[0].Message, "configmap/settings") {
+		t.Fatalf("expected a stale config finding for api-0, got %+v", findings)
+	}
+	if stale, _ := store.GetStaleConfigs("default"); len(stale) != 1 {
+		t.Errorf("expected api-0 to be reported stale, got %+v", stale)
+	}
+
+	// restarted after the change
+	saveAll(t, store, configPod(time.Now().Add(time.Second)))
+	if findings, _ := store.GetFindings("/StaleConfig/"); len(findings) != 0 {
+		t.Errorf("expected the finding to clear once the pod restarted, got %+v", findings)
+	}
+}
+
+func TestDeletedPodConfigNotStale(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store, testConfigMap("info"), configPod(time.Now().Add(-time.Hour)), testConfigMap("debug"))
+
+	// the finding is resolved with the pod
+	if err := store.WriteDeletion(context.Background(), "pod", "default", "api-0"); err != nil {
+		t.Fatal(err)
+	}
+	if findings, _ := store.GetFindings("/StaleConfig/"); len(findings) != 0 {
+		t.Errorf("expected the finding to clear once the pod was deleted, got %+v", findings)
+	}
+
+	// nor is a deleted pod reported stale by later changes
+	saveAll(t, store, testConfigMap("warn"))
+	if findings, _ := store.GetFindings("/StaleConfig/"); len(findings) != 0 {
+		t.Errorf("expected no finding about the deleted pod, got %+v", findings)
+	}
+	if stale, _ := store.GetStaleConfigs("default"); len(stale) != 0 {
+		t.Errorf("expected the deleted pod not to be reported stale, got %+v", stale)
+	}
+}
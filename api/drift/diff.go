@@ -0,0 +1,85 @@
+package provider
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Change is a single field that differs between two versions of an object.
+type Change struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// VersionDiff lists the changes between two successive stored versions of an object.
+type VersionDiff struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Changes []Change  `json:"changes"`
+}
+
+// Diff returns the changes from prev to cur after applying rules to both.
+func Diff(prev, cur KubeDrift, rules []IgnoreRule) ([]Change, error) {
+	a, err := normalize(prev, rules)
+	if err != nil {
+		return nil, err
+	}
+	b, err := normalize(cur, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	diffValues("$", a, b, &changes)
+	return changes, nil
+}
+
+func diffValues(path string, a, b interface{}, changes *[]Change) {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for k := range av {
+			keys[k] = true
+		}
+		for k := range bv {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+		for _, k := range sorted {
+			diffValues(childPath(path, k), av[k], bv[k], changes)
+		}
+		return
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			break
+		}
+		for i := range av {
+			diffValues(fmt.Sprintf("%s[%d]", path, i), av[i], bv[i], changes)
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		*changes = append(*changes, Change{Path: path, Old: a, New: b})
+	}
+}
+
+func childPath(path, key string) string {
+	if strings.ContainsAny(key, ".[]'") {
+		return fmt.Sprintf("%s['%s']", path, key)
+	}
+	return path + "." + key
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"k8s.io/klog/v2"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,6 +16,36 @@ import (
 
 // APIRouter defines the usable API routes
 func APIRouter(r *mux.Router, store *Store) {
+	r.Path("/images").HandlerFunc(imagesHandler(store))
+	r.Path("/findings").HandlerFunc(findingsHandler(store))
+	r.Path("/findings/{type}").HandlerFunc(findingsHandler(store))
+	r.Path("/config/stale").HandlerFunc(staleConfigHandler(store))
+	r.Path("/config/stale/{namespace}").HandlerFunc(staleConfigHandler(store))
+	r.Path("/history/{kind}/{namespace}/{name}").HandlerFunc(historyHandler(store))
+	r.Path("/timeline/{kind}/{namespace}/{name}").HandlerFunc(timelineHandler(store))
+	r.Path("/diff/{kind}/{namespace}/{name}").HandlerFunc(diffHandler(store))
+	r.Path("/stats/history").HandlerFunc(historyStatsHandler(store))
+	r.Path("/stats/pipeline").HandlerFunc(pipelineStatsHandler(store))
+	r.Path("/stats/encryption").HandlerFunc(encryptionStatsHandler(store))
+	r.Path("/chain/verify").HandlerFunc(chainVerifyHandler(store))
+	r.Path("/chain/checkpoints").Methods(http.MethodGet).HandlerFunc(checkpointsHandler(store))
+	r.Path("/chain/checkpoints").Methods(http.MethodPost).HandlerFunc(createCheckpointHandler(store))
+	r.Path("/verify").HandlerFunc(verifyHandler(store))
+	r.Path("/schema").HandlerFunc(schemaHandler(store))
+	r.Path("/archive/segments").HandlerFunc(segmentsHandler(store))
+	r.Path("/query").HandlerFunc(queryHandler(store))
+	r.Path("/owned/{kind}/{namespace}/{name}").HandlerFunc(ownedHandler(store))
+	r.Path("/volumes/{namespace}/{claim}").HandlerFunc(volumeHandler(store))
+	r.Path("/replicas/{namespace}/{deployment}").HandlerFunc(replicasHandler(store))
+	r.Path("/eventseries/{namespace}").HandlerFunc(eventSeriesHandler(store))
+	r.Path("/eventseries/{namespace}/{kind}").HandlerFunc(eventSeriesHandler(store))
+	r.Path("/eventseries/{namespace}/{kind}/{name}").HandlerFunc(eventSeriesHandler(store))
+	r.Path("/quotas/{namespace}").HandlerFunc(quotasHandler(store))
+	r.Path("/permissions").HandlerFunc(permissionsHandler(store))
+	r.Path("/permissions/changes").HandlerFunc(permissionChangesHandler(store))
+	r.Path("/permissions/report").HandlerFunc(permissionReportHandler(store))
+	r.Path("/export").Methods(http.MethodGet).HandlerFunc(exportHandler(store))
+	r.Path("/import").Methods(http.MethodPost).HandlerFunc(importHandler(store))
 	r.Path("/{kind}").HandlerFunc(driftHandler(store))
 	r.Path("/{kind}/{namespace}").HandlerFunc(driftHandler(store))
 	r.Path("/{kind}/{namespace}/{template-hash}").HandlerFunc(driftHandler(store))
@@ -68,6 +100,349 @@ func driftHandler(store *Store) func(http.ResponseWriter, *http.Request) {
 	return fn
 }
 
+func imagesHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetImageRecords(r.URL.Query().Get("image"))
+		writeJSON(w, resp, err)
+	}
+}
+
+func findingsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prefix := ""
+		if t := mux.Vars(r)["type"]; t != "" {
+			prefix = fmt.Sprintf("/%s/", t)
+		}
+		resp, err := store.GetFindings(prefix)
+		writeJSON(w, resp, err)
+	}
+}
+
+func staleConfigHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetStaleConfigs(mux.Vars(r)["namespace"])
+		writeJSON(w, resp, err)
+	}
+}
+
+func historyHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetHistoryRange(vars["kind"], vars["namespace"], vars["name"], since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func timelineHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetTimeline(vars["kind"], vars["namespace"], vars["name"], since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func diffHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		resp, err := store.GetDiffs(vars["kind"], vars["namespace"], vars["name"])
+		writeJSON(w, resp, err)
+	}
+}
+
+func historyStatsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetHistoryStats(r.URL.Query().Get("prefix"))
+		writeJSON(w, resp, err)
+	}
+}
+
+func pipelineStatsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]int{
+			"queueDepth": store.QueueDepth(),
+			"queueSize":  cap(store.queue),
+		}
+		writeJSON(w, resp, nil)
+	}
+}
+
+func encryptionStatsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		usage, err := store.GetKeyUsage()
+		resp := map[string]interface{}{"values": usage}
+		if store.keys != nil {
+			resp["primary"] = store.keys.Primary()
+			resp["keys"] = store.keys.keyIDs()
+		}
+		writeJSON(w, resp, err)
+	}
+}
+
+func chainVerifyHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.VerifyChain()
+		writeJSON(w, resp, err)
+	}
+}
+
+func checkpointsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetCheckpoints()
+		writeJSON(w, resp, err)
+	}
+}
+
+func createCheckpointHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.CreateCheckpoint(time.Now())
+		writeJSON(w, resp, err)
+	}
+}
+
+// verifyHandler reports the problems Verify finds without repairing them; the
+// offline verify command repairs them.
+func verifyHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.Verify(false)
+		writeJSON(w, resp, err)
+	}
+}
+
+func schemaHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := store.SchemaVersion()
+		writeJSON(w, map[string]int{"version": version, "current": CurrentSchemaVersion}, err)
+	}
+}
+
+// parseTimeRange reads the since and until (RFC 3339) query parameters.
+func parseTimeRange(q url.Values) (since, until time.Time, err error) {
+	if v := q.Get("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		until, err = time.Parse(time.RFC3339, v)
+	}
+	return
+}
+
+// ParseExportFilter reads an export filter from kind, namespace, since and
+// until (RFC 3339) query parameters.
+func ParseExportFilter(q url.Values) (ExportFilter, error) {
+	since, until, err := parseTimeRange(q)
+	return ExportFilter{
+		Kind:      q.Get("kind"),
+		Namespace: q.Get("namespace"),
+		Since:     since,
+		Until:     until,
+	}, err
+}
+
+// queryHandler serves /query?kind=&namespace=&owner=&node=&involved=&label=name=value&since=&until=
+// from the secondary indexes; label may be repeated.
+func queryHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		since, until, err := parseTimeRange(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query := IndexQuery{
+			Kind:      q.Get("kind"),
+			Namespace: q.Get("namespace"),
+			Owner:     q.Get("owner"),
+			Node:      q.Get("node"),
+			Involved:  q.Get("involved"),
+			Labels:    map[string]string{},
+			Since:     since,
+			Until:     until,
+		}
+		for _, label := range q["label"] {
+			kv := strings.SplitN(label, "=", 2)
+			if len(kv) != 2 {
+				http.Error(w, fmt.Sprintf("invalid label selector %q", label), http.StatusBadRequest)
+				return
+			}
+			query.Labels[kv[0]] = kv[1]
+		}
+
+		resp, err := store.Query(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, resp, nil)
+	}
+}
+
+func volumeHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		resp, err := store.GetVolumeUsage(vars["namespace"], vars["claim"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, resp, nil)
+	}
+}
+
+func replicasHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetReplicaTimeline(vars["namespace"], vars["deployment"], since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func eventSeriesHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		resp, err := store.GetEventSeries(vars["namespace"], vars["kind"], vars["name"])
+		writeJSON(w, resp, err)
+	}
+}
+
+func quotasHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetQuotaUsage(mux.Vars(r)["namespace"], since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func permissionsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := r.URL.Query().Get("subject")
+		if subject == "" {
+			http.Error(w, "subject is required, e.g. ServiceAccount:default/deployer", http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetPermissions(subject)
+		writeJSON(w, resp, err)
+	}
+}
+
+func permissionChangesHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetPermissionChanges(r.URL.Query().Get("subject"), since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func permissionReportHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since, until, err := parseTimeRange(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := store.GetPermissionReport(since, until)
+		writeJSON(w, resp, err)
+	}
+}
+
+func ownedHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		uid, err := store.GetUID(vars["kind"], vars["namespace"], vars["name"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		resp, err := store.Query(IndexQuery{Owner: uid, Kind: r.URL.Query().Get("kind")})
+		writeJSON(w, resp, err)
+	}
+}
+
+func segmentsHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp, err := store.GetSegments()
+		writeJSON(w, resp, err)
+	}
+}
+
+func exportHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := ParseExportFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		compress := r.URL.Query().Get("gzip") == "true"
+
+		name := "kube-drift-export.tar"
+		w.Header().Set("Content-Type", "application/x-tar")
+		if compress {
+			name += ".gz"
+			w.Header().Set("Content-Type", "application/gzip")
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+		if _, err := store.Export(w, filter, compress); err != nil {
+			log.Errorf("Error exporting store: %v", err)
+		}
+	}
+}
+
+func importHandler(store *Store) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		manifest, err := store.Import(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, manifest, nil)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, resp interface{}, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(j)
+	if err != nil {
+		log.Errorf("Error cannot write response: %v", err)
+	}
+}
+
 func defaultHandler(w http.ResponseWriter, r *http.Request) {
 	msg := fmt.Sprintf("%v - URL: %s", time.Now(), r.URL)
 	_, err := w.Write([]byte(msg))
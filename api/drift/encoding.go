@@ -0,0 +1,264 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Stored values are wrapped in a versioned envelope:
+//
+//	bytes 0-1  magic "KD"
+//	byte  2    envelope version
+//	byte  3    encoding of the payload
+//	byte  4    compression of the payload
+//	bytes 5-   payload
+//
+// Values without the magic prefix predate the envelope and are plain JSON, so
+// records written by any earlier version of kube-drift remain readable. Values
+// of an encrypted store are sealed in a further envelope, see encryption.go.
+const (
+	envelopeVersion    = 1
+	envelopeHeaderSize = 5
+)
+
+var envelopeMagic = []byte("KD")
+
+type Encoding byte
+
+const (
+	EncodingJSON Encoding = iota
+	// EncodingProtobuf encodes object records as the Record message of
+	// record.proto. The other values of the store, such as findings, have no
+	// schema of their own and are written as JSON.
+	EncodingProtobuf
+)
+
+type Compression byte
+
+const (
+	CompressionNone Compression = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// Codec selects how values are encoded and compressed when written. Values are
+// read back according to their envelope, whatever codec the store uses.
+type Codec struct {
+	Encoding    Encoding
+	Compression Compression
+}
+
+var DefaultCodec = Codec{Encoding: EncodingJSON, Compression: CompressionSnappy}
+
+// ParseCodec returns the codec named by an encoding (json, protobuf) and a
+// compression (none, snappy, zstd).
+func ParseCodec(encoding, compression string) (Codec, error) {
+	c := Codec{}
+	switch encoding {
+	case "json":
+		c.Encoding = EncodingJSON
+	case "protobuf":
+		c.Encoding = EncodingProtobuf
+	default:
+		return c, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	switch compression {
+	case "none":
+		c.Compression = CompressionNone
+	case "snappy":
+		c.Compression = CompressionSnappy
+	case "zstd":
+		c.Compression = CompressionZstd
+	default:
+		return c, fmt.Errorf("unknown compression %q", compression)
+	}
+	return c, nil
+}
+
+// SetCodec sets the codec used for values written from now on.
+func (s *Store) SetCodec(c Codec) {
+	s.codec = c
+}
+
+// Marshal encodes v with the codec's encoding, compresses it with the
+// codec's compression, and wraps it in an envelope.
+func (c Codec) Marshal(v interface{}) ([]byte, error) {
+	if c.Encoding == EncodingProtobuf {
+		switch drift := v.(type) {
+		case KubeDrift:
+			return c.marshalRecord(drift, nil)
+		case *KubeDrift:
+			return c.marshalRecord(*drift, nil)
+		}
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.wrap(payload)
+}
+
+// marshalRecord encodes an object record with the codec's encoding. doc is
+// the JSON of drift when already marshalled, or nil.
+func (c Codec) marshalRecord(drift KubeDrift, doc []byte) ([]byte, error) {
+	if c.Encoding == EncodingProtobuf {
+		payload, err := marshalRecordProto(drift)
+		if err != nil {
+			return nil, err
+		}
+		return c.envelope(EncodingProtobuf, payload)
+	}
+	if doc == nil {
+		var err error
+		if doc, err = json.Marshal(drift); err != nil {
+			return nil, err
+		}
+	}
+	return c.wrap(doc)
+}
+
+// wrap compresses a JSON document into an envelope.
+func (c Codec) wrap(doc []byte) ([]byte, error) {
+	return c.envelope(EncodingJSON, doc)
+}
+
+// envelope compresses a payload of an encoding into an envelope.
+func (c Codec) envelope(encoding Encoding, payload []byte) ([]byte, error) {
+	switch c.Compression {
+	case CompressionNone:
+	case CompressionSnappy:
+		payload = snappy.Encode(nil, payload)
+	case CompressionZstd:
+		payload = zstdEncoder().EncodeAll(payload, nil)
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c.Compression)
+	}
+
+	data := make([]byte, 0, envelopeHeaderSize+len(payload))
+	data = append(data, envelopeMagic...)
+	data = append(data, envelopeVersion, byte(encoding), byte(c.Compression))
+	return append(data, payload...), nil
+}
+
+// Unmarshal decodes a stored value of any supported envelope into v. Sealed
+// values are decoded by the store holding their keys.
+func Unmarshal(data []byte, v interface{}) error {
+	j, err := decodeEnvelope(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+// decodeEnvelope returns the JSON form of a stored value.
+func decodeEnvelope(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, envelopeMagic) {
+		return data, nil
+	}
+	if len(data) < envelopeHeaderSize {
+		return nil, fmt.Errorf("truncated record envelope")
+	}
+	if data[2] == sealedEnvelopeVersion {
+		return nil, fmt.Errorf("value is encrypted")
+	}
+	if data[2] != envelopeVersion {
+		return nil, fmt.Errorf("unsupported record envelope version %d", data[2])
+	}
+
+	payload := data[envelopeHeaderSize:]
+	var err error
+	switch Compression(data[4]) {
+	case CompressionNone:
+	case CompressionSnappy:
+		payload, err = snappy.Decode(nil, payload)
+	case CompressionZstd:
+		payload, err = zstdDecoder().DecodeAll(payload, nil)
+	default:
+		err = fmt.Errorf("unknown compression %d", data[4])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch Encoding(data[3]) {
+	case EncodingJSON:
+		return payload, nil
+	case EncodingProtobuf:
+		drift, err := unmarshalRecordProto(payload)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(drift)
+	}
+	return nil, fmt.Errorf("unknown encoding %d", data[3])
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func initZstd() {
+	var err error
+	if zstdEnc, err = zstd.NewWriter(nil); err != nil {
+		panic(err)
+	}
+	if zstdDec, err = zstd.NewReader(nil); err != nil {
+		panic(err)
+	}
+}
+
+func zstdEncoder() *zstd.Encoder {
+	zstdOnce.Do(initZstd)
+	return zstdEnc
+}
+
+func zstdDecoder() *zstd.Decoder {
+	zstdOnce.Do(initZstd)
+	return zstdDec
+}
+
+// encode wraps v in an envelope using the store's codec, sealed if the store
+// has a keyring.
+func (s *Store) encode(v interface{}) ([]byte, error) {
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(data)
+}
+
+// encodeRecord wraps an object record, whose JSON is doc, in an envelope
+// using the store's codec, sealed if the store has a keyring.
+func (s *Store) encodeRecord(drift KubeDrift, doc []byte) ([]byte, error) {
+	data, err := s.codec.marshalRecord(drift, doc)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(data)
+}
+
+// wrap wraps a JSON document in an envelope using the store's codec, sealed if
+// the store has a keyring.
+func (s *Store) wrap(doc []byte) ([]byte, error) {
+	data, err := s.codec.wrap(doc)
+	if err != nil {
+		return nil, err
+	}
+	return s.seal(data)
+}
+
+// unmarshal decodes a stored value, sealed or not, into v.
+func (s *Store) unmarshal(data []byte, v interface{}) error {
+	j, err := s.decode(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
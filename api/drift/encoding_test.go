@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	drift := *New(testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"), "update")
+	want, err := json.Marshal(drift)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, encoding := range []string{"json", "protobuf"} {
+		for _, compression := range []string{"none", "snappy", "zstd"} {
+			codec, err := ParseCodec(encoding, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := codec.Marshal(drift)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", encoding, compression, err)
+			}
+
+			got := KubeDrift{}
+			if err := Unmarshal(data, &got); err != nil {
+				t.Fatalf("%s/%s: %v", encoding, compression, err)
+			}
+			gotJSON, _ := json.Marshal(got)
+			if !jsonEqual(gotJSON, want) {
+				t.Errorf("%s/%s: round trip mismatch\n got %s\nwant %s", encoding, compression, gotJSON, want)
+			}
+		}
+	}
+}
+
+func TestUnmarshalLegacyJSON(t *testing.T) {
+	data := []byte(`{"type":"node","eventType":"update","metaData":{"name":"node-7"}}`)
+	got := KubeDrift{}
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != "node" || got.MetaData.Name != "node-7" {
+		t.Errorf("unexpected legacy record %+v", got)
+	}
+}
+
+func TestProtobufRecordSchema(t *testing.T) {
+	codec := Codec{Encoding: EncodingProtobuf, Compression: CompressionNone}
+	drift := *New(testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"), "update")
+	data, err := codec.Marshal(drift)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Encoding(data[3]) != EncodingProtobuf {
+		t.Fatalf("expected a protobuf envelope, got encoding %d", data[3])
+	}
+
+	// the payload is a Record of record.proto: its type is field 1
+	num, typ, n := protowire.ConsumeTag(data[envelopeHeaderSize:])
+	if n < 0 || num != 1 || typ != protowire.BytesType {
+		t.Fatalf("unexpected first field %d of type %d", num, typ)
+	}
+	if v, _ := protowire.ConsumeString(data[envelopeHeaderSize+n:]); v != "pod" {
+		t.Errorf("expected the record type, got %q", v)
+	}
+	got := KubeDrift{}
+	if err := Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.MetaData.OwnerReferences) != 1 || got.MetaData.OwnerReferences[0].Name != drift.MetaData.OwnerReferences[0].Name {
+		t.Errorf("expected the owner references to round trip, got %+v", got.MetaData.OwnerReferences)
+	}
+
+	// values without a schema are written as JSON
+	data, err = codec.Marshal(Finding{Type: "StaleConfig", Name: "web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Encoding(data[3]) != EncodingJSON {
+		t.Errorf("expected a finding to be written as JSON, got encoding %d", data[3])
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	drift := New(testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"), "update")
+	got := Deserialize(drift.Serialize())
+	if !reflect.DeepEqual(got.Images, drift.Images) || got.Status == nil {
+		t.Errorf("unexpected deserialized record %+v", got)
+	}
+}
+
+func TestMixedCodecHistory(t *testing.T) {
+	store := newTestStore(t)
+
+	for i, codec := range []Codec{
+		{EncodingJSON, CompressionNone},
+		{EncodingJSON, CompressionZstd},
+		{EncodingJSON, CompressionSnappy},
+		{EncodingProtobuf, CompressionZstd},
+	} {
+		store.SetCodec(codec)
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.Status.ContainerStatuses[0].RestartCount = int32(i)
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 4 {
+		t.Fatalf("expected 4 versions, got %d", len(history))
+	}
+	for i, version := range history {
+		status, err := podStatus(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := status.ContainerStatuses[0].RestartCount; got != int32(i) {
+			t.Errorf("version %d: expected restart count %d, got %d", i, i, got)
+		}
+	}
+}
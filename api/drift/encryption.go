@@ -0,0 +1,357 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"k8s.io/klog/v2"
+)
+
+// Encrypted values are sealed in an envelope of their own around the plain
+// envelope of the value:
+//
+//	bytes 0-1      magic "KD"
+//	byte  2        sealed envelope version
+//	byte  3        length n of the key id
+//	bytes 4-4+n    id of the key the value is sealed with
+//	next 12 bytes  nonce
+//	rest           AES-256-GCM ciphertext of the plain envelope
+//
+// The header is authenticated along with the value, so the key id cannot be
+// swapped. Stores hold values sealed with several keys while a rotation is in
+// progress, and plain values written before encryption was enabled.
+const (
+	sealedEnvelopeVersion = 2
+	keySize               = 32
+)
+
+// Values are re-encrypted in batches, each written while other writes are held
+// back.
+const reencryptBatch = 256
+
+// Keyring holds the keys values are sealed with. New values are sealed with the
+// primary key; values sealed with any key of the ring are opened.
+type Keyring struct {
+	primary string
+	aeads   map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of keys by id, each 32 bytes either raw or base64
+// encoded. primary may be empty when there is a single key.
+func NewKeyring(keys map[string][]byte, primary string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no encryption keys")
+	}
+	if primary == "" {
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("%d encryption keys and no primary key id", len(keys))
+		}
+		for id := range keys {
+			primary = id
+		}
+	}
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("no encryption key with id %q", primary)
+	}
+
+	k := &Keyring{primary: primary, aeads: map[string]cipher.AEAD{}}
+	for id, data := range keys {
+		if id == "" || len(id) > 255 {
+			return nil, fmt.Errorf("invalid encryption key id %q", id)
+		}
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s: %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == keySize {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("must be %d bytes, raw or base64 encoded", keySize)
+	}
+	return key, nil
+}
+
+// LoadKeyring reads the keys at path. A file holds a single key named after
+// the file; a directory, such as a mounted Secret, holds a key per file.
+func LoadKeyring(path, primary string) (*Keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, e := range entries {
+			// mounted Secrets hold their data in ..data, linked from the key files
+			if !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+
+	keys := map[string][]byte{}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		keys[filepath.Base(f)] = data
+	}
+	return NewKeyring(keys, primary)
+}
+
+// Primary returns the id of the key new values are sealed with.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// seal encrypts a plain value with the primary key.
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	aead := k.aeads[k.primary]
+	header := append([]byte{}, envelopeMagic...)
+	header = append(header, sealedEnvelopeVersion, byte(len(k.primary)))
+	header = append(header, k.primary...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, data, header), nil
+}
+
+// open decrypts a sealed value.
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	id, ok := sealedWith(data)
+	if !ok {
+		return nil, fmt.Errorf("truncated sealed envelope")
+	}
+	aead := k.aeads[id]
+	if aead == nil {
+		return nil, fmt.Errorf("value is sealed with key %q, which is not loaded", id)
+	}
+	header := data[:4+len(id)]
+	rest := data[len(header):]
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("truncated sealed envelope")
+	}
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], header)
+}
+
+// isSealed reports whether data is a sealed envelope.
+func isSealed(data []byte) bool {
+	return len(data) > 2 && bytes.HasPrefix(data, envelopeMagic) && data[2] == sealedEnvelopeVersion
+}
+
+// sealedWith returns the id of the key data is sealed with, and whether data is
+// a sealed envelope.
+func sealedWith(data []byte) (string, bool) {
+	if !isSealed(data) || len(data) < 4 || len(data) < 4+int(data[3]) {
+		return "", false
+	}
+	return string(data[4 : 4+int(data[3])]), true
+}
+
+// SetKeyring enables encryption of values written from now on, and decryption
+// of values sealed with the keys of k.
+func (s *Store) SetKeyring(k *Keyring) {
+	s.keys = k
+}
+
+// seal encrypts a plain envelope if the store has a keyring.
+func (s *Store) seal(data []byte) ([]byte, error) {
+	if s.keys == nil {
+		return data, nil
+	}
+	return s.keys.seal(data)
+}
+
+// decode returns the JSON form of a stored value, decrypting it first if it is
+// sealed.
+func (s *Store) decode(data []byte) ([]byte, error) {
+	if isSealed(data) {
+		if s.keys == nil {
+			id, _ := sealedWith(data)
+			return nil, fmt.Errorf("value is sealed with key %q and the store has no keys", id)
+		}
+		var err error
+		if data, err = s.keys.open(data); err != nil {
+			return nil, err
+		}
+	}
+	return decodeEnvelope(data)
+}
+
+// encryptable reports whether the value at key is encrypted when the store has
+// a keyring. Index entries, quarantined values and the schema version never are.
+func encryptable(key string, value []byte) bool {
+	return len(value) > 0 && key != schemaVersionKey && !strings.HasPrefix(key, quarantinePrefix+"/")
+}
+
+// stale reports whether the value at key should be re-encrypted with the
+// primary key.
+func (s *Store) stale(key string, value []byte) bool {
+	if !encryptable(key, value) {
+		return false
+	}
+	id, ok := sealedWith(value)
+	return !ok || id != s.keys.primary
+}
+
+// Reencrypt seals every value that is plain or sealed with another key with the
+// primary key, and returns how many were rewritten. Once it completes, keys no
+// longer primary can be removed from the keyring.
+func (s *Store) Reencrypt(ctx context.Context) (int, error) {
+	if s.keys == nil {
+		return 0, nil
+	}
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	rewritten := 0
+	var pending [][]byte
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if s.stale(string(iter.Key()), iter.Value()) {
+			pending = append(pending, append([]byte{}, iter.Key()...))
+		}
+		if len(pending) == reencryptBatch {
+			n, err := s.reencrypt(pending)
+			rewritten += n
+			if err != nil {
+				return rewritten, err
+			}
+			pending = nil
+			if ctx.Err() != nil {
+				return rewritten, ctx.Err()
+			}
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return rewritten, err
+	}
+	n, err := s.reencrypt(pending)
+	return rewritten + n, err
+}
+
+// reencrypt rewrites the values at keys. The values are read again while
+// writes are held back, so a value written since the snapshot is not
+// overwritten with an older one.
+func (s *Store) reencrypt(keys [][]byte) (int, error) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		value, err := s.db.Get(key, nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !s.stale(string(key), value) {
+			continue
+		}
+		if isSealed(value) {
+			if value, err = s.keys.open(value); err != nil {
+				klog.Errorf("reencrypt: skipping %s: %v", key, err)
+				continue
+			}
+		}
+		value, err = s.keys.seal(value)
+		if err != nil {
+			return 0, err
+		}
+		batch.Put(key, value)
+	}
+	if batch.Len() == 0 {
+		return 0, nil
+	}
+	return batch.Len(), s.db.Write(batch, nil)
+}
+
+// RunReencrypt re-encrypts the store, and then its archive, once in the
+// background, such as after a new primary key was configured.
+func (s *Store) RunReencrypt(ctx context.Context) error {
+	if s.keys == nil {
+		return nil
+	}
+	n, err := s.Reencrypt(ctx)
+	if err != nil && err != ctx.Err() {
+		klog.Errorf("reencrypt: %v", err)
+		return nil
+	}
+	klog.Infof("reencrypt: sealed %d values with key %s", n, s.keys.primary)
+
+	n, err = s.ReencryptArchive(ctx)
+	if err != nil && err != ctx.Err() {
+		klog.Errorf("reencrypt archive: %v", err)
+		return nil
+	}
+	klog.Infof("reencrypt: sealed %d archived objects with key %s", n, s.keys.primary)
+	return nil
+}
+
+// GetKeyUsage counts the values of the store by the id of the key they are
+// sealed with; plain values are counted under "none".
+func (s *Store) GetKeyUsage() (map[string]int, error) {
+	usage := map[string]int{}
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if !encryptable(string(iter.Key()), iter.Value()) {
+			continue
+		}
+		if id, ok := sealedWith(iter.Value()); ok {
+			usage[id]++
+		} else {
+			usage["none"]++
+		}
+	}
+	return usage, iter.Error()
+}
+
+// keyIDs returns the ids of the keys of the ring, sorted.
+func (k *Keyring) keyIDs() []string {
+	var ids []string
+	for id := range k.aeads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
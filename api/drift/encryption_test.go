@@ -0,0 +1,110 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, keySize)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	store := newTestStore(t)
+	keys, err := NewKeyring(map[string][]byte{"k1": testKey(1)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetKeyring(keys)
+	saveRestarts(t, store, 3)
+
+	key := "/pod/default/web-1/uid-web-1"
+	data, _ := store.db.Get([]byte(key), nil)
+	if id, ok := sealedWith(data); !ok || id != "k1" || bytes.Contains(data, []byte("nginx")) {
+		t.Fatalf("record is not sealed with k1: %q", data)
+	}
+	drift, err := store.GetDriftByKey(key)
+	if err != nil || drift.MetaData.Name != "web-1" {
+		t.Fatalf("unable to read sealed record: %+v, %v", drift, err)
+	}
+	if history, err := store.GetHistory("pod", "default", "web-1"); err != nil || len(history) != 3 {
+		t.Fatalf("unable to read sealed history: %d versions, %v", len(history), err)
+	}
+
+	// a tampered value fails to open
+	data[len(data)-1] ^= 1
+	store.db.Put([]byte(key), data, nil)
+	if report, _ := store.Verify(false); len(report.Problems) == 0 || report.Problems[0].Key != key {
+		t.Errorf("expected the tampered record to fail verification, got %+v", report.Problems)
+	}
+
+	store.SetKeyring(nil)
+	if history, _ := store.GetHistory("pod", "default", "web-1"); len(history) != 0 {
+		t.Errorf("expected sealed history to be unreadable without keys, got %d versions", len(history))
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	saveRestarts(t, store, 2)
+	old, _ := NewKeyring(map[string][]byte{"k1": testKey(1)}, "")
+	store.SetKeyring(old)
+	saveRestarts(t, store, 4)
+
+	rotated, err := NewKeyring(map[string][]byte{"k1": testKey(1), "k2": testKey(2)}, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetKeyring(rotated)
+	n, err := store.Reencrypt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := store.GetKeyUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage["k2"] != n {
+		t.Fatalf("expected all %d values sealed with k2, got %v", n, usage)
+	}
+
+	// k1 can be dropped once the store is re-encrypted
+	current, _ := NewKeyring(map[string][]byte{"k2": testKey(2)}, "")
+	store.SetKeyring(current)
+	if report, err := store.Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("expected a clean store, got %+v, %v", report.Problems, err)
+	}
+	if report, err := store.VerifyChain(); err != nil || len(report.Breaks) != 0 || report.Versions != 6 {
+		t.Errorf("unexpected chain report %+v, %v", report, err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	dir := t.TempDir()
+	// the layout of a mounted Secret
+	os.Mkdir(filepath.Join(dir, "..data"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "k1"), []byte(base64.StdEncoding.EncodeToString(testKey(1))+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "k2"), testKey(2), 0600)
+
+	if _, err := LoadKeyring(dir, ""); err == nil {
+		t.Error("expected an error without a primary key id")
+	}
+	keys, err := LoadKeyring(dir, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys.keyIDs(); len(got) != 2 || keys.Primary() != "k2" {
+		t.Errorf("unexpected keyring %v, primary %s", got, keys.Primary())
+	}
+	if _, err := NewKeyring(map[string][]byte{"short": []byte("too short")}, ""); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
@@ -0,0 +1,245 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// newEventsV1Event records an events.k8s.io/v1 Event as the same event record
+// its core/v1 form produces.
+func (p *KubeDrift) newEventsV1Event(eventType string, o *eventsv1.Event) {
+	p.Type = "event"
+	p.EventType = eventType
+	var series *v1.EventSeries
+	if o.Series != nil {
+		series = &v1.EventSeries{Count: o.Series.Count, LastObservedTime: o.Series.LastObservedTime}
+	}
+	p.Event = normalizeEvent(Event{
+		InvolvedObject:      o.Regarding,
+		Reason:              o.Reason,
+		Message:             o.Note,
+		Source:              o.DeprecatedSource,
+		FirstTimestamp:      o.DeprecatedFirstTimestamp,
+		LastTimestamp:       o.DeprecatedLastTimestamp,
+		Count:               o.DeprecatedCount,
+		Type:                o.Type,
+		EventTime:           o.EventTime,
+		Series:              series,
+		Action:              o.Action,
+		Related:             o.Related,
+		ReportingController: o.ReportingController,
+		ReportingInstance:   o.ReportingInstance,
+	})
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.SetKey()
+}
+
+// normalizeEvent fills the fields of an event that only one of the core/v1 and
+// events.k8s.io/v1 APIs sets from their counterparts, so that an event reads
+// the same through both: the reporting controller and source, the event time
+// and first timestamp, and the count and last timestamp of its series.
+func normalizeEvent(e Event) Event {
+	if e.ReportingController == "" {
+		e.ReportingController = e.Source.Component
+	}
+	if e.Source.Component == "" {
+		e.Source.Component = e.ReportingController
+	}
+	if e.ReportingInstance == "" {
+		e.ReportingInstance = e.Source.Host
+	}
+	if e.Source.Host == "" {
+		e.Source.Host = e.ReportingInstance
+	}
+
+	if e.EventTime.IsZero() && !e.FirstTimestamp.IsZero() {
+		e.EventTime = metav1.NewMicroTime(e.FirstTimestamp.Time)
+	}
+	if e.FirstTimestamp.IsZero() && !e.EventTime.IsZero() {
+		e.FirstTimestamp = metav1.NewTime(e.EventTime.Time)
+	}
+	if e.Series != nil {
+		if e.Series.Count > e.Count {
+			e.Count = e.Series.Count
+		}
+		if e.Series.LastObservedTime.Time.After(e.LastTimestamp.Time) {
+			e.LastTimestamp = metav1.NewTime(e.Series.LastObservedTime.Time)
+		}
+	}
+	if e.LastTimestamp.IsZero() {
+		e.LastTimestamp = e.FirstTimestamp
+	}
+	if e.Count == 0 {
+		e.Count = 1
+	}
+	return e
+}
+
+// maxEventOccurrences bounds the occurrence history kept for an event series.
+const maxEventOccurrences = 100
+
+// EventSeries merges the repeats of a logical event, whether counted within an
+// event object or reported as new event objects, into one record.
+type EventSeries struct {
+	Namespace           string             `json:"namespace"`
+	InvolvedObject      v1.ObjectReference `json:"involvedObject"`
+	Reason              string             `json:"reason,omitempty"`
+	Message             string             `json:"message,omitempty"`
+	Type                string             `json:"type,omitempty"`
+	Action              string             `json:"action,omitempty"`
+	ReportingController string             `json:"reportingController,omitempty"`
+	Count               int32              `json:"count"`
+	FirstTimestamp      time.Time          `json:"firstTimestamp"`
+	LastTimestamp       time.Time          `json:"lastTimestamp"`
+	// Events holds the count of each event object of the series until the
+	// object is deleted.
+	Events      map[string]int32  `json:"events"`
+	Occurrences []EventOccurrence `json:"occurrences"`
+}
+
+// EventOccurrence is a repeat of an event series: Count more occurrences
+// reported by an event object by Time.
+type EventOccurrence struct {
+	Time  time.Time `json:"time"`
+	Count int32     `json:"count"`
+	Event string    `json:"event"`
+}
+
+func eventSeriesPrefix(namespace, kind, name string) string {
+	prefix := "/eventseries/"
+	for _, segment := range []string{namespace, kind, name} {
+		if segment == "" {
+			break
+		}
+		prefix += segment + "/"
+	}
+	return prefix
+}
+
+// GetKey keys a series by the object the event is about and a hash of what
+// makes two events the same: their reason, message, type, action and
+// reporting controller.
+func (e *EventSeries) GetKey() string {
+	identity, _ := json.Marshal([]string{string(e.InvolvedObject.UID), e.Reason, e.Message, e.Type, e.Action, e.ReportingController})
+	return fmt.Sprintf("%s%s", eventSeriesPrefix(e.Namespace, e.InvolvedObject.Kind, e.InvolvedObject.Name),
+		strings.TrimPrefix(hashValue(identity), "sha256:")[:16])
+}
+
+// mergeEvent adds the occurrences of an event not yet counted to its series,
+// and forgets the count of an event object once it is deleted.
+func (s *Store) mergeEvent(b *batch, drift KubeDrift) error {
+	e := Event{}
+	if err := convert(drift.Event, &e); err != nil {
+		return err
+	}
+	series := EventSeries{
+		Namespace:           drift.MetaData.Namespace,
+		InvolvedObject:      e.InvolvedObject,
+		Reason:              e.Reason,
+		Message:             e.Message,
+		Type:                e.Type,
+		Action:              e.Action,
+		ReportingController: e.ReportingController,
+		Events:              map[string]int32{},
+	}
+	data, err := s.get(b, series.GetKey())
+	if err == nil {
+		if err := s.unmarshal(data, &series); err != nil {
+			return err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	name := drift.MetaData.Name
+	if drift.EventType == EventTypeDeleted {
+		if _, ok := series.Events[name]; !ok {
+			return nil
+		}
+		delete(series.Events, name)
+		if data, err = s.encode(series); err != nil {
+			return err
+		}
+		return s.set(b, series.GetKey(), data)
+	}
+	added := e.Count - series.Events[name]
+	if added <= 0 {
+		return nil
+	}
+	series.Events[name] = e.Count
+	series.Count += added
+	if series.FirstTimestamp.IsZero() || e.FirstTimestamp.Time.Before(series.FirstTimestamp) {
+		series.FirstTimestamp = e.FirstTimestamp.Time
+	}
+	if e.LastTimestamp.Time.After(series.LastTimestamp) {
+		series.LastTimestamp = e.LastTimestamp.Time
+	}
+	series.Occurrences = append(series.Occurrences, EventOccurrence{Time: e.LastTimestamp.Time, Count: added, Event: name})
+	if len(series.Occurrences) > maxEventOccurrences {
+		series.Occurrences = series.Occurrences[len(series.Occurrences)-maxEventOccurrences:]
+	}
+
+	if data, err = s.encode(series); err != nil {
+		return err
+	}
+	return s.set(b, series.GetKey(), data)
+}
+
+// GetEventSeries returns the event series of a namespace, optionally only
+// those about objects of a kind or a single object.
+func (s *Store) GetEventSeries(namespace, kind, name string) ([]EventSeries, error) {
+	var series []EventSeries
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(eventSeriesPrefix(namespace, kind, name))), nil)
+	for iter.Next() {
+		e := EventSeries{}
+		if err := s.unmarshal(iter.Value(), &e); err != nil {
+			klog.Errorf("error decoding event series %s: %v", iter.Key(), err)
+			continue
+		}
+		series = append(series, e)
+	}
+	iter.Release()
+
+	return series, iter.Error()
+}
+
+// involvedUID returns the UID of the object an event record is about, or ""
+// for other records.
+func involvedUID(drift KubeDrift) string {
+	if drift.Type != "event" {
+		return ""
+	}
+	switch e := drift.Event.(type) {
+	case Event:
+		return string(e.InvolvedObject.UID)
+	case map[string]interface{}:
+		involved, _ := e["involvedObject"].(map[string]interface{})
+		uid, _ := involved["uid"].(string)
+		return uid
+	}
+	return ""
+}
+
+// eventTime returns when an event record last occurred.
+func eventTime(drift KubeDrift) time.Time {
+	e := Event{}
+	if err := convert(drift.Event, &e); err == nil {
+		switch {
+		case !e.LastTimestamp.IsZero():
+			return e.LastTimestamp.Time
+		case !e.EventTime.IsZero():
+			return e.EventTime.Time
+		}
+	}
+	return drift.ObservedAt
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var (
+	eventStart = time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	backOff    = v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "web-1", UID: "uid-web-1"}
+)
+
+// seriesEvent is an event as reported by the events.k8s.io/v1 recorder, which
+// counts repeats in its series.
+func seriesEvent(name string, repeats int32) *eventsv1.Event {
+	e := &eventsv1.Event{
+		ObjectMeta:          metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+		EventTime:           metav1.NewMicroTime(eventStart),
+		Regarding:           backOff,
+		Reason:              "BackOff",
+		Note:                "Back-off restarting failed container",
+		Type:                v1.EventTypeWarning,
+		Action:              "Restarting",
+		ReportingController: "kubelet",
+		ReportingInstance:   "node-1",
+	}
+	if repeats > 1 {
+		e.Series = &eventsv1.EventSeries{
+			Count:            repeats,
+			LastObservedTime: metav1.NewMicroTime(eventStart.Add(time.Duration(repeats) * time.Minute)),
+		}
+	}
+	return e
+}
+
+// coreForm is seriesEvent read through core/v1.
+func coreForm(e *eventsv1.Event) *v1.Event {
+	core := &v1.Event{
+		ObjectMeta:          e.ObjectMeta,
+		InvolvedObject:      e.Regarding,
+		Reason:              e.Reason,
+		Message:             e.Note,
+		Type:                e.Type,
+		EventTime:           e.EventTime,
+		Action:              e.Action,
+		ReportingController: e.ReportingController,
+		ReportingInstance:   e.ReportingInstance,
+	}
+	if e.Series != nil {
+		core.Series = &v1.EventSeries{Count: e.Series.Count, LastObservedTime: e.Series.LastObservedTime}
+	}
+	return core
+}
+
+func TestEventsNormalizedAcrossAPIs(t *testing.T) {
+	e := seriesEvent("web-1.16a", 3)
+	fromEvents, err := json.Marshal(New(e, "update"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromCore, err := json.Marshal(New(coreForm(e), "update"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fromEvents) != string(fromCore) {
+		t.Errorf("records differ:\n%s\n%s", fromEvents, fromCore)
+	}
+
+	normalized := New(e, "update").Event.(Event)
+	if normalized.Count != 3 || normalized.Source.Component != "kubelet" || normalized.Source.Host != "node-1" ||
+		!normalized.FirstTimestamp.Time.Equal(eventStart) || !normalized.LastTimestamp.Time.Equal(eventStart.Add(3*time.Minute)) {
+		t.Errorf("unexpected normalized event %+v", normalized)
+	}
+}
+
+func TestEventSeriesMerging(t *testing.T) {
+	store := newTestStore(t)
+	// the series repeats within one event object, then in a new one once the
+	// recorder started over
+	saveAll(t, store,
+		seriesEvent("web-1.16a", 1),
+		seriesEvent("web-1.16a", 2),
+		coreForm(seriesEvent("web-1.16a", 4)),
+		seriesEvent("web-1.16a", 4),
+		seriesEvent("web-1.27b", 2),
+	)
+
+	series, err := store.GetEventSeries("default", "Pod", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected one series, got %+v", series)
+	}
+	s := series[0]
+	if s.Count != 6 || len(s.Occurrences) != 4 || len(s.Events) != 2 {
+		t.Errorf("unexpected series %+v", s)
+	}
+	if !s.FirstTimestamp.Equal(eventStart) || !s.LastTimestamp.Equal(eventStart.Add(4*time.Minute)) {
+		t.Errorf("unexpected series times %s - %s", s.FirstTimestamp, s.LastTimestamp)
+	}
+
+	versions, err := store.GetHistory("event", "default", "web-1.16a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("expected repeats of an event to leave a single version, got %d", len(versions))
+	}
+}
+
+func TestEventSeriesBounded(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i <= maxEventOccurrences; i++ {
+		saveAll(t, store, seriesEvent(fmt.Sprintf("web-1.%03d", i), 1))
+	}
+
+	series, err := store.GetEventSeries("default", "Pod", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected one series, got %+v", series)
+	}
+	s := series[0]
+	if s.Count != maxEventOccurrences+1 || len(s.Occurrences) != maxEventOccurrences {
+		t.Errorf("expected the series to count every event but keep %d occurrences, got count %d and %d occurrences",
+			maxEventOccurrences, s.Count, len(s.Occurrences))
+	}
+
+	// the first event object repeats after its occurrence was dropped
+	saveAll(t, store, seriesEvent("web-1.000", 3))
+	if series, _ = store.GetEventSeries("default", "Pod", "web-1"); series[0].Count != maxEventOccurrences+3 {
+		t.Errorf("expected only the new repeats to be counted, got count %d", series[0].Count)
+	}
+
+	if err := store.WriteDeletion(context.Background(), "event", "default", "web-1.000"); err != nil {
+		t.Fatal(err)
+	}
+	series, _ = store.GetEventSeries("default", "Pod", "web-1")
+	if _, ok := series[0].Events["web-1.000"]; ok || series[0].Count != maxEventOccurrences+3 {
+		t.Errorf("expected the count of the deleted event object to be dropped, got %+v", series[0])
+	}
+}
+
+func TestTimelineInterleavesEvents(t *testing.T) {
+	store := newTestStore(t)
+	pod := testPod("web-1", "nginx:1.21", "")
+	pod.UID = backOff.UID
+	event := func(name, reason string, at time.Time) *v1.Event {
+		return &v1.Event{
+			ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name)},
+			InvolvedObject: backOff,
+			Reason:         reason,
+			FirstTimestamp: metav1.NewTime(at),
+			LastTimestamp:  metav1.NewTime(at),
+			Count:          1,
+		}
+	}
+	restarted := pod
+	restarted.Status.ContainerStatuses = []v1.ContainerStatus{{Name: "web", RestartCount: 1}}
+	now := time.Now()
+	saveAll(t, store, event("web-1.1", "Scheduled", now.Add(-time.Hour)), pod, restarted, event("web-1.2", "BackOff", now.Add(time.Hour)))
+
+	timeline, err := store.GetTimeline("pod", "default", "web-1", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, e := range timeline {
+		entries = append(entries, e.Entry+" "+e.Record.MetaData.Name)
+	}
+	want := []string{"event web-1.1", "version web-1", "version web-1", "event web-1.2"}
+	if strings.Join(entries, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected timeline %q", entries)
+	}
+
+	events, err := store.Query(IndexQuery{Involved: string(backOff.UID)})
+	if err != nil || len(events) != 2 {
+		t.Errorf("expected the two events about the pod, got %d: %v", len(events), err)
+	}
+}
@@ -0,0 +1,529 @@
+package provider
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/klog/v2"
+)
+
+// exportFormatVersion is the version of the archive layout written by Export.
+const exportFormatVersion = 1
+
+const (
+	manifestFile = "manifest.json"
+	recordsFile  = "records.ndjson"
+)
+
+// ExportFilter limits an export to the records of a kind and namespace, and to
+// those observed within [Since, Until). Zero values match everything.
+type ExportFilter struct {
+	Kind      string    `json:"kind,omitempty"`
+	Namespace string    `json:"namespace,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+	Until     time.Time `json:"until,omitempty"`
+}
+
+// ExportManifest describes the records of an export archive.
+type ExportManifest struct {
+	FormatVersion int          `json:"formatVersion"`
+	SchemaVersion int          `json:"schemaVersion"`
+	CreatedAt     time.Time    `json:"createdAt"`
+	Filter        ExportFilter `json:"filter"`
+	Records       int          `json:"records"`
+	SHA256        string       `json:"sha256"`
+}
+
+// exportLine is one line of records.ndjson. Value holds the decoded JSON of the
+// stored value, so archives are independent of the codec of either store.
+// History versions are exported as full snapshots.
+type exportLine struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+	// Hash and Prev carry the hash chain of history versions.
+	Hash string `json:"hash,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// keyScope returns the kind and namespace a key belongs to.
+func keyScope(key string) (string, string) {
+	segments := strings.Split(strings.TrimPrefix(key, "/"), "/")
+	at := func(i int) string {
+		if i < len(segments) {
+			return segments[i]
+		}
+		return ""
+	}
+
+	switch segments[0] {
+	case "history", "configchange":
+		return at(1), at(2)
+	case "finding":
+		return at(2), at(3)
+	case "image":
+		return "image", at(3)
+	}
+	return at(0), at(1)
+}
+
+// observedAt returns the time a stored value was last observed.
+func observedAt(key string, doc []byte) time.Time {
+	if strings.HasPrefix(key, "/history/") {
+		if t, ok := versionTime(key); ok {
+			return t
+		}
+	}
+
+	times := struct {
+		ObservedAt time.Time `json:"observedAt"`
+		LastSeen   time.Time `json:"lastSeen"`
+		ChangedAt  time.Time `json:"changedAt"`
+	}{}
+	if err := json.Unmarshal(doc, &times); err != nil {
+		return time.Time{}
+	}
+
+	t := times.ObservedAt
+	for _, other := range []time.Time{times.LastSeen, times.ChangedAt} {
+		if other.After(t) {
+			t = other
+		}
+	}
+	return t
+}
+
+// exportable reports whether key is exported. Store metadata, indexes, the
+// archive index and chain heads and checkpoints belong to the store they were
+// written in; imported records are indexed and chained again as they are
+// written.
+func exportable(key string) bool {
+	for _, prefix := range []string{"/meta/", "/index/", "/archive/", "/quarantine/", "/chain/"} {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f ExportFilter) matchKey(key string) bool {
+	kind, namespace := keyScope(key)
+	if f.Kind != "" && !strings.EqualFold(f.Kind, kind) {
+		return false
+	}
+	return f.Namespace == "" || f.Namespace == namespace
+}
+
+func (f ExportFilter) matchTime(t time.Time) bool {
+	if f.Since.IsZero() && f.Until.IsZero() {
+		return true
+	}
+	return !t.IsZero() && inRange(t, f.Since, f.Until)
+}
+
+// exportRecords writes the records matching filter from a consistent snapshot
+// of the store as NDJSON, and returns the number written.
+func (s *Store) exportRecords(w io.Writer, filter ExportFilter) (int, error) {
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	iter := snap.NewIterator(nil, nil)
+	defer iter.Release()
+
+	enc := json.NewEncoder(w)
+	docs := map[string][]byte{}
+	count := 0
+
+	for iter.Next() {
+		key := string(iter.Key())
+		if !exportable(key) || !filter.matchKey(key) {
+			continue
+		}
+
+		line, err := s.exportValue(key, iter, docs)
+		if err != nil {
+			klog.Errorf("export: skipping %s: %v", key, err)
+			continue
+		}
+		if !filter.matchTime(observedAt(key, line.Value)) {
+			continue
+		}
+
+		if err := enc.Encode(line); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, iter.Error()
+}
+
+// exportValue decodes the value at the iterator, reconstructing history versions
+// from the versions before them.
+func (s *Store) exportValue(key string, iter iterator.Iterator, docs map[string][]byte) (exportLine, error) {
+	line := exportLine{Key: key}
+	var err error
+	if !strings.HasPrefix(key, "/history/") {
+		line.Value, err = s.decode(iter.Value())
+		return line, err
+	}
+	rec, err := s.decodeVersion(iter.Value())
+	if err != nil {
+		return line, err
+	}
+	line.Hash, line.Prev = rec.Hash, rec.Prev
+	line.Value, err = versionDoc(historyObjectPrefix(key), rec, docs)
+	return line, err
+}
+
+// Export writes a tar archive, gzipped if compress is set, holding a manifest
+// and the records matching filter as NDJSON. The records come from a single
+// snapshot of the store, so writes continuing during the export are either
+// wholly included or not at all.
+//
+// Exports are never encrypted, even from an encrypted store: they hold the
+// decoded records so that a store with other keys, or none, can import them.
+// Whoever exports is responsible for protecting the archive, which holds
+// everything the store does in the clear, Secret values aside.
+func (s *Store) Export(w io.Writer, filter ExportFilter, compress bool) (ExportManifest, error) {
+	manifest := ExportManifest{
+		FormatVersion: exportFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Filter:        filter,
+	}
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return manifest, err
+	}
+	manifest.SchemaVersion = version
+
+	// the tar header needs the size of the records, so spool them first
+	tmp, err := ioutil.TempFile("", "kube-drift-export-")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(tmp, hash))
+	if manifest.Records, err = s.exportRecords(buf, filter); err != nil {
+		return manifest, err
+	}
+	if err := buf.Flush(); err != nil {
+		return manifest, err
+	}
+	manifest.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return manifest, err
+	}
+
+	out := w
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+
+	tw := tar.NewWriter(out)
+	m, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeTarFile(tw, manifestFile, int64(len(m)), bytes.NewReader(m), manifest.CreatedAt); err != nil {
+		return manifest, err
+	}
+	if err := writeTarFile(tw, recordsFile, size, tmp, manifest.CreatedAt); err != nil {
+		return manifest, err
+	}
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return manifest, err
+		}
+	}
+
+	klog.Infof("exported %d records", manifest.Records)
+	return manifest, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, r io.Reader, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// Import loads an archive written by Export, gzipped or not, preserving the
+// keys of its records. History versions are delta encoded again as they are
+// written, in their original order. The versions of an object that already
+// has history in the store are skipped, leaving its history and chain as they
+// were. Records and findings replace those of the store only when they were
+// seen later, and the index entries of a replaced record are removed.
+func (s *Store) Import(r io.Reader) (ExportManifest, error) {
+	manifest := ExportManifest{}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return manifest, err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	haveManifest := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, err
+		}
+
+		switch hdr.Name {
+		case manifestFile:
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return manifest, err
+			}
+			if manifest.FormatVersion != exportFormatVersion {
+				return manifest, fmt.Errorf("unsupported export format version %d", manifest.FormatVersion)
+			}
+			if manifest.SchemaVersion != CurrentSchemaVersion {
+				return manifest, fmt.Errorf("archive schema version %d does not match store schema version %d", manifest.SchemaVersion, CurrentSchemaVersion)
+			}
+			haveManifest = true
+		case recordsFile:
+			if !haveManifest {
+				return manifest, fmt.Errorf("%s must precede %s", manifestFile, recordsFile)
+			}
+			if err := s.importRecords(tr, manifest); err != nil {
+				return manifest, err
+			}
+			klog.Infof("imported %d records", manifest.Records)
+			return manifest, nil
+		}
+	}
+	return manifest, fmt.Errorf("archive has no %s", recordsFile)
+}
+
+const importBatchSize = 1000
+
+// importRecords verifies the records against the manifest before writing any
+// of them, so a damaged archive leaves the store untouched.
+func (s *Store) importRecords(r io.Reader, manifest ExportManifest) error {
+	tmp, err := ioutil.TempFile("", "kube-drift-import-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), r); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != manifest.SHA256 {
+		return fmt.Errorf("records checksum %s does not match manifest %s", sum, manifest.SHA256)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(tmp)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	batch := new(leveldb.Batch)
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		err := s.writeBatch(batch)
+		batch.Reset()
+		return err
+	}
+
+	var object string
+	var prev []byte
+	var head string
+	var skip bool
+	deltas := 0
+	count := 0
+	skipped := 0
+	kept := 0
+
+	for scanner.Scan() {
+		line := exportLine{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			return fmt.Errorf("record %d: %v", count+1, err)
+		}
+
+		var value []byte
+		var err error
+		if strings.HasPrefix(line.Key, "/history/") {
+			if o := historyObjectPrefix(line.Key); o != object {
+				if err := flush(); err != nil {
+					return err
+				}
+				object, prev, head, deltas = o, nil, "", 0
+				if skip, err = s.hasHistory(object); err != nil {
+					return err
+				}
+				if skip {
+					klog.Warningf("import: %s already has history in this store, skipping its imported versions", object)
+				}
+			}
+			if skip {
+				skipped++
+				continue
+			}
+			rec, err := encodeVersion(prev, deltas, line.Value)
+			if err != nil {
+				return err
+			}
+			if rec.Snapshot != nil {
+				deltas = 0
+			} else {
+				deltas++
+			}
+			prev = line.Value
+
+			// keep the chain of the exporting store; versions exported before
+			// chaining are chained as they are imported
+			rec.Hash, rec.Prev = line.Hash, line.Prev
+			if rec.Hash == "" {
+				rec.Prev = head
+				if rec.Hash, err = chainHash(head, line.Key, line.Value); err != nil {
+					return err
+				}
+			}
+			head = rec.Hash
+			if err := s.setChainHead(batch, object, head); err != nil {
+				return err
+			}
+			value, err = s.encode(rec)
+		} else {
+			drift := KubeDrift{}
+			f := Finding{}
+			switch {
+			case isRecordKey(line.Key) && json.Unmarshal(line.Value, &drift) == nil && drift.Type != "":
+				var prev *KubeDrift
+				existing, err := s.GetDriftByKey(line.Key)
+				if err == nil {
+					if !existing.LastSeen.Before(drift.LastSeen) {
+						kept++
+						continue
+					}
+					prev = &existing
+				} else if err != leveldb.ErrNotFound {
+					return err
+				}
+				if value, err = s.encodeRecord(drift, line.Value); err != nil {
+					return err
+				}
+				s.updateIndexes(batch, prev, drift)
+			case strings.HasPrefix(line.Key, "/finding/") && json.Unmarshal(line.Value, &f) == nil:
+				existing, err := s.getFinding(nil, line.Key)
+				if err == nil {
+					if !existing.LastSeen.Before(f.LastSeen) {
+						kept++
+						continue
+					}
+					if existing.FirstSeen.Before(f.FirstSeen) {
+						f.FirstSeen = existing.FirstSeen
+					}
+				} else if err != leveldb.ErrNotFound {
+					return err
+				}
+				if value, err = s.encode(f); err != nil {
+					return err
+				}
+			default:
+				value, err = s.wrap(line.Value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		batch.Put([]byte(line.Key), value)
+		count++
+		if batch.Len() >= importBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if count+skipped+kept != manifest.Records {
+		klog.Warningf("archive holds %d records, manifest lists %d", count+skipped+kept, manifest.Records)
+	}
+	if kept > 0 {
+		klog.Warningf("import: kept %d records and findings seen later in this store", kept)
+	}
+	if skipped > 0 {
+		klog.Warningf("import: skipped %d versions of objects with history in this store", skipped)
+	}
+	return flush()
+}
+
+// hasHistory reports whether the object with the given history prefix has
+// versions in the store, locally or archived, or a chain head. Imported
+// versions are delta encoded and chained against each other only, so they
+// cannot be merged into an existing history without corrupting it.
+func (s *Store) hasHistory(object string) (bool, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(object)), nil)
+	found := iter.Next()
+	iter.Release()
+	if err := iter.Error(); err != nil || found {
+		return found, err
+	}
+	if head, err := s.chainHead(object); err != nil || head != "" {
+		return head != "", err
+	}
+	if s.archive == nil {
+		return false, nil
+	}
+	segments, err := s.GetSegments()
+	if err != nil {
+		return false, err
+	}
+	for _, info := range segments {
+		if info.covers(object, time.Time{}, time.Time{}) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,263 @@
+package provider
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func populateExportStore(t *testing.T, store *Store) {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.Status.ContainerStatuses[0].RestartCount = int32(i)
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", UID: "uid-node-1"}}
+	if err := store.Save(*New(node, "update")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := newTestStore(t)
+	if _, err := src.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	populateExportStore(t, src)
+
+	var archive bytes.Buffer
+	manifest, err := src.Export(&archive, ExportFilter{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	dst.SetCodec(Codec{EncodingJSON, CompressionZstd})
+	imported, err := dst.Import(&archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.Records != manifest.Records || imported.SHA256 != manifest.SHA256 {
+		t.Errorf("imported manifest %+v does not match exported %+v", imported, manifest)
+	}
+
+	want, err := src.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := dst.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d versions, got %d", len(want), len(got))
+	}
+	for i := range want {
+		w, _ := json.Marshal(want[i])
+		g, _ := json.Marshal(got[i])
+		if !jsonEqual(w, g) {
+			t.Fatalf("version %d differs\n got %s\nwant %s", i, g, w)
+		}
+	}
+
+	node, err := dst.GetDriftByKey("/node/none/node-1/uid-node-1")
+	if err != nil {
+		t.Fatalf("node record not imported: %v", err)
+	}
+	if node.MetaData.Name != "node-1" {
+		t.Errorf("unexpected node record %+v", node)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	store := newTestStore(t)
+	populateExportStore(t, store)
+
+	var archive bytes.Buffer
+	if _, err := store.Export(&archive, ExportFilter{Kind: "node"}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != recordsFile {
+			continue
+		}
+		dec := json.NewDecoder(tr)
+		for dec.More() {
+			line := exportLine{}
+			if err := dec.Decode(&line); err != nil {
+				t.Fatal(err)
+			}
+			if kind, _ := keyScope(line.Key); kind != "node" {
+				t.Errorf("filtered export holds %s", line.Key)
+			}
+		}
+	}
+}
+
+func TestImportRejectsDamagedArchive(t *testing.T) {
+	src := newTestStore(t)
+	if _, err := src.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	populateExportStore(t, src)
+
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive, ExportFilter{}, false); err != nil {
+		t.Fatal(err)
+	}
+	data := archive.Bytes()
+	i := bytes.Index(data, []byte(`"key":"/node/`))
+	if i < 0 {
+		t.Fatal("node record not found in archive")
+	}
+	data[i+8] = 'm'
+
+	dst := newTestStore(t)
+	if _, err := dst.Import(bytes.NewReader(data)); err == nil {
+		t.Fatal("expected damaged archive to be rejected")
+	}
+	if empty, err := dst.empty(); err != nil || !empty {
+		t.Errorf("damaged archive was partially imported")
+	}
+}
+
+func TestImportIntoPopulatedStore(t *testing.T) {
+	src := newTestStore(t)
+	if _, err := src.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	populateExportStore(t, src)
+	web2 := testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+	saveAll(t, src, web2)
+
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive, ExportFilter{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := newTestStore(t)
+	for i := 0; i < 3; i++ {
+		pod := testPod("web-1", "nginx:1.22", "docker-pullable://nginx@sha256:bbb")
+		pod.Status.ContainerStatuses[0].RestartCount = int32(100 + i)
+		saveAll(t, dst, pod)
+	}
+	before, err := dst.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := historyPrefix("pod", "default", "web-1")
+	head, err := dst.chainHead(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := dst.Import(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := dst.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("expected the existing history of web-1 to be kept, got %d versions, had %d", len(after), len(before))
+	}
+	for i := range before {
+		b, _ := json.Marshal(before[i])
+		a, _ := json.Marshal(after[i])
+		if !jsonEqual(a, b) {
+			t.Fatalf("version %d of web-1 changed\n got %s\nwant %s", i, a, b)
+		}
+	}
+	if got, _ := dst.chainHead(object); got != head {
+		t.Errorf("expected the chain head of web-1 to be kept, got %s, had %s", got, head)
+	}
+
+	if versions, err := dst.GetHistory("pod", "default", "web-2"); err != nil || len(versions) != 1 {
+		t.Errorf("expected the history of web-2 to be imported, got %d versions, %v", len(versions), err)
+	}
+	report, err := dst.VerifyChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Breaks) != 0 {
+		t.Errorf("expected the chains to verify after the import, got %+v", report.Breaks)
+	}
+}
+
+func TestImportKeepsNewerRecordsAndIndexes(t *testing.T) {
+	dst := newTestStore(t)
+	src := newTestStore(t)
+	for _, store := range []*Store{dst, src} {
+		if _, err := store.Migrate(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	finding := Finding{Type: "StaleConfig", Severity: SeverityWarning, Kind: "ConfigMap", Namespace: "default", Name: "web"}
+
+	// web-1 and the finding are seen first by dst, then by src, and web-2 by
+	// src, then by dst
+	if err := dst.Save(indexedPod("web-1", "node-3", "uid-rs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.SaveFinding(finding); err != nil {
+		t.Fatal(err)
+	}
+	first, err := dst.GetFinding(finding.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drift := range []KubeDrift{indexedPod("web-1", "node-7", "uid-rs"), indexedPod("web-2", "node-7", "uid-rs")} {
+		if err := src.Save(drift); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.SaveFinding(finding); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.Save(indexedPod("web-2", "node-3", "uid-rs")); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if _, err := src.Export(&archive, ExportFilter{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dst.Import(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := queryNames(t, dst, IndexQuery{Node: "node-7"}); got != "web-1" {
+		t.Errorf("pods on node-7 after the import: got %q, want web-1", got)
+	}
+	if got := queryNames(t, dst, IndexQuery{Node: "node-3"}); got != "web-2" {
+		t.Errorf("pods on node-3 after the import: got %q, want web-2", got)
+	}
+	if report, err := dst.Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("expected the indexes to match the records, got %+v, %v", report.Problems, err)
+	}
+	f, err := dst.GetFinding(finding.GetKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.FirstSeen.Equal(first.FirstSeen) || !f.LastSeen.After(first.LastSeen) {
+		t.Errorf("expected the finding to be seen since %s and again later, got %+v", first.FirstSeen, f)
+	}
+}
@@ -0,0 +1,123 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Finding is a drift condition detected while recording an object. Findings are
+// keyed by type and object so repeated detections update the same record.
+type Finding struct {
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Kind      string    `json:"kind"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	UID       types.UID `json:"uid,omitempty"`
+	// Subject tells apart findings of one type about an object, such as the
+	// images of a workload.
+	Subject   string    `json:"subject,omitempty"`
+	Message   string    `json:"message"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (f *Finding) GetKey() string {
+	namespace := f.Namespace
+	if namespace == "" {
+		namespace = "none"
+	}
+	key := fmt.Sprintf("/finding/%s/%s/%s/%s", f.Type, f.Kind, namespace, f.Name)
+	if f.Subject != "" {
+		key += "/" + url.PathEscape(f.Subject)
+	}
+	return key
+}
+
+// SaveFinding stores f with the severity its policies set, keeping the
+// FirstSeen time of an earlier detection of the same finding. A finding a
+// policy disables is removed instead.
+func (s *Store) SaveFinding(f Finding) error {
+	return s.saveFinding(nil, f)
+}
+
+// saveFinding queues f on b, see SaveFinding.
+func (s *Store) saveFinding(b *batch, f Finding) error {
+	if f.Severity = s.severity(f); f.Severity == SeverityNone {
+		return s.remove(b, f.GetKey())
+	}
+	now := time.Now().UTC()
+	f.LastSeen = now
+	f.FirstSeen = now
+
+	prev, err := s.getFinding(b, f.GetKey())
+	if err == nil {
+		f.FirstSeen = prev.FirstSeen
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	data, err := s.encode(f)
+	if err != nil {
+		return err
+	}
+	klog.Infof("finding %s: %s", f.GetKey(), f.Message)
+	return s.set(b, f.GetKey(), data)
+}
+
+// DeleteFinding removes a finding once the condition it describes no longer holds.
+func (s *Store) DeleteFinding(key string) error {
+	return s.remove(nil, key)
+}
+
+// clearFinding queues on b the removal of a finding, if it was raised.
+func (s *Store) clearFinding(b *batch, key string) error {
+	if _, err := s.getFinding(b, key); err != nil {
+		return nil
+	}
+	return s.remove(b, key)
+}
+
+func (s *Store) GetFinding(key string) (Finding, error) {
+	return s.getFinding(nil, key)
+}
+
+func (s *Store) getFinding(b *batch, key string) (Finding, error) {
+	f := Finding{}
+	data, err := s.get(b, key)
+	if err != nil {
+		return f, err
+	}
+	err = s.unmarshal(data, &f)
+	return f, err
+}
+
+// GetFindings returns all findings whose key starts with /finding followed by keyPrefix.
+func (s *Store) GetFindings(keyPrefix string) ([]Finding, error) {
+	var findings []Finding
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("/finding"+keyPrefix)), nil)
+	for iter.Next() {
+		f := Finding{}
+		if err := s.unmarshal(iter.Value(), &f); err != nil {
+			klog.Errorf("error decoding finding %s: %v", iter.Key(), err)
+			continue
+		}
+		findings = append(findings, f)
+	}
+	iter.Release()
+
+	return findings, iter.Error()
+}
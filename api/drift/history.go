@@ -0,0 +1,463 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	jsonpatchgen "gomodules.xyz/jsonpatch/v2"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/klog/v2"
+)
+
+func historyPrefix(kind, namespace, name string) string {
+	if namespace == "" {
+		namespace = "none"
+	}
+	return fmt.Sprintf("/history/%s/%s/%s/", kind, namespace, name)
+}
+
+// historyKey is the key of the version of p observed at p.ObservedAt.
+func (p *KubeDrift) historyKey() string {
+	return fmt.Sprintf("%s%019d", historyPrefix(p.Type, p.MetaData.Namespace, p.MetaData.Name), p.ObservedAt.UnixNano())
+}
+
+// contentHash hashes the normalized content of drift, so that two versions
+// differing only in ignored fields hash the same.
+func contentHash(drift KubeDrift, rules []IgnoreRule) (string, error) {
+	obj, err := normalize(drift, rules)
+	if err != nil {
+		return "", err
+	}
+	// map keys are marshalled in sorted order, making the encoding canonical
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	return hashValue(data), nil
+}
+
+// dedup sets the content hash of drift and reports whether it is unchanged from
+// prev, in which case drift carries over the observation time of prev and
+// counts one more sighting instead of becoming a new version.
+func (s *Store) dedup(prev *KubeDrift, drift *KubeDrift) (bool, error) {
+	hash, err := contentHash(*drift, s.ignoreRules())
+	if err != nil {
+		return false, err
+	}
+	drift.ContentHash = hash
+	drift.LastSeen = drift.ObservedAt
+	drift.SeenCount = 1
+
+	if prev == nil {
+		return false, nil
+	}
+
+	prevHash := prev.ContentHash
+	if prevHash == "" {
+		if prevHash, err = contentHash(*prev, s.ignoreRules()); err != nil {
+			return false, err
+		}
+	}
+	if prevHash != hash {
+		return false, nil
+	}
+
+	if !prev.ObservedAt.IsZero() {
+		drift.ObservedAt = prev.ObservedAt
+	}
+	drift.SeenCount = prev.SeenCount + 1
+	return true, nil
+}
+
+// snapshotInterval is the number of versions of an object between full
+// snapshots; the versions in between are stored as JSON patches.
+const snapshotInterval = 16
+
+// versionRecord is a stored history version: either a full snapshot of the
+// object or a JSON patch (RFC 6902) against the version before it. Versions
+// written before delta encoding are plain KubeDrift documents and are read as
+// snapshots.
+type versionRecord struct {
+	Snapshot json.RawMessage `json:"snapshot,omitempty"`
+	Patch    json.RawMessage `json:"patch,omitempty"`
+	// Hash and Prev link the version into the hash chain of its object.
+	Hash string `json:"hash,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+func (s *Store) decodeVersion(data []byte) (versionRecord, error) {
+	rec := versionRecord{}
+	data, err := s.decode(data)
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, err
+	}
+	if rec.Snapshot == nil && rec.Patch == nil {
+		rec.Snapshot = append(json.RawMessage{}, data...)
+	}
+	return rec, nil
+}
+
+func applyPatch(doc, patch []byte) ([]byte, error) {
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	return p.Apply(doc)
+}
+
+func jsonEqual(a, b []byte) bool {
+	var av, bv interface{}
+	if json.Unmarshal(a, &av) != nil || json.Unmarshal(b, &bv) != nil {
+		return false
+	}
+	return reflect.DeepEqual(av, bv)
+}
+
+// lastVersion reconstructs the most recent version stored under an object's
+// history prefix, and returns the number of deltas written since its snapshot.
+func (s *Store) lastVersion(prefix string) ([]byte, int, error) {
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iter.Release()
+
+	var base []byte
+	var patches [][]byte
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			return nil, 0, fmt.Errorf("error decoding version %s: %v", iter.Key(), err)
+		}
+		if rec.Snapshot != nil {
+			base = rec.Snapshot
+			break
+		}
+		patches = append(patches, rec.Patch)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, 0, err
+	}
+	if base == nil {
+		if len(patches) > 0 {
+			return nil, 0, fmt.Errorf("history %s has no snapshot", prefix)
+		}
+		return nil, 0, nil
+	}
+
+	doc := base
+	for i := len(patches) - 1; i >= 0; i-- {
+		var err error
+		if doc, err = applyPatch(doc, patches[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	return doc, len(patches), nil
+}
+
+// encodeVersion encodes cur as a patch against prev, or as a snapshot when
+// there is no previous version, the snapshot interval is reached, or the patch
+// does not reproduce cur exactly.
+func encodeVersion(prev []byte, deltas int, cur []byte) (versionRecord, error) {
+	if prev == nil || deltas+1 >= snapshotInterval {
+		return versionRecord{Snapshot: cur}, nil
+	}
+
+	ops, err := jsonpatchgen.CreatePatch(prev, cur)
+	if err != nil {
+		return versionRecord{Snapshot: cur}, nil
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return versionRecord{}, err
+	}
+	if applied, err := applyPatch(prev, patch); err != nil || !jsonEqual(applied, cur) {
+		return versionRecord{Snapshot: cur}, nil
+	}
+	return versionRecord{Patch: patch}, nil
+}
+
+// saveVersion queues on batch a new version of drift in the history of its
+// object, chained to the version before it.
+func (s *Store) saveVersion(batch batchWriter, drift KubeDrift, data []byte) error {
+	object := historyPrefix(drift.Type, drift.MetaData.Namespace, drift.MetaData.Name)
+	prev, deltas, err := s.lastVersion(object)
+	if err != nil {
+		klog.Errorf("error reading last version of %s, storing a snapshot: %v", drift.GetKey(), err)
+		prev = nil
+	}
+
+	rec, err := encodeVersion(prev, deltas, data)
+	if err != nil {
+		return err
+	}
+	if rec.Prev, err = s.chainHead(object); err != nil {
+		return err
+	}
+	key := drift.historyKey()
+	if rec.Hash, err = chainHash(rec.Prev, key, data); err != nil {
+		return err
+	}
+
+	value, err := s.encode(rec)
+	if err != nil {
+		return err
+	}
+	batch.Put([]byte(key), value)
+	return s.setChainHead(batch, object, rec.Hash)
+}
+
+// historyObjectPrefix strips the version timestamp from a history key.
+func historyObjectPrefix(key string) string {
+	return key[:strings.LastIndex(key, "/")+1]
+}
+
+// versionDoc returns the document of a version of object, applying a patch to
+// the previous version in docs, and records it there for the next version.
+func versionDoc(object string, rec versionRecord, docs map[string][]byte) ([]byte, error) {
+	doc := []byte(rec.Snapshot)
+	if doc == nil {
+		base, ok := docs[object]
+		if !ok {
+			return nil, fmt.Errorf("no base snapshot")
+		}
+		var err error
+		if doc, err = applyPatch(base, rec.Patch); err != nil {
+			delete(docs, object)
+			return nil, err
+		}
+	}
+	docs[object] = doc
+	return doc, nil
+}
+
+// getHistoryByKeyPrefix reconstructs every version stored under a history key
+// prefix, which may span the histories of several objects.
+func (s *Store) getHistoryByKeyPrefix(keyPrefix string) ([]KubeDrift, error) {
+	return s.getHistoryRange(keyPrefix, time.Time{}, time.Time{})
+}
+
+// getHistoryRange reconstructs the versions stored under a history key prefix
+// and observed within [since, until), reading archived segments for versions
+// no longer held locally. Zero times leave the range open.
+func (s *Store) getHistoryRange(keyPrefix string, since, until time.Time) ([]KubeDrift, error) {
+	var versions []KubeDrift
+	docs := map[string][]byte{}
+
+	archived, err := s.archivedVersions(keyPrefix, since, until)
+	if err != nil {
+		klog.Errorf("error reading archived history %s: %v", keyPrefix, err)
+	}
+	// emitArchived merges the archived versions preceding key into versions
+	emitArchived := func(key string) {
+		for len(archived) > 0 && (key == "" || archived[0].Key < key) {
+			line := archived[0]
+			archived = archived[1:]
+
+			drift := KubeDrift{}
+			if err := json.Unmarshal(line.Value, &drift); err != nil {
+				klog.Errorf("error decoding archived version %s: %v", line.Key, err)
+				continue
+			}
+			// a delta written while its base was archived still applies to it
+			docs[historyObjectPrefix(line.Key)] = line.Value
+			versions = append(versions, drift)
+		}
+	}
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		emitArchived(key)
+		if len(archived) > 0 && archived[0].Key == key {
+			archived = archived[1:]
+		}
+
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			klog.Errorf("error decoding version %s: %v", key, err)
+			continue
+		}
+		doc, err := versionDoc(historyObjectPrefix(key), rec, docs)
+		if err != nil {
+			klog.Errorf("error reconstructing version %s: %v", key, err)
+			continue
+		}
+		if t, ok := versionTime(key); ok && !inRange(t, since, until) {
+			continue
+		}
+
+		drift := KubeDrift{}
+		if err := json.Unmarshal(doc, &drift); err != nil {
+			klog.Errorf("error decoding version %s: %v", key, err)
+			continue
+		}
+		versions = append(versions, drift)
+	}
+	iter.Release()
+	emitArchived("")
+
+	return versions, iter.Error()
+}
+
+// versionTime returns the observation time encoded in a history key.
+func versionTime(key string) (time.Time, bool) {
+	ns, err := strconv.ParseInt(key[strings.LastIndex(key, "/")+1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns).UTC(), true
+}
+
+// inRange reports whether t lies within [since, until); zero times leave the
+// range open.
+func inRange(t, since, until time.Time) bool {
+	return (since.IsZero() || !t.Before(since)) && (until.IsZero() || t.Before(until))
+}
+
+// GetHistory returns the stored versions of an object, oldest first.
+func (s *Store) GetHistory(kind, namespace, name string) ([]KubeDrift, error) {
+	return s.getHistoryByKeyPrefix(historyPrefix(kind, namespace, name))
+}
+
+// GetHistoryRange returns the versions of an object observed within
+// [since, until), oldest first.
+func (s *Store) GetHistoryRange(kind, namespace, name string, since, until time.Time) ([]KubeDrift, error) {
+	return s.getHistoryRange(historyPrefix(kind, namespace, name), since, until)
+}
+
+// TimelineEntry is a version of an object or an event about it.
+type TimelineEntry struct {
+	Time   time.Time `json:"time"`
+	Entry  string    `json:"entry"`
+	Record KubeDrift `json:"record"`
+}
+
+// GetTimeline returns the versions of an object observed within
+// [since, until) interleaved with the events about it that last occurred
+// within the range, oldest first. Events about earlier incarnations of the
+// object, recorded under other UIDs, are included.
+func (s *Store) GetTimeline(kind, namespace, name string, since, until time.Time) ([]TimelineEntry, error) {
+	versions, err := s.GetHistoryRange(kind, namespace, name, since, until)
+	if err != nil {
+		return nil, err
+	}
+	var timeline []TimelineEntry
+	for _, version := range versions {
+		timeline = append(timeline, TimelineEntry{Time: version.ObservedAt, Entry: "version", Record: version})
+	}
+
+	if namespace == "" {
+		namespace = "none"
+	}
+	records, err := s.GetDriftByKeyPrefix(fmt.Sprintf("/%s/%s/%s/", kind, namespace, name))
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		keys, err := s.indexedKeys(indexInvolved, string(record.MetaData.UID), "")
+		if err != nil {
+			return nil, err
+		}
+		for key := range keys {
+			event, err := s.GetDriftByKey(key)
+			if err == leveldb.ErrNotFound {
+				klog.Warningf("index entry for missing event %s", key)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if t := eventTime(event); inRange(t, since, until) {
+				timeline = append(timeline, TimelineEntry{Time: t, Entry: "event", Record: event})
+			}
+		}
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].Time.Before(timeline[j].Time)
+	})
+	return timeline, nil
+}
+
+// HistoryStats compares the encoded size of stored versions to the size they
+// would take as full copies.
+type HistoryStats struct {
+	Versions     int   `json:"versions"`
+	Snapshots    int   `json:"snapshots"`
+	Deltas       int   `json:"deltas"`
+	EncodedBytes int64 `json:"encodedBytes"`
+	FullBytes    int64 `json:"fullBytes"`
+	DiskBytes    int64 `json:"diskBytes"`
+}
+
+// GetHistoryStats reports the storage used by the history under keyPrefix.
+func (s *Store) GetHistoryStats(keyPrefix string) (HistoryStats, error) {
+	stats := HistoryStats{}
+	docs := map[string][]byte{}
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("/history"+keyPrefix)), nil)
+	for iter.Next() {
+		object := historyObjectPrefix(string(iter.Key()))
+		rec, err := s.decodeVersion(iter.Value())
+		if err != nil {
+			continue
+		}
+
+		stats.Versions++
+		stats.EncodedBytes += int64(len(iter.Key()) + len(iter.Value()))
+
+		doc := []byte(rec.Snapshot)
+		if doc != nil {
+			stats.Snapshots++
+		} else {
+			stats.Deltas++
+			if doc, err = applyPatch(docs[object], rec.Patch); err != nil {
+				continue
+			}
+		}
+		docs[object] = doc
+		stats.FullBytes += int64(len(iter.Key()) + len(doc))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return stats, err
+	}
+
+	sizes, err := s.db.SizeOf([]util.Range{*util.BytesPrefix([]byte("/history" + keyPrefix))})
+	if err != nil {
+		return stats, err
+	}
+	stats.DiskBytes = sizes.Sum()
+	return stats, nil
+}
+
+// GetDiffs returns the changes between each pair of successive versions of an object.
+func (s *Store) GetDiffs(kind, namespace, name string) ([]VersionDiff, error) {
+	versions, err := s.GetHistory(kind, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []VersionDiff
+	for i := 1; i < len(versions); i++ {
+		changes, err := Diff(versions[i-1], versions[i], s.ignoreRules())
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, VersionDiff{
+			From:    versions[i-1].ObservedAt,
+			To:      versions[i].ObservedAt,
+			Changes: changes,
+		})
+	}
+	return diffs, nil
+}
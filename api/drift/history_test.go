@@ -0,0 +1,99 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSaveDeduplicatesIdenticalStates(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, resourceVersion := range []string{"1", "2", "3"} {
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.ResourceVersion = resourceVersion
+		pod.Status.Conditions = []v1.PodCondition{
+			{Type: v1.PodReady, Status: v1.ConditionTrue, LastProbeTime: metav1.Unix(int64(resourceVersion[0]), 0)},
+		}
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Fatalf("expected a single version, got %d", len(history))
+	}
+
+	latest, err := store.GetDriftByKey("/pod/default/web-1/uid-web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.SeenCount != 3 {
+		t.Errorf("expected seen count 3, got %d", latest.SeenCount)
+	}
+	if !latest.ObservedAt.Equal(history[0].ObservedAt) || latest.LastSeen.Before(latest.ObservedAt) {
+		t.Errorf("unexpected observation times: observed %v, last seen %v", latest.ObservedAt, latest.LastSeen)
+	}
+	if latest.MetaData.ResourceVersion != "3" {
+		t.Errorf("expected latest to hold resource version 3, got %s", latest.MetaData.ResourceVersion)
+	}
+}
+
+func TestHistoryDeltaEncoding(t *testing.T) {
+	store := newTestStore(t)
+
+	const versions = 40
+	for i := 0; i < versions; i++ {
+		pod := testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+		pod.Labels = map[string]string{"app": "web", "tier": "frontend", "team": "checkout"}
+		pod.Annotations = map[string]string{"example.com/config": strings.Repeat("x", 1024)}
+		pod.Status.Phase = v1.PodRunning
+		pod.Status.ContainerStatuses[0].RestartCount = int32(i)
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.GetHistory("pod", "default", "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != versions {
+		t.Fatalf("expected %d versions, got %d", versions, len(history))
+	}
+	for i, version := range history {
+		status, err := podStatus(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := status.ContainerStatuses[0].RestartCount; got != int32(i) {
+			t.Fatalf("version %d: expected restart count %d, got %d", i, i, got)
+		}
+	}
+
+	key := history[versions-1].historyKey()
+	last, err := store.GetDriftByKey(key)
+	if err != nil {
+		t.Fatalf("GetDriftByKey(%s): %v", key, err)
+	}
+	if !last.ObservedAt.Equal(history[versions-1].ObservedAt) {
+		t.Errorf("GetDriftByKey returned the wrong version")
+	}
+
+	stats, err := store.GetHistoryStats("/pod/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Snapshots != 3 || stats.Deltas != versions-3 {
+		t.Errorf("expected 3 snapshots and %d deltas, got %+v", versions-3, stats)
+	}
+	if stats.EncodedBytes*2 > stats.FullBytes {
+		t.Errorf("expected delta encoding to at least halve the stored size, got %+v", stats)
+	}
+}
@@ -0,0 +1,207 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// IgnoreRule removes the fields matching a JSONPath pattern from drift records
+// of a kind before they are compared or diffed. A Kind of "*" applies to all kinds.
+//
+// Paths are rooted at the KubeDrift record and support field names, quoted
+// keys, indexes and the [*] wildcard, e.g. $.status.conditions[*].lastProbeTime
+// or $.metaData.annotations['kubectl.kubernetes.io/last-applied-configuration'].
+// A rule with a Namespace only applies to the records of objects in it.
+type IgnoreRule struct {
+	Kind      string `json:"kind"`
+	Path      string `json:"path"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// DefaultIgnoreRules drop fields that change on every status update without
+// reflecting a change in the object. The repeats of an event are kept by its
+// EventSeries rather than as versions of it.
+var DefaultIgnoreRules = []IgnoreRule{
+	{Kind: "*", Path: "$.metaData.resourceVersion"},
+	{Kind: "*", Path: "$.metaData.annotations['kubectl.kubernetes.io/last-applied-configuration']"},
+	{Kind: "pod", Path: "$.status.conditions[*].lastProbeTime"},
+	{Kind: "node", Path: "$.status.conditions[*].lastHeartbeatTime"},
+	{Kind: "node", Path: "$.metaData.annotations['node.alpha.kubernetes.io/ttl']"},
+	{Kind: "deployment", Path: "$.status.observedGeneration"},
+	{Kind: "statefulset", Path: "$.status.observedGeneration"},
+	{Kind: "daemonset", Path: "$.status.observedGeneration"},
+	{Kind: "replicaset", Path: "$.status.observedGeneration"},
+	{Kind: "event", Path: "$.event.lastTimestamp"},
+	{Kind: "event", Path: "$.event.count"},
+	{Kind: "event", Path: "$.event.series"},
+	{Kind: "endpoints", Path: "$.metaData.annotations['endpoints.kubernetes.io/last-change-trigger-time']"},
+	{Kind: "endpointslice", Path: "$.metaData.annotations['endpoints.kubernetes.io/last-change-trigger-time']"},
+}
+
+// bookkeepingFields are set by the store itself and never compared.
+var bookkeepingFields = []string{"observedAt", "lastSeen", "seenCount", "contentHash"}
+
+// LoadIgnoreRules reads a list of ignore rules from a JSON or YAML file.
+func LoadIgnoreRules(path string) ([]IgnoreRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []IgnoreRule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if _, err := parsePath(rule.Path); err != nil {
+			return nil, fmt.Errorf("invalid ignore rule %q for kind %s: %v", rule.Path, rule.Kind, err)
+		}
+	}
+	return rules, nil
+}
+
+// SetIgnoreRules replaces the rules applied when deciding whether a new version
+// of an object is stored and when computing diffs.
+func (s *Store) SetIgnoreRules(rules []IgnoreRule) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.ignore = rules
+}
+
+// normalize returns the generic JSON form of drift with the ignore rules for
+// its kind applied.
+func normalize(drift KubeDrift, rules []IgnoreRule) (interface{}, error) {
+	data, err := json.Marshal(drift)
+	if err != nil {
+		return nil, err
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	if m, ok := obj.(map[string]interface{}); ok {
+		for _, field := range bookkeepingFields {
+			delete(m, field)
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.Kind != "*" && rule.Kind != drift.Type {
+			continue
+		}
+		if rule.Namespace != "" && rule.Namespace != drift.MetaData.Namespace {
+			continue
+		}
+		segments, err := parsePath(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		obj = removePath(obj, segments)
+	}
+	return obj, nil
+}
+
+// parsePath splits a JSONPath such as $.a.b[*]['c.d'][0] into its segments.
+func parsePath(path string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var segments []string
+
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty field name")
+			}
+			segments = append(segments, p[:end])
+			p = p[end:]
+		case '[':
+			if len(p) > 1 && (p[1] == '\'' || p[1] == '"') {
+				// quoted keys may contain dots and brackets
+				closing := strings.IndexByte(p[2:], p[1])
+				if closing < 0 || len(p) < closing+4 || p[closing+3] != ']' {
+					return nil, fmt.Errorf("unterminated quoted key")
+				}
+				segments = append(segments, p[2:closing+2])
+				p = p[closing+4:]
+				continue
+			}
+			end := strings.Index(p, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [")
+			}
+			segments = append(segments, p[1:end])
+			p = p[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q", p[0])
+		}
+	}
+
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return segments, nil
+}
+
+// removePath deletes the value at segments from obj, expanding * over every
+// key of an object or element of an array.
+func removePath(obj interface{}, segments []string) interface{} {
+	if len(segments) == 0 {
+		return obj
+	}
+	segment, last := segments[0], len(segments) == 1
+
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		if segment == "*" {
+			for k := range v {
+				if last {
+					delete(v, k)
+				} else {
+					v[k] = removePath(v[k], segments[1:])
+				}
+			}
+			return v
+		}
+		child, ok := v[segment]
+		if !ok {
+			return v
+		}
+		if last {
+			delete(v, segment)
+		} else {
+			v[segment] = removePath(child, segments[1:])
+		}
+		return v
+	case []interface{}:
+		if segment == "*" {
+			if last {
+				return []interface{}{}
+			}
+			for i := range v {
+				v[i] = removePath(v[i], segments[1:])
+			}
+			return v
+		}
+		i, err := strconv.Atoi(segment)
+		if err != nil || i < 0 || i >= len(v) {
+			return v
+		}
+		if last {
+			return append(v[:i:i], v[i+1:]...)
+		}
+		v[i] = removePath(v[i], segments[1:])
+		return v
+	}
+	return obj
+}
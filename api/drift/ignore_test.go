@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := map[string][]string{
+		"$.status.conditions[*].lastProbeTime":   {"status", "conditions", "*", "lastProbeTime"},
+		"$.metaData.annotations['a.b/c']":        {"metaData", "annotations", "a.b/c"},
+		`$.metaData.labels["x"].y`:               {"metaData", "labels", "x", "y"},
+		"$.status.containerStatuses[0].restarts": {"status", "containerStatuses", "0", "restarts"},
+	}
+	for path, want := range tests {
+		got, err := parsePath(path)
+		if err != nil {
+			t.Fatalf("parsePath(%q): %v", path, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parsePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"$", "$.a[", "$.a['b]", "$..a"} {
+		if _, err := parsePath(path); err == nil {
+			t.Errorf("parsePath(%q) expected an error", path)
+		}
+	}
+}
+
+func nodeWithHeartbeat(resourceVersion string, heartbeat metav1.Time, ready v1.ConditionStatus) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-7", UID: "node-7", ResourceVersion: resourceVersion},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{
+				{Type: v1.NodeReady, Status: ready, LastHeartbeatTime: heartbeat},
+			},
+		},
+	}
+}
+
+func TestSaveIgnoresHeartbeats(t *testing.T) {
+	store := newTestStore(t)
+
+	versions := []*v1.Node{
+		nodeWithHeartbeat("1", metav1.Unix(100, 0), v1.ConditionTrue),
+		nodeWithHeartbeat("2", metav1.Unix(140, 0), v1.ConditionTrue),
+		nodeWithHeartbeat("3", metav1.Unix(180, 0), v1.ConditionFalse),
+	}
+	for _, node := range versions {
+		if err := store.Save(*New(node, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := store.GetHistory("node", "none", "node-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 versions, got %d", len(history))
+	}
+
+	diffs, err := store.GetDiffs("node", "none", "node-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{{Path: "$.status.conditions[0].status", Old: "True", New: "False"}}
+	if len(diffs) != 1 || !reflect.DeepEqual(diffs[0].Changes, want) {
+		t.Fatalf("unexpected diffs %+v", diffs)
+	}
+}
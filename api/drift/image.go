@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ImageRecord tracks when a workload was observed running an image tag at a given digest.
+type ImageRecord struct {
+	Image     string    `json:"image"`
+	Digest    string    `json:"digest"`
+	Namespace string    `json:"namespace"`
+	OwnerKind string    `json:"ownerKind"`
+	OwnerName string    `json:"ownerName"`
+	Pods      []string  `json:"pods"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (r *ImageRecord) GetKey() string {
+	return fmt.Sprintf("%s%s/%s/%s/%s", imageKeyPrefix(r.Image), r.Digest, r.Namespace, r.OwnerKind, r.OwnerName)
+}
+
+func imageKeyPrefix(image string) string {
+	return fmt.Sprintf("/image/%s/", url.PathEscape(image))
+}
+
+func containerImages(o v1.Pod) []ContainerImage {
+	var images []ContainerImage
+
+	statuses := map[string]v1.ContainerStatus{}
+	for _, cs := range o.Status.InitContainerStatuses {
+		statuses[cs.Name] = cs
+	}
+	for _, cs := range o.Status.ContainerStatuses {
+		statuses[cs.Name] = cs
+	}
+
+	containers := make([]v1.Container, 0, len(o.Spec.InitContainers)+len(o.Spec.Containers))
+	containers = append(containers, o.Spec.InitContainers...)
+	containers = append(containers, o.Spec.Containers...)
+
+	for _, c := range containers {
+		image := ContainerImage{
+			Container: c.Name,
+			Image:     normalizeImage(c.Image),
+		}
+		if cs, ok := statuses[c.Name]; ok {
+			image.ImageID = cs.ImageID
+			image.Digest = imageDigest(cs.ImageID)
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// normalizeImage adds the implicit latest tag to an untagged image reference.
+func normalizeImage(image string) string {
+	if strings.Contains(image, "@") {
+		return image
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if !strings.Contains(name, ":") {
+		return image + ":latest"
+	}
+	return image
+}
+
+// imageDigest extracts the digest from a container status imageID such as
+// docker-pullable://nginx@sha256:... or sha256:...
+func imageDigest(imageID string) string {
+	if i := strings.LastIndex(imageID, "@"); i >= 0 {
+		return imageID[i+1:]
+	}
+	if i := strings.Index(imageID, "://"); i >= 0 {
+		imageID = imageID[i+3:]
+	}
+	if strings.HasPrefix(imageID, "sha256:") {
+		return imageID
+	}
+	return ""
+}
+
+func podOwner(drift KubeDrift) (string, string) {
+	for _, ref := range drift.MetaData.OwnerReferences {
+		if ref.Controller != nil && *ref.Controller {
+			return ref.Kind, ref.Name
+		}
+	}
+	return "Pod", drift.MetaData.Name
+}
+
+// trackImages records the tag to digest mapping of every container in a pod and
+// raises findings when a workload runs several digests for the same tag, or a
+// container's digest changed while its image tag did not.
+func (s *Store) trackImages(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if drift.EventType == EventTypeDeleted {
+		// a deleted pod no longer runs its images
+		return nil
+	}
+	prevDigests := map[string]ContainerImage{}
+	if prev != nil {
+		for _, image := range prev.Images {
+			prevDigests[image.Container] = image
+		}
+	}
+
+	ownerKind, ownerName := podOwner(drift)
+	now := time.Now().UTC()
+
+	for _, image := range drift.Images {
+		if image.Digest == "" || strings.Contains(image.Image, "@") {
+			continue
+		}
+
+		if p, ok := prevDigests[image.Container]; ok && p.Image == image.Image && p.Digest != "" && p.Digest != image.Digest {
+			err := s.saveFinding(b, Finding{
+				Type:      "ImageDigestChanged",
+				Severity:  SeverityWarning,
+				Kind:      "Pod",
+				Namespace: drift.MetaData.Namespace,
+				Name:      drift.MetaData.Name,
+				UID:       drift.MetaData.UID,
+				Message:   fmt.Sprintf("container %s image %s changed digest from %s to %s without a spec change", image.Container, image.Image, p.Digest, image.Digest),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		record := ImageRecord{
+			Image:     image.Image,
+			Digest:    image.Digest,
+			Namespace: drift.MetaData.Namespace,
+			OwnerKind: ownerKind,
+			OwnerName: ownerName,
+			FirstSeen: now,
+		}
+		data, err := s.get(b, record.GetKey())
+		if err == nil {
+			if err := s.unmarshal(data, &record); err != nil {
+				return err
+			}
+		} else if err != leveldb.ErrNotFound {
+			return err
+		}
+		record.LastSeen = now
+		record.Pods = appendUnique(record.Pods, drift.MetaData.Name)
+
+		data, err = s.encode(record)
+		if err != nil {
+			return err
+		}
+		if err := s.set(b, record.GetKey(), data); err != nil {
+			return err
+		}
+
+		if err := s.checkImageDigests(b, image.Image, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkImageDigests flags an image tag that currently resolves to more than one
+// digest, across the cluster and within the workload that owns record.
+func (s *Store) checkImageDigests(b *batch, image string, record ImageRecord) error {
+	records, err := s.getImageRecords(b, image)
+	if err != nil {
+		return err
+	}
+
+	active := time.Now().UTC().Add(-s.window)
+	clusterDigests := map[string]bool{}
+	workloadDigests := map[string]bool{}
+	for _, r := range records {
+		if r.LastSeen.Before(active) {
+			continue
+		}
+		clusterDigests[r.Digest] = true
+		if r.Namespace == record.Namespace && r.OwnerKind == record.OwnerKind && r.OwnerName == record.OwnerName {
+			workloadDigests[r.Digest] = true
+		}
+	}
+
+	workload := Finding{
+		Type:      "WorkloadDigestMismatch",
+		Severity:  SeverityWarning,
+		Kind:      record.OwnerKind,
+		Namespace: record.Namespace,
+		Name:      record.OwnerName,
+		Subject:   image,
+		Message:   fmt.Sprintf("image %s is running with digests %s", image, strings.Join(keys(workloadDigests), ", ")),
+	}
+	if len(workloadDigests) > 1 {
+		if err := s.saveFinding(b, workload); err != nil {
+			return err
+		}
+	} else if err := s.clearFinding(b, workload.GetKey()); err != nil {
+		// the digests of the image converged once the pods running the others
+		// were replaced; mismatches of other images have keys of their own
+		return err
+	}
+
+	cluster := Finding{
+		Type:     "ImageTagDigestMismatch",
+		Severity: SeverityInfo,
+		Kind:     "Image",
+		Name:     url.PathEscape(image),
+		Message:  fmt.Sprintf("image %s resolves to digests %s across the cluster", image, strings.Join(keys(clusterDigests), ", ")),
+	}
+	if len(clusterDigests) > 1 {
+		return s.saveFinding(b, cluster)
+	}
+	return s.clearFinding(b, cluster.GetKey())
+}
+
+// GetImageRecords returns every digest and workload observed for image, or for
+// all images when image is empty.
+func (s *Store) GetImageRecords(image string) ([]ImageRecord, error) {
+	return s.getImageRecords(nil, image)
+}
+
+func (s *Store) getImageRecords(b *batch, image string) ([]ImageRecord, error) {
+	prefix := "/image/"
+	if image != "" {
+		prefix = imageKeyPrefix(image)
+	}
+
+	var records []ImageRecord
+	err := s.scan(b, prefix, func(key string, value []byte) {
+		r := ImageRecord{}
+		if err := s.unmarshal(value, &r); err != nil {
+			klog.Errorf("error decoding image record %s: %v", key, err)
+			return
+		}
+		records = append(records, r)
+	})
+	return records, err
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func keys(m map[string]bool) []string {
+	var k []string
+	for key := range m {
+		k = append(k, key)
+	}
+	sort.Strings(k)
+	return k
+}
@@ -0,0 +1,191 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	store := &Store{}
+	if err := store.New(t.TempDir()); err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func testPod(name, image, imageID string) v1.Pod {
+	controller := true
+	return v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + name),
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: "ReplicaSet", Name: "web-5d4f", Controller: &controller},
+			},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "web", Image: image}},
+		},
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{{Name: "web", Image: image, ImageID: imageID}},
+		},
+	}
+}
+
+func TestImageDigest(t *testing.T) {
+	tests := map[string]string{
+		"docker-pullable://nginx@sha256:abc": "sha256:abc",
+		"docker.io/library/nginx@sha256:def": "sha256:def",
+		"sha256:123":                         "sha256:123",
+		"docker://sha256:456":                "sha256:456",
+		"":                                   "",
+	}
+	for imageID, want := range tests {
+		if got := imageDigest(imageID); got != want {
+			t.Errorf("imageDigest(%q) = %q, want %q", imageID, got, want)
+		}
+	}
+}
+
+func TestNormalizeImage(t *testing.T) {
+	tests := map[string]string{
+		"nginx":                "nginx:latest",
+		"nginx:1.21":           "nginx:1.21",
+		"registry:5000/app":    "registry:5000/app:latest",
+		"registry:5000/app:v2": "registry:5000/app:v2",
+		"nginx@sha256:abc":     "nginx@sha256:abc",
+	}
+	for image, want := range tests {
+		if got := normalizeImage(image); got != want {
+			t.Errorf("normalizeImage(%q) = %q, want %q", image, got, want)
+		}
+	}
+}
+
+func TestTrackImagesWorkloadDigestMismatch(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, pod := range []v1.Pod{
+		testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"),
+		testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"),
+	} {
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatalf("error saving pod: %v", err)
+		}
+	}
+
+	records, err := store.GetImageRecords("nginx:1.21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 image records, got %d", len(records))
+	}
+
+	findings, err := store.GetFindings("/WorkloadDigestMismatch/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Name != "web-5d4f" {
+		t.Fatalf("expected a digest mismatch finding for web-5d4f, got %+v", findings)
+	}
+}
+
+func TestTrackImagesWorkloadDigestMismatchPerImage(t *testing.T) {
+	store := newTestStore(t)
+	store.window = 200 * time.Millisecond
+
+	withSidecar := func(pod v1.Pod, imageID string) v1.Pod {
+		pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: "proxy", Image: "envoy:1.19"})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses,
+			v1.ContainerStatus{Name: "proxy", Image: "envoy:1.19", ImageID: imageID})
+		return pod
+	}
+	for _, pod := range []v1.Pod{
+		withSidecar(testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"), "docker-pullable://envoy@sha256:ccc"),
+		withSidecar(testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"), "docker-pullable://envoy@sha256:ddd"),
+	} {
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatalf("error saving pod: %v", err)
+		}
+	}
+	findings, err := store.GetFindings("/WorkloadDigestMismatch/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("expected a digest mismatch finding per image, got %+v", findings)
+	}
+
+	// web-1 is replaced by a pod running the digest of nginx of web-2, but
+	// a third digest of envoy
+	time.Sleep(300 * time.Millisecond)
+	pod := withSidecar(testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"), "docker-pullable://envoy@sha256:ddd")
+	if err := store.Save(*New(pod, "update")); err != nil {
+		t.Fatalf("error saving pod: %v", err)
+	}
+	pod = withSidecar(testPod("web-3", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"), "docker-pullable://envoy@sha256:eee")
+	if err := store.Save(*New(pod, "update")); err != nil {
+		t.Fatalf("error saving pod: %v", err)
+	}
+	findings, err = store.GetFindings("/WorkloadDigestMismatch/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Subject != "envoy:1.19" {
+		t.Errorf("expected only the mismatch of envoy to be kept, got %+v", findings)
+	}
+}
+
+func TestTrackImagesWorkloadDigestsConverge(t *testing.T) {
+	store := newTestStore(t)
+	store.window = 200 * time.Millisecond
+
+	for _, pod := range []v1.Pod{
+		testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"),
+		testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"),
+	} {
+		if err := store.Save(*New(pod, "update")); err != nil {
+			t.Fatalf("error saving pod: %v", err)
+		}
+	}
+	if findings, _ := store.GetFindings("/WorkloadDigestMismatch/"); len(findings) != 1 {
+		t.Fatalf("expected a digest mismatch finding, got %+v", findings)
+	}
+
+	// web-1 was replaced by the rollout, so only the new digest stays active
+	time.Sleep(300 * time.Millisecond)
+	if err := store.Save(*New(testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"), "update")); err != nil {
+		t.Fatalf("error saving pod: %v", err)
+	}
+	for _, prefix := range []string{"/WorkloadDigestMismatch/", "/ImageTagDigestMismatch/"} {
+		if findings, _ := store.GetFindings(prefix); len(findings) != 0 {
+			t.Errorf("expected the %s finding to clear once digests converged, got %+v", prefix, findings)
+		}
+	}
+}
+
+func TestTrackImagesDigestChanged(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, imageID := range []string{"docker-pullable://nginx@sha256:aaa", "docker-pullable://nginx@sha256:bbb"} {
+		if err := store.Save(*New(testPod("web-1", "nginx:1.21", imageID), "update")); err != nil {
+			t.Fatalf("error saving pod: %v", err)
+		}
+	}
+
+	findings, err := store.GetFindings("/ImageDigestChanged/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 {
+		t.Fatalf("expected one digest changed finding, got %+v", findings)
+	}
+}
@@ -0,0 +1,327 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/klog/v2"
+)
+
+// Secondary indexes map a property of a record to its primary key, as keys
+// with empty values:
+//
+//	/index/owner/<owner uid><primary key>
+//	/index/node/<node name><primary key>
+//	/index/label/<name>=<value><primary key>
+//	/index/time/<last seen unixnano><primary key>
+//	/index/involved/<involved object uid><event primary key>
+//
+// Index values are path escaped, so the primary key follows the first slash
+// after the value. Index entries are written in the same batch as the record
+// they point to.
+const indexPrefix = "/index/"
+
+const (
+	indexOwner = "owner"
+	indexNode  = "node"
+	indexLabel = "label"
+	indexTime  = "time"
+	// indexInvolved links events to the object they are about
+	indexInvolved = "involved"
+)
+
+// DefaultIndexedLabels are the labels records are indexed by.
+var DefaultIndexedLabels = []string{
+	"app",
+	"app.kubernetes.io/name",
+	"app.kubernetes.io/instance",
+	"app.kubernetes.io/part-of",
+	"k8s-app",
+}
+
+// SetIndexedLabels sets the labels records are indexed by. Records saved
+// before a change keep the index entries they were saved with.
+func (s *Store) SetIndexedLabels(labels []string) {
+	s.indexedLabels = labels
+}
+
+func indexKeyPrefix(index, value string) string {
+	return indexPrefix + index + "/" + url.PathEscape(value)
+}
+
+func timeIndexValue(t time.Time) string {
+	return fmt.Sprintf("%019d", t.UnixNano())
+}
+
+// indexKeys returns the index entries of a record.
+func (s *Store) indexKeys(drift KubeDrift) []string {
+	key := drift.GetKey()
+	var entries []string
+	for _, owner := range drift.MetaData.OwnerReferences {
+		entries = append(entries, indexKeyPrefix(indexOwner, string(owner.UID))+key)
+	}
+	if drift.NodeName != "" {
+		entries = append(entries, indexKeyPrefix(indexNode, drift.NodeName)+key)
+	}
+	for _, label := range s.indexedLabels {
+		if value, ok := drift.MetaData.Labels[label]; ok {
+			entries = append(entries, indexKeyPrefix(indexLabel, label+"="+value)+key)
+		}
+	}
+	if !drift.LastSeen.IsZero() {
+		entries = append(entries, indexKeyPrefix(indexTime, timeIndexValue(drift.LastSeen))+key)
+	}
+	if uid := involvedUID(drift); uid != "" {
+		entries = append(entries, indexKeyPrefix(indexInvolved, uid)+key)
+	}
+	return entries
+}
+
+// updateIndexes queues on batch the index changes from prev to drift.
+func (s *Store) updateIndexes(batch batchWriter, prev *KubeDrift, drift KubeDrift) {
+	current := map[string]bool{}
+	for _, k := range s.indexKeys(drift) {
+		current[k] = true
+		batch.Put([]byte(k), nil)
+	}
+	if prev == nil {
+		return
+	}
+	prev.SetKey()
+	for _, k := range s.indexKeys(*prev) {
+		if !current[k] {
+			batch.Delete([]byte(k))
+		}
+	}
+}
+
+// indexedKeys returns the primary keys indexed under the values of an index
+// between from and to, or under the single value from when to is empty.
+func (s *Store) indexedKeys(index, from, to string) (map[string]bool, error) {
+	var r *util.Range
+	if to == "" {
+		r = util.BytesPrefix([]byte(indexKeyPrefix(index, from) + "/"))
+	} else {
+		r = &util.Range{Start: []byte(indexKeyPrefix(index, from)), Limit: []byte(indexKeyPrefix(index, to))}
+	}
+
+	keys := map[string]bool{}
+	iter := s.db.NewIterator(r, nil)
+	for iter.Next() {
+		entry := strings.TrimPrefix(string(iter.Key()), indexPrefix+index+"/")
+		if i := strings.Index(entry, "/"); i >= 0 {
+			keys[entry[i:]] = true
+		}
+	}
+	iter.Release()
+	return keys, iter.Error()
+}
+
+// IndexQuery selects records by their indexed properties. Every field set
+// must match; Since and Until bound the time a record was last seen.
+type IndexQuery struct {
+	Kind      string
+	Namespace string
+	Owner     string
+	Node      string
+	Involved  string
+	Labels    map[string]string
+	Since     time.Time
+	Until     time.Time
+}
+
+// Query returns the latest records matching q, using the secondary indexes
+// instead of scanning the records of a kind.
+func (s *Store) Query(q IndexQuery) ([]KubeDrift, error) {
+	var matched map[string]bool
+	intersect := func(keys map[string]bool, err error) error {
+		if err != nil {
+			return err
+		}
+		if matched == nil {
+			matched = keys
+			return nil
+		}
+		for k := range matched {
+			if !keys[k] {
+				delete(matched, k)
+			}
+		}
+		return nil
+	}
+
+	if q.Owner != "" {
+		if err := intersect(s.ownedKeys(q.Owner)); err != nil {
+			return nil, err
+		}
+	}
+	if q.Node != "" {
+		if err := intersect(s.indexedKeys(indexNode, q.Node, "")); err != nil {
+			return nil, err
+		}
+	}
+	if q.Involved != "" {
+		if err := intersect(s.indexedKeys(indexInvolved, q.Involved, "")); err != nil {
+			return nil, err
+		}
+	}
+	for label, value := range q.Labels {
+		if err := intersect(s.indexedKeys(indexLabel, label+"="+value, "")); err != nil {
+			return nil, err
+		}
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		from, to := "", timeIndexValue(time.Now().Add(time.Hour))
+		if !q.Since.IsZero() {
+			from = timeIndexValue(q.Since)
+		}
+		if !q.Until.IsZero() {
+			to = timeIndexValue(q.Until)
+		}
+		if err := intersect(s.indexedKeys(indexTime, from, to)); err != nil {
+			return nil, err
+		}
+	}
+	if matched == nil {
+		return nil, fmt.Errorf("query needs an owner, node, involved object, label or time range")
+	}
+
+	var keys []string
+	for k := range matched {
+		// primary keys are /kind/namespace/name/uid
+		segments := strings.Split(k, "/")
+		if len(segments) != 5 {
+			continue
+		}
+		if q.Kind != "" && !strings.EqualFold(q.Kind, segments[1]) {
+			continue
+		}
+		if q.Namespace != "" && q.Namespace != segments[2] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var drifts []KubeDrift
+	for _, k := range keys {
+		drift, err := s.GetDriftByKey(k)
+		if err == leveldb.ErrNotFound {
+			klog.Warningf("index entry for missing record %s", k)
+			continue
+		}
+		if err != nil {
+			return drifts, err
+		}
+		drifts = append(drifts, drift)
+	}
+	return drifts, nil
+}
+
+// ownedKeys returns the records owned by the object with the given UID, and
+// those owned by them in turn, such as the pods of a deployment's replica sets.
+func (s *Store) ownedKeys(uid string) (map[string]bool, error) {
+	owned := map[string]bool{}
+	queue := []string{uid}
+	visited := map[string]bool{}
+	for len(queue) > 0 {
+		owner := queue[0]
+		queue = queue[1:]
+		if visited[owner] {
+			continue
+		}
+		visited[owner] = true
+
+		keys, err := s.indexedKeys(indexOwner, owner, "")
+		if err != nil {
+			return nil, err
+		}
+		for k := range keys {
+			owned[k] = true
+			// the UID is the last segment of a primary key
+			queue = append(queue, k[strings.LastIndex(k, "/")+1:])
+		}
+	}
+	return owned, nil
+}
+
+// GetUID returns the UID of the latest record of the named object.
+func (s *Store) GetUID(kind, namespace, name string) (string, error) {
+	if namespace == "" {
+		namespace = "none"
+	}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(fmt.Sprintf("/%s/%s/%s/", kind, namespace, name))), nil)
+	defer iter.Release()
+
+	var latest *KubeDrift
+	for iter.Next() {
+		drift := KubeDrift{}
+		if err := s.unmarshal(iter.Value(), &drift); err != nil {
+			continue
+		}
+		if latest == nil || drift.LastSeen.After(latest.LastSeen) {
+			latest = &drift
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return "", err
+	}
+	if latest == nil {
+		return "", leveldb.ErrNotFound
+	}
+	return string(latest.MetaData.UID), nil
+}
+
+func migrateIndexes(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if !isRecordKey(string(iter.Key())) {
+			continue
+		}
+		drift := KubeDrift{}
+		if err := s.unmarshal(iter.Value(), &drift); err != nil || drift.Type == "" {
+			continue
+		}
+		drift.SetKey()
+		if drift.GetKey() != string(iter.Key()) {
+			continue
+		}
+		for _, k := range s.indexKeys(drift) {
+			batch.Put([]byte(k), nil)
+		}
+		changed++
+	}
+	return changed, iter.Error()
+}
+
+// migrateInvolvedIndexes indexes the events recorded before events were
+// indexed by the object they are about.
+func migrateInvolvedIndexes(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	iter := s.db.NewIterator(util.BytesPrefix([]byte("/event/")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		drift := KubeDrift{}
+		if err := s.unmarshal(iter.Value(), &drift); err != nil || drift.Type != "event" {
+			continue
+		}
+		drift.SetKey()
+		if drift.GetKey() != string(iter.Key()) {
+			continue
+		}
+		if uid := involvedUID(drift); uid != "" {
+			batch.Put([]byte(indexKeyPrefix(indexInvolved, uid)+drift.GetKey()), nil)
+			changed++
+		}
+	}
+	return changed, iter.Error()
+}
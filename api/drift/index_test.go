@@ -0,0 +1,89 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func indexedPod(name, node string, owner types.UID) KubeDrift {
+	pod := testPod(name, "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+	pod.Labels = map[string]string{"app": "checkout", "pod-template-hash": "5d4f"}
+	pod.OwnerReferences[0].UID = owner
+	pod.Spec.NodeName = node
+	return *New(pod, "update")
+}
+
+func queryNames(t *testing.T, store *Store, q IndexQuery) string {
+	t.Helper()
+	drifts, err := store.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range drifts {
+		names = append(names, d.MetaData.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestQueryIndexes(t *testing.T) {
+	store := newTestStore(t)
+	start := time.Now()
+
+	replicaSet := KubeDrift{
+		Type: "replicaset",
+		MetaData: ObjectMeta{
+			Name:            "checkout-5d4f",
+			Namespace:       "default",
+			UID:             "uid-rs",
+			OwnerReferences: []metav1.OwnerReference{{Kind: "Deployment", Name: "checkout", UID: "uid-deploy"}},
+		},
+	}
+	for _, drift := range []KubeDrift{
+		replicaSet,
+		indexedPod("web-1", "node-7", "uid-rs"),
+		indexedPod("web-2", "node-7", "uid-rs"),
+		indexedPod("web-3", "node-8", "uid-rs"),
+		indexedPod("other", "node-7", "uid-other"),
+	} {
+		if err := store.Save(drift); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := queryNames(t, store, IndexQuery{Kind: "pod", Node: "node-7", Since: start}); got != "other,web-1,web-2" {
+		t.Errorf("pods on node-7: got %s", got)
+	}
+	if got := queryNames(t, store, IndexQuery{Owner: "uid-deploy", Kind: "pod"}); got != "web-1,web-2,web-3" {
+		t.Errorf("pods owned by the deployment: got %s", got)
+	}
+	if got := queryNames(t, store, IndexQuery{Labels: map[string]string{"app": "checkout"}, Node: "node-8"}); got != "web-3" {
+		t.Errorf("checkout pods on node-8: got %s", got)
+	}
+	if got := queryNames(t, store, IndexQuery{Node: "node-7", Until: start}); got != "" {
+		t.Errorf("expected no pods seen before the test started, got %s", got)
+	}
+
+	// rescheduling moves the record between node index entries
+	if err := store.Save(indexedPod("web-1", "node-8", "uid-rs")); err != nil {
+		t.Fatal(err)
+	}
+	if got := queryNames(t, store, IndexQuery{Node: "node-7"}); got != "other,web-2" {
+		t.Errorf("pods on node-7 after rescheduling: got %s", got)
+	}
+	if got := queryNames(t, store, IndexQuery{Node: "node-8"}); got != "web-1,web-3" {
+		t.Errorf("pods on node-8 after rescheduling: got %s", got)
+	}
+
+	timeEntries, err := store.indexedKeys(indexTime, "", timeIndexValue(time.Now().Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timeEntries) != 5 {
+		t.Errorf("expected one time index entry per record, got %d", len(timeEntries))
+	}
+}
@@ -0,0 +1,319 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+const schemaVersionKey = "/meta/schema-version"
+
+// internalPrefixes are the first key segments used by the store for data other
+// than the latest record of an object.
+var internalPrefixes = map[string]bool{
+	"meta":             true,
+	"history":          true,
+	"finding":          true,
+	"image":            true,
+	"configchange":     true,
+	"eventseries":      true,
+	"permissionchange": true,
+	"archive":          true,
+	"index":            true,
+	"quarantine":       true,
+	"chain":            true,
+}
+
+// isRecordKey reports whether key holds the latest record of an object.
+func isRecordKey(key string) bool {
+	segments := strings.SplitN(strings.TrimPrefix(key, "/"), "/", 2)
+	return len(segments) == 2 && !internalPrefixes[segments[0]]
+}
+
+// Migration upgrades the store from Version-1 to Version. Migrate queues its
+// writes on batch and returns the number of records it changes.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(s *Store, batch *leveldb.Batch) (int, error)
+}
+
+// MigrationResult reports what a migration changed, or would change in a dry run.
+type MigrationResult struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Changed     int    `json:"changed"`
+	DryRun      bool   `json:"dryRun"`
+}
+
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "convert flat legacy records (uuid, templateHash, kind) and raw events to the KubeDrift layout and key",
+		Migrate:     migrateLegacyRecords,
+	},
+	{
+		Version:     2,
+		Description: "wrap plain JSON values in the record envelope",
+		Migrate:     migrateEnvelope,
+	},
+	{
+		Version:     3,
+		Description: "seed the history of objects recorded before versions were kept",
+		Migrate:     migrateSeedHistory,
+	},
+	{
+		Version:     4,
+		Description: "build the owner, node, label and time indexes of existing records",
+		Migrate:     migrateIndexes,
+	},
+	{
+		Version:     5,
+		Description: "chain the history recorded before versions were hashed",
+		Migrate:     migrateChain,
+	},
+	{
+		Version:     6,
+		Description: "index existing events by the object they involve",
+		Migrate:     migrateInvolvedIndexes,
+	},
+}
+
+// CurrentSchemaVersion is the schema version written by this version of kube-drift.
+var CurrentSchemaVersion = migrations[len(migrations)-1].Version
+
+// SchemaVersion returns the schema version of the store. A store without a
+// version predates schema versioning and is version 0.
+func (s *Store) SchemaVersion() (int, error) {
+	data, err := s.db.Get([]byte(schemaVersionKey), nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(data))
+}
+
+func (s *Store) empty() (bool, error) {
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if string(iter.Key()) != schemaVersionKey {
+			return false, nil
+		}
+	}
+	return true, iter.Error()
+}
+
+// Migrate runs the migrations newer than the store's schema version, each in a
+// single atomic batch together with the version bump. With dryRun the store is
+// left untouched and the results report what each migration would change
+// against the current data.
+func (s *Store) Migrate(dryRun bool) ([]MigrationResult, error) {
+	version, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > CurrentSchemaVersion {
+		return nil, fmt.Errorf("store schema version %d is newer than supported version %d", version, CurrentSchemaVersion)
+	}
+
+	empty, err := s.empty()
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		if dryRun || version == CurrentSchemaVersion {
+			return nil, nil
+		}
+		return nil, s.put([]byte(schemaVersionKey), []byte(strconv.Itoa(CurrentSchemaVersion)))
+	}
+
+	var results []MigrationResult
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+
+		batch := new(leveldb.Batch)
+		changed, err := m.Migrate(s, batch)
+		if err != nil {
+			return results, fmt.Errorf("migration %d (%s): %v", m.Version, m.Description, err)
+		}
+		results = append(results, MigrationResult{Version: m.Version, Description: m.Description, Changed: changed, DryRun: dryRun})
+		klog.Infof("migration %d (%s): %d records changed, dry run: %v", m.Version, m.Description, changed, dryRun)
+
+		if dryRun {
+			continue
+		}
+		batch.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(m.Version)))
+		if err := s.writeBatch(batch); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// legacyRecord is the flat layout records were stored in before KubeDrift.
+type legacyRecord struct {
+	UUID              string                 `json:"uuid"`
+	ResourceVersion   string                 `json:"resourceVersion"`
+	Name              string                 `json:"name"`
+	GenerationName    string                 `json:"generationName"`
+	TemplateHash      string                 `json:"templateHash"`
+	Namespace         string                 `json:"namespace"`
+	Kind              string                 `json:"kind"`
+	CreationTimestamp metav1.Time            `json:"creationTimestamp"`
+	Labels            map[string]string      `json:"labels"`
+	Annotations       map[string]string      `json:"annotations"`
+	Status            map[string]interface{} `json:"status"`
+}
+
+func migrateLegacyRecords(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := string(iter.Key())
+		if !isRecordKey(key) {
+			continue
+		}
+		data, err := s.decode(iter.Value())
+		if err != nil {
+			klog.Errorf("migration: skipping undecodable record %s: %v", key, err)
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			klog.Errorf("migration: skipping undecodable record %s: %v", key, err)
+			continue
+		}
+
+		var drift *KubeDrift
+		switch {
+		case fields["metaData"] != nil:
+			continue
+		case fields["uuid"] != nil:
+			legacy := legacyRecord{}
+			if err := json.Unmarshal(data, &legacy); err != nil {
+				return changed, fmt.Errorf("record %s: %v", key, err)
+			}
+			drift = &KubeDrift{
+				Type:      strings.ToLower(legacy.Kind),
+				EventType: "update",
+				MetaData: ObjectMeta{
+					Name:              legacy.Name,
+					GenerateName:      legacy.GenerationName,
+					Namespace:         legacy.Namespace,
+					UID:               types.UID(legacy.UUID),
+					ResourceVersion:   legacy.ResourceVersion,
+					CreationTimestamp: legacy.CreationTimestamp,
+					Labels:            legacy.Labels,
+					Annotations:       legacy.Annotations,
+				},
+			}
+			if legacy.Status != nil {
+				drift.Status = legacy.Status
+			}
+		case fields["involvedObject"] != nil:
+			event := v1.Event{}
+			if err := json.Unmarshal(data, &event); err != nil {
+				return changed, fmt.Errorf("record %s: %v", key, err)
+			}
+			drift = New(&event, "update")
+		default:
+			klog.Warningf("migration: leaving record %s of unknown layout", key)
+			continue
+		}
+
+		value, err := s.encode(drift)
+		if err != nil {
+			return changed, err
+		}
+		if drift.GetKey() != key {
+			batch.Delete([]byte(key))
+		}
+		batch.Put([]byte(drift.GetKey()), value)
+		changed++
+	}
+	return changed, iter.Error()
+}
+
+func migrateEnvelope(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		if string(iter.Key()) == schemaVersionKey || bytes.HasPrefix(iter.Value(), envelopeMagic) {
+			continue
+		}
+		if !json.Valid(iter.Value()) {
+			klog.Errorf("migration: skipping non-JSON value %s", iter.Key())
+			continue
+		}
+		value, err := s.wrap(iter.Value())
+		if err != nil {
+			return changed, err
+		}
+		batch.Put(append([]byte{}, iter.Key()...), value)
+		changed++
+	}
+	return changed, iter.Error()
+}
+
+func migrateSeedHistory(s *Store, batch *leveldb.Batch) (int, error) {
+	changed := 0
+	iter := s.db.NewIterator(nil, nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		key := string(iter.Key())
+		if !isRecordKey(key) {
+			continue
+		}
+		drift := KubeDrift{}
+		if err := s.unmarshal(iter.Value(), &drift); err != nil || drift.Type == "" {
+			continue
+		}
+
+		prefix := historyPrefix(drift.Type, drift.MetaData.Namespace, drift.MetaData.Name)
+		versions := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+		seeded := versions.Next()
+		versions.Release()
+		if seeded {
+			continue
+		}
+
+		if drift.ObservedAt.IsZero() {
+			drift.ObservedAt = drift.MetaData.CreationTimestamp.Time.UTC()
+			if drift.ObservedAt.IsZero() {
+				drift.ObservedAt = time.Now().UTC()
+			}
+		}
+		doc, err := json.Marshal(drift)
+		if err != nil {
+			return changed, err
+		}
+		value, err := s.encode(versionRecord{Snapshot: doc})
+		if err != nil {
+			return changed, err
+		}
+		batch.Put([]byte(drift.historyKey()), value)
+		changed++
+	}
+	return changed, iter.Error()
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestMigrateLegacySample(t *testing.T) {
+	store := newTestStore(t)
+
+	sample, err := ioutil.ReadFile("../../samples/pod-drift.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey := "/pod/kubernetes-dashboard/5594458c94/444cd945-2ff1-401e-a0b5-f3f3ef040690"
+	if err := store.db.Put([]byte(legacyKey), sample, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := store.Migrate(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != CurrentSchemaVersion || results[0].Changed != 1 {
+		t.Fatalf("unexpected dry run results %+v", results)
+	}
+	if version, _ := store.SchemaVersion(); version != 0 {
+		t.Fatalf("dry run changed the schema version to %d", version)
+	}
+
+	if _, err := store.Migrate(false); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := store.SchemaVersion(); version != CurrentSchemaVersion {
+		t.Fatalf("expected schema version %d, got %d", CurrentSchemaVersion, version)
+	}
+
+	if _, err := store.db.Get([]byte(legacyKey), nil); err == nil {
+		t.Errorf("legacy key %s was not removed", legacyKey)
+	}
+	key := "/pod/kubernetes-dashboard/dashboard-metrics-scraper-5594458c94-4s78n/444cd945-2ff1-401e-a0b5-f3f3ef040690"
+	drift, err := store.GetDriftByKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := podStatus(drift)
+	if err != nil || status.Phase != "Running" {
+		t.Errorf("unexpected migrated status %+v: %v", status, err)
+	}
+
+	history, err := store.GetHistory("pod", "kubernetes-dashboard", "dashboard-metrics-scraper-5594458c94-4s78n")
+	if err != nil || len(history) != 1 {
+		t.Errorf("expected a seeded history version, got %d: %v", len(history), err)
+	}
+
+	results, err = store.Migrate(false)
+	if err != nil || len(results) != 0 {
+		t.Errorf("expected no pending migrations, got %+v: %v", results, err)
+	}
+}
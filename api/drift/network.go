@@ -0,0 +1,456 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// EndpointSliceSpec is the recorded content of an EndpointSlice, which has no
+// spec of its own.
+type EndpointSliceSpec struct {
+	AddressType discoveryv1.AddressType    `json:"addressType"`
+	Endpoints   []discoveryv1.Endpoint     `json:"endpoints"`
+	Ports       []discoveryv1.EndpointPort `json:"ports,omitempty"`
+}
+
+func (p *KubeDrift) newService(eventType string, o *v1.Service) {
+	p.Type = "service"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+// newEndpoints records the subsets of an Endpoints object as its status.
+func (p *KubeDrift) newEndpoints(eventType string, o *v1.Endpoints) {
+	p.Type = "endpoints"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Status = o.Subsets
+	p.SetKey()
+}
+
+func (p *KubeDrift) newEndpointSlice(eventType string, o *discoveryv1.EndpointSlice) {
+	p.Type = "endpointslice"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = EndpointSliceSpec{AddressType: o.AddressType, Endpoints: o.Endpoints, Ports: o.Ports}
+	p.SetKey()
+}
+
+func (p *KubeDrift) newIngress(eventType string, o *networkingv1.Ingress) {
+	p.Type = "ingress"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newNetworkPolicy(eventType string, o *networkingv1.NetworkPolicy) {
+	p.Type = "networkpolicy"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.SetKey()
+}
+
+// convert decodes a Spec or Status, which is typed when freshly built and a
+// generic map when read back from the store, into out.
+func convert(in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// checkNetwork detects changes of services, their endpoints and network
+// policies that commonly cause outages.
+func (s *Store) checkNetwork(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	switch drift.Type {
+	case "service":
+		return s.checkServiceSelector(b, prev, drift)
+	case "endpoints":
+		return s.checkEndpoints(b, prev, drift)
+	case "endpointslice":
+		return s.checkEndpointSlice(b, prev, drift)
+	case "networkpolicy":
+		return s.checkNetworkPolicy(b, prev, drift)
+	}
+	return nil
+}
+
+func (s *Store) checkServiceSelector(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if drift.EventType == EventTypeDeleted {
+		// the findings about a deleted service are resolved with it
+		for _, t := range []string{"SelectorChanged", "EndpointsDroppedToZero"} {
+			f := Finding{Type: t, Kind: "Service", Namespace: drift.MetaData.Namespace, Name: drift.MetaData.Name}
+			if err := s.clearFinding(b, f.GetKey()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if prev == nil {
+		return nil
+	}
+	var before, after v1.ServiceSpec
+	if err := convert(prev.Spec, &before); err != nil {
+		return err
+	}
+	if err := convert(drift.Spec, &after); err != nil {
+		return err
+	}
+	if labels.Equals(before.Selector, after.Selector) {
+		return nil
+	}
+	return s.saveFinding(b, Finding{
+		Type:      "SelectorChanged",
+		Severity:  SeverityWarning,
+		Kind:      "Service",
+		Namespace: drift.MetaData.Namespace,
+		Name:      drift.MetaData.Name,
+		UID:       drift.MetaData.UID,
+		Message: fmt.Sprintf("selector changed from %q to %q",
+			labels.Set(before.Selector).String(), labels.Set(after.Selector).String()),
+	})
+}
+
+func readyAddresses(drift KubeDrift) (int, error) {
+	var subsets []v1.EndpointSubset
+	if err := convert(drift.Status, &subsets); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, subset := range subsets {
+		n += len(subset.Addresses)
+	}
+	return n, nil
+}
+
+// checkEndpoints counts the ready addresses of a service before and after
+// the change of its Endpoints. Deleted Endpoints have no addresses left.
+func (s *Store) checkEndpoints(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	var err error
+	after := 0
+	if drift.EventType != EventTypeDeleted {
+		if after, err = readyAddresses(drift); err != nil {
+			return err
+		}
+	}
+	before := 0
+	if prev != nil && prev.EventType != EventTypeDeleted {
+		if before, err = readyAddresses(*prev); err != nil {
+			return err
+		}
+	}
+	return s.updateEndpointsFinding(b, drift.MetaData.Namespace, drift.MetaData.Name, before, after)
+}
+
+func readyEndpoints(drift KubeDrift) (int, error) {
+	spec := EndpointSliceSpec{}
+	if err := convert(drift.Spec, &spec); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range spec.Endpoints {
+		if e.Conditions.Ready == nil || *e.Conditions.Ready {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// checkEndpointSlice counts the ready endpoints of every live slice of the
+// slice's service, before and after the change of this slice. A deleted slice
+// has no endpoints left.
+func (s *Store) checkEndpointSlice(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	service := drift.MetaData.Labels[discoveryv1.LabelServiceName]
+	if service == "" {
+		return nil
+	}
+	others, err := s.getDriftByKeyPrefix(b, fmt.Sprintf("/endpointslice/%s/", drift.MetaData.Namespace))
+	if err != nil {
+		return err
+	}
+	total := 0
+	for _, other := range others {
+		if other.MetaData.Labels[discoveryv1.LabelServiceName] != service || other.MetaData.UID == drift.MetaData.UID ||
+			other.EventType == EventTypeDeleted {
+			continue
+		}
+		n, err := readyEndpoints(other)
+		if err != nil {
+			return err
+		}
+		total += n
+	}
+
+	after := 0
+	if drift.EventType != EventTypeDeleted {
+		if after, err = readyEndpoints(drift); err != nil {
+			return err
+		}
+	}
+	before := 0
+	if prev != nil && prev.EventType != EventTypeDeleted {
+		if before, err = readyEndpoints(*prev); err != nil {
+			return err
+		}
+	}
+	return s.updateEndpointsFinding(b, drift.MetaData.Namespace, service, total+before, total+after)
+}
+
+// serviceDeleted reports whether every record of a service is a tombstone. A
+// service never recorded is not known to be deleted.
+func (s *Store) serviceDeleted(b *batch, namespace, name string) (bool, error) {
+	records, err := s.getDriftByKeyPrefix(b, fmt.Sprintf("/service/%s/%s/", namespace, name))
+	if err != nil || len(records) == 0 {
+		return false, err
+	}
+	for _, record := range records {
+		if record.EventType != EventTypeDeleted {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// updateEndpointsFinding reports a service whose ready endpoints dropped to
+// zero, until it has ready endpoints again or is deleted.
+func (s *Store) updateEndpointsFinding(b *batch, namespace, service string, before, after int) error {
+	finding := Finding{
+		Type:      "EndpointsDroppedToZero",
+		Severity:  SeverityCritical,
+		Kind:      "Service",
+		Namespace: namespace,
+		Name:      service,
+		Message:   fmt.Sprintf("ready endpoints dropped from %d to 0", before),
+	}
+	deleted, err := s.serviceDeleted(b, namespace, service)
+	if err != nil {
+		return err
+	}
+	switch {
+	case after > 0 || deleted:
+		return s.clearFinding(b, finding.GetKey())
+	case before > 0:
+		return s.saveFinding(b, finding)
+	}
+	return nil
+}
+
+func (s *Store) checkNetworkPolicy(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if drift.EventType == EventTypeDeleted {
+		// a deleted policy no longer selects or blocks anything
+		for _, t := range []string{"SelectorChanged", "PolicyBlocksTraffic"} {
+			f := Finding{Type: t, Kind: "NetworkPolicy", Namespace: drift.MetaData.Namespace, Name: drift.MetaData.Name}
+			if err := s.clearFinding(b, f.GetKey()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if prev == nil {
+		// a new policy isolates the pods it selects, but is also what every
+		// existing policy looks like when kube-drift starts
+		return nil
+	}
+	var before, after networkingv1.NetworkPolicySpec
+	if err := convert(prev.Spec, &before); err != nil {
+		return err
+	}
+	if err := convert(drift.Spec, &after); err != nil {
+		return err
+	}
+
+	finding := Finding{
+		Kind:      "NetworkPolicy",
+		Namespace: drift.MetaData.Namespace,
+		Name:      drift.MetaData.Name,
+		UID:       drift.MetaData.UID,
+	}
+	if !reflect.DeepEqual(before.PodSelector, after.PodSelector) {
+		f := finding
+		f.Type, f.Severity = "SelectorChanged", SeverityWarning
+		f.Message = fmt.Sprintf("pod selector changed from %q to %q",
+			metav1.FormatLabelSelector(&before.PodSelector), metav1.FormatLabelSelector(&after.PodSelector))
+		if err := s.saveFinding(b, f); err != nil {
+			return err
+		}
+	}
+
+	blocked := blockedTraffic(before, after)
+	if len(blocked) == 0 {
+		return nil
+	}
+	finding.Type, finding.Severity = "PolicyBlocksTraffic", SeverityWarning
+	finding.Message = "no longer allows " + strings.Join(blocked, "; ")
+	return s.saveFinding(b, finding)
+}
+
+// policyRule is an ingress or egress rule of a network policy: traffic from or
+// to any of peers, on any of ports. No peers or no ports allow all of them.
+type policyRule struct {
+	peers []networkingv1.NetworkPolicyPeer
+	ports []networkingv1.NetworkPolicyPort
+}
+
+// policyRules returns the rules of a policy for a direction, and whether the
+// policy restricts that direction at all.
+func policyRules(spec networkingv1.NetworkPolicySpec, direction networkingv1.PolicyType) ([]policyRule, bool) {
+	restricts := false
+	for _, t := range spec.PolicyTypes {
+		restricts = restricts || t == direction
+	}
+	// without policy types, a policy restricts ingress, and egress if it has
+	// egress rules
+	if len(spec.PolicyTypes) == 0 {
+		restricts = direction == networkingv1.PolicyTypeIngress ||
+			(direction == networkingv1.PolicyTypeEgress && len(spec.Egress) > 0)
+	}
+
+	var rules []policyRule
+	if direction == networkingv1.PolicyTypeIngress {
+		for _, r := range spec.Ingress {
+			rules = append(rules, policyRule{peers: r.From, ports: r.Ports})
+		}
+	} else {
+		for _, r := range spec.Egress {
+			rules = append(rules, policyRule{peers: r.To, ports: r.Ports})
+		}
+	}
+	return rules, restricts
+}
+
+// covers reports whether r allows all traffic allowed by other.
+func (r policyRule) covers(other policyRule) bool {
+	if len(r.peers) > 0 {
+		if len(other.peers) == 0 {
+			return false
+		}
+		for _, peer := range other.peers {
+			if !containsPeer(r.peers, peer) {
+				return false
+			}
+		}
+	}
+	if len(r.ports) > 0 {
+		if len(other.ports) == 0 {
+			return false
+		}
+		for _, port := range other.ports {
+			if !containsPort(r.ports, port) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsPeer(peers []networkingv1.NetworkPolicyPeer, peer networkingv1.NetworkPolicyPeer) bool {
+	for _, p := range peers {
+		if reflect.DeepEqual(p, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsPort(ports []networkingv1.NetworkPolicyPort, port networkingv1.NetworkPolicyPort) bool {
+	for _, p := range ports {
+		if reflect.DeepEqual(p, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedTraffic describes the rules of before whose traffic no single rule of
+// after allows any more. Traffic allowed by a combination of narrower rules
+// is reported too, so the result errs on the side of reporting.
+func blockedTraffic(before, after networkingv1.NetworkPolicySpec) []string {
+	var blocked []string
+	for _, direction := range []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress} {
+		beforeRules, beforeRestricts := policyRules(before, direction)
+		afterRules, afterRestricts := policyRules(after, direction)
+		if !afterRestricts {
+			continue
+		}
+		if !beforeRestricts {
+			// everything was allowed in this direction
+			beforeRules = []policyRule{{}}
+		}
+		for _, rule := range beforeRules {
+			allowed := false
+			for _, r := range afterRules {
+				if r.covers(rule) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				blocked = append(blocked, describeRule(direction, rule))
+			}
+		}
+	}
+	sort.Strings(blocked)
+	return blocked
+}
+
+func describeRule(direction networkingv1.PolicyType, rule policyRule) string {
+	peers := "anywhere"
+	if len(rule.peers) > 0 {
+		var ps []string
+		for _, p := range rule.peers {
+			ps = append(ps, describePeer(p))
+		}
+		peers = strings.Join(ps, ", ")
+	}
+	ports := "all ports"
+	if len(rule.ports) > 0 {
+		var ps []string
+		for _, p := range rule.ports {
+			protocol := v1.ProtocolTCP
+			if p.Protocol != nil {
+				protocol = *p.Protocol
+			}
+			port := "*"
+			if p.Port != nil {
+				port = p.Port.String()
+			}
+			ps = append(ps, fmt.Sprintf("%s/%s", protocol, port))
+		}
+		ports = strings.Join(ps, ", ")
+	}
+	preposition := "from"
+	if direction == networkingv1.PolicyTypeEgress {
+		preposition = "to"
+	}
+	return fmt.Sprintf("%s %s %s on %s", strings.ToLower(string(direction)), preposition, peers, ports)
+}
+
+func describePeer(p networkingv1.NetworkPolicyPeer) string {
+	var parts []string
+	if p.IPBlock != nil {
+		parts = append(parts, "ipBlock "+p.IPBlock.CIDR)
+	}
+	if p.PodSelector != nil {
+		parts = append(parts, fmt.Sprintf("pods %q", metav1.FormatLabelSelector(p.PodSelector)))
+	}
+	if p.NamespaceSelector != nil {
+		parts = append(parts, fmt.Sprintf("namespaces %q", metav1.FormatLabelSelector(p.NamespaceSelector)))
+	}
+	return strings.Join(parts, " in ")
+}
@@ -0,0 +1,231 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func findingTypes(t *testing.T, store *Store) []string {
+	t.Helper()
+	findings, err := store.GetFindings("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.Type+" "+f.Kind+" "+f.Name)
+	}
+	return got
+}
+
+func endpoints(addresses ...string) *v1.Endpoints {
+	subset := v1.EndpointSubset{}
+	for _, a := range addresses {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: a})
+	}
+	return &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-ep"},
+		Subsets:    []v1.EndpointSubset{subset},
+	}
+}
+
+func TestServiceEndpointsDroppedToZero(t *testing.T) {
+	store := newTestStore(t)
+	for _, ep := range []*v1.Endpoints{endpoints("10.0.0.1", "10.0.0.2"), endpoints()} {
+		if err := store.Save(*New(ep, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := findingTypes(t, store); !reflect.DeepEqual(got, []string{"EndpointsDroppedToZero Service web"}) {
+		t.Fatalf("unexpected findings %v", got)
+	}
+
+	if err := store.Save(*New(endpoints("10.0.0.3"), "update")); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Errorf("expected the finding to clear once endpoints are back, got %v", got)
+	}
+}
+
+func endpointSlice(name string, ready ...bool) *discoveryv1.EndpointSlice {
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID("uid-" + name),
+			Labels: map[string]string{discoveryv1.LabelServiceName: "web"}},
+		AddressType: discoveryv1.AddressTypeIPv4,
+	}
+	for i := range ready {
+		slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{"10.0.0.1"},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready[i]},
+		})
+	}
+	return slice
+}
+
+func TestEndpointSlicesDroppedToZero(t *testing.T) {
+	store := newTestStore(t)
+	for _, slice := range []*discoveryv1.EndpointSlice{
+		endpointSlice("web-a", true), endpointSlice("web-b", true),
+		// the service still has the endpoint of web-b
+		endpointSlice("web-a", false),
+	} {
+		if err := store.Save(*New(slice, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Fatalf("unexpected findings %v", got)
+	}
+
+	if err := store.Save(*New(endpointSlice("web-b"), "update")); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); !reflect.DeepEqual(got, []string{"EndpointsDroppedToZero Service web"}) {
+		t.Errorf("unexpected findings %v", got)
+	}
+}
+
+func TestDeletedEndpointSliceNotCounted(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store, endpointSlice("web-a", true), endpointSlice("web-b", true))
+
+	// deleting web-a leaves the endpoint of web-b
+	if err := store.WriteDeletion(context.Background(), "endpointslice", "default", "web-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Fatalf("unexpected findings %v", got)
+	}
+
+	// the deleted web-a no longer counts once web-b has no ready endpoints
+	saveAll(t, store, endpointSlice("web-b", false))
+	if got := findingTypes(t, store); !reflect.DeepEqual(got, []string{"EndpointsDroppedToZero Service web"}) {
+		t.Errorf("unexpected findings %v", got)
+	}
+	history, err := store.GetHistory("endpointslice", "default", "web-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[1].EventType != EventTypeDeleted {
+		t.Errorf("expected the history of web-a to end with its deletion, got %+v", history)
+	}
+}
+
+func TestServiceSelectorChanged(t *testing.T) {
+	store := newTestStore(t)
+	for _, selector := range []map[string]string{{"app": "web"}, {"app": "web"}, {"app": "web-v2"}} {
+		svc := &v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-svc"},
+			Spec:       v1.ServiceSpec{Selector: selector},
+		}
+		if err := store.Save(*New(svc, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	findings, _ := store.GetFindings("/SelectorChanged/")
+	if len(findings) != 1 || findings[0].Message != `selector changed from "app=web" to "app=web-v2"` {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
+
+func TestDeletedServiceResolvesFindings(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-svc"},
+		Spec:       v1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+	}
+	saveAll(t, store, svc, endpoints("10.0.0.1"))
+
+	// the Endpoints of a service are deleted first, which drops its addresses
+	if err := store.WriteDeletion(ctx, "endpoints", "default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); !reflect.DeepEqual(got, []string{"EndpointsDroppedToZero Service web"}) {
+		t.Fatalf("unexpected findings %v", got)
+	}
+	if err := store.WriteDeletion(ctx, "service", "default", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Errorf("expected the findings of the deleted service to be resolved, got %v", got)
+	}
+
+	// nor does a slice deleted after its service raise the finding again
+	saveAll(t, store, endpointSlice("web-a", true))
+	if err := store.WriteDeletion(ctx, "endpointslice", "default", "web-a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Errorf("expected no findings about the deleted service, got %v", got)
+	}
+}
+
+func policy(rules ...networkingv1.NetworkPolicyIngressRule) *networkingv1.NetworkPolicy {
+	return &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-np"},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress:     rules,
+		},
+	}
+}
+
+func fromFrontend(ports ...int) networkingv1.NetworkPolicyIngressRule {
+	rule := networkingv1.NetworkPolicyIngressRule{
+		From: []networkingv1.NetworkPolicyPeer{{
+			PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+		}},
+	}
+	for _, p := range ports {
+		port := intstr.FromInt(p)
+		rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Port: &port})
+	}
+	return rule
+}
+
+func TestPolicyBlocksTraffic(t *testing.T) {
+	store := newTestStore(t)
+	for _, p := range []*networkingv1.NetworkPolicy{
+		policy(fromFrontend(8080)),
+		// widening the policy blocks nothing
+		policy(fromFrontend(8080, 9090)),
+	} {
+		if err := store.Save(*New(p, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := findingTypes(t, store); len(got) != 0 {
+		t.Fatalf("unexpected findings %v", got)
+	}
+
+	if err := store.Save(*New(policy(fromFrontend(443)), "update")); err != nil {
+		t.Fatal(err)
+	}
+	findings, _ := store.GetFindings("/PolicyBlocksTraffic/")
+	want := `no longer allows ingress from pods "app=frontend" on TCP/8080, TCP/9090`
+	if len(findings) != 1 || findings[0].Message != want {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
+
+func TestBlockedTrafficOfNewDirection(t *testing.T) {
+	before := policy(fromFrontend(8080)).Spec
+	after := policy(fromFrontend(8080)).Spec
+	after.PolicyTypes = append(after.PolicyTypes, networkingv1.PolicyTypeEgress)
+
+	got := blockedTraffic(before, after)
+	if !reflect.DeepEqual(got, []string{"egress to anywhere on all ports"}) {
+		t.Errorf("unexpected blocked traffic %v", got)
+	}
+}
@@ -0,0 +1,212 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// ErrQueueFull is returned by Write when the write queue stays full for longer
+// than the enqueue timeout. Reconcilers should requeue the object.
+var ErrQueueFull = errors.New("write queue full")
+
+// PipelineOptions tune the write pipeline.
+type PipelineOptions struct {
+	// QueueSize is the number of writes waiting to be committed before Write
+	// blocks.
+	QueueSize int
+	// MaxBatch is the most writes committed in one LevelDB batch.
+	MaxBatch int
+	// EnqueueTimeout is how long Write waits for room in a full queue before
+	// failing with ErrQueueFull.
+	EnqueueTimeout time.Duration
+}
+
+var DefaultPipelineOptions = PipelineOptions{
+	QueueSize:      1024,
+	MaxBatch:       256,
+	EnqueueTimeout: 5 * time.Second,
+}
+
+var (
+	writeQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kube_drift_write_queue_depth",
+		Help: "Number of writes waiting in the store write pipeline.",
+	})
+	writeBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kube_drift_write_batch_size",
+		Help:    "Number of writes committed per store batch.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	writesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kube_drift_writes_total",
+		Help: "Writes submitted to the store write pipeline, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(writeQueueDepth, writeBatchSize, writesTotal)
+}
+
+type writeRequest struct {
+	drift KubeDrift
+	done  chan error
+}
+
+// EnablePipeline routes Write through a bounded queue committed in batches by
+// RunPipeline. Without it, Write saves synchronously.
+func (s *Store) EnablePipeline(opts PipelineOptions) {
+	s.pipelineOpts = opts
+	s.queue = make(chan writeRequest, opts.QueueSize)
+}
+
+// QueueDepth returns the number of writes waiting to be committed.
+func (s *Store) QueueDepth() int {
+	return len(s.queue)
+}
+
+// Write saves drift through the write pipeline and waits until it is committed,
+// returning the error of its batch. When the queue is full Write applies
+// backpressure by blocking for up to the enqueue timeout. Objects no policy
+// targets are not saved.
+func (s *Store) Write(ctx context.Context, drift KubeDrift) error {
+	if !s.Targeted(drift) {
+		return nil
+	}
+	if s.queue == nil {
+		return s.Save(drift)
+	}
+
+	req := writeRequest{drift: drift, done: make(chan error, 1)}
+	timer := time.NewTimer(s.pipelineOpts.EnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case s.queue <- req:
+		writeQueueDepth.Set(float64(len(s.queue)))
+	case <-timer.C:
+		writesTotal.WithLabelValues("rejected").Inc()
+		return ErrQueueFull
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EventTypeDeleted is the event type of a tombstone: the last record of an
+// object, written again once the object was deleted from the cluster.
+const EventTypeDeleted = "deleted"
+
+// WriteDeletion records that the objects of a kind with a namespace and name
+// were deleted, writing a tombstone of each of their records through Write.
+// Detectors treat a tombstoned object as gone: its history ends with the
+// tombstone, and it no longer counts towards the state of other objects.
+func (s *Store) WriteDeletion(ctx context.Context, kind, namespace, name string) error {
+	if namespace == "" {
+		namespace = "none"
+	}
+	records, err := s.GetDriftByKeyPrefix(fmt.Sprintf("/%s/%s/%s/", kind, namespace, name))
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if record.EventType == EventTypeDeleted {
+			continue
+		}
+		record.EventType = EventTypeDeleted
+		if err := s.Write(ctx, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunPipeline commits queued writes until ctx is done, then commits the writes
+// still queued before returning.
+func (s *Store) RunPipeline(ctx context.Context) error {
+	for {
+		select {
+		case req := <-s.queue:
+			s.commit(s.collect(req))
+		case <-ctx.Done():
+			for len(s.queue) > 0 {
+				s.commit(s.collect(<-s.queue))
+			}
+			return nil
+		}
+	}
+}
+
+// collect takes the writes already queued behind first, up to a batch.
+func (s *Store) collect(first writeRequest) []writeRequest {
+	reqs := []writeRequest{first}
+	for len(reqs) < s.pipelineOpts.MaxBatch {
+		select {
+		case req := <-s.queue:
+			reqs = append(reqs, req)
+		default:
+			writeQueueDepth.Set(float64(len(s.queue)))
+			return reqs
+		}
+	}
+	writeQueueDepth.Set(float64(len(s.queue)))
+	return reqs
+}
+
+// commit saves reqs in as few batches as possible. Each write is prepared
+// against the records queued before it in the batch, but a batch holds at
+// most one write per object, as versions are delta encoded and chained
+// against the stored history of their object.
+func (s *Store) commit(reqs []writeRequest) {
+	batch := newBatch(nil)
+	var pending []writeRequest
+	keys := map[string]bool{}
+
+	flush := func() {
+		var err error
+		if batch.Len() > 0 {
+			err = s.writeBatch(&batch.Batch)
+		}
+		if err != nil {
+			klog.Errorf("error committing %d writes: %v", len(pending), err)
+			writesTotal.WithLabelValues("error").Add(float64(len(pending)))
+		} else {
+			writesTotal.WithLabelValues("ok").Add(float64(len(pending)))
+		}
+		writeBatchSize.Observe(float64(len(pending)))
+		for _, req := range pending {
+			req.done <- err
+		}
+		batch.Reset()
+		pending = nil
+		keys = map[string]bool{}
+	}
+
+	for _, req := range reqs {
+		key := historyPrefix(req.drift.Type, req.drift.MetaData.Namespace, req.drift.MetaData.Name)
+		if keys[key] {
+			flush()
+		}
+		if err := s.prepare(batch, &req.drift); err != nil {
+			writesTotal.WithLabelValues("error").Inc()
+			req.done <- err
+			continue
+		}
+		keys[key] = true
+		pending = append(pending, req)
+	}
+	if len(pending) > 0 {
+		flush()
+	}
+}
@@ -0,0 +1,145 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startPipeline(t *testing.T, store *Store, opts PipelineOptions) {
+	t.Helper()
+	store.EnablePipeline(opts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.RunPipeline(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestPipelineCommitsConcurrentWrites(t *testing.T) {
+	store := newTestStore(t)
+	startPipeline(t, store, DefaultPipelineOptions)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		for _, restarts := range []int32{0, 1} {
+			wg.Add(1)
+			go func(i int, restarts int32) {
+				defer wg.Done()
+				pod := testPod(fmt.Sprintf("web-%d", i), "nginx:1.21", "docker-pullable://nginx@sha256:aaa")
+				pod.Status.ContainerStatuses[0].RestartCount = restarts
+				errs <- store.Write(context.Background(), *New(pod, "update"))
+			}(i, restarts)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		history, err := store.GetHistory("pod", "default", fmt.Sprintf("web-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// both writes of an object are kept, even when queued in the same batch
+		if len(history) != 2 {
+			t.Fatalf("web-%d: expected 2 versions, got %d", i, len(history))
+		}
+	}
+	if store.QueueDepth() != 0 {
+		t.Errorf("expected an empty queue, got %d", store.QueueDepth())
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	store := newTestStore(t)
+	// no RunPipeline, so queued writes are never committed
+	store.EnablePipeline(PipelineOptions{QueueSize: 1, MaxBatch: 1, EnqueueTimeout: 50 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		first <- store.Write(ctx, *New(testPod("web-1", "nginx:1.21", ""), "update"))
+	}()
+	for store.QueueDepth() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := store.Write(context.Background(), *New(testPod("web-2", "nginx:1.21", ""), "update")); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("write was rejected without waiting for room in the queue")
+	}
+
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected the waiting write to be cancelled, got %v", err)
+	}
+}
+
+func TestPipelineReportsWriteErrors(t *testing.T) {
+	store := newTestStore(t)
+	startPipeline(t, store, DefaultPipelineOptions)
+
+	store.db.Close()
+	if err := store.Write(context.Background(), *New(testPod("web-1", "nginx:1.21", ""), "update")); err == nil {
+		t.Error("expected the write to a closed store to fail")
+	}
+}
+
+func TestPipelineBatchesDetectorWrites(t *testing.T) {
+	store := newTestStore(t)
+	reqs := func() []writeRequest {
+		return []writeRequest{
+			{drift: *New(testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"), "update"), done: make(chan error, 1)},
+			{drift: *New(testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"), "update"), done: make(chan error, 1)},
+		}
+	}
+
+	// a batch prepared but never committed, as when its write fails, leaves
+	// no image records or findings behind to be applied again on retry
+	b := newBatch(nil)
+	for _, req := range reqs() {
+		if err := store.prepare(b, &req.drift); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records, _ := store.GetImageRecords("nginx:1.21"); len(records) != 0 {
+		t.Errorf("expected image records to be written only with their batch, got %+v", records)
+	}
+	if findings, _ := store.GetFindings("/"); len(findings) != 0 {
+		t.Errorf("expected findings to be written only with their batch, got %+v", findings)
+	}
+
+	// the second pod sees the image record of the first in the same batch
+	store.commit(reqs())
+	records, err := store.GetImageRecords("nginx:1.21")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 image records, got %+v", records)
+	}
+	findings, err := store.GetFindings("/WorkloadDigestMismatch/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Name != "web-5d4f" {
+		t.Errorf("expected a digest mismatch finding for web-5d4f, got %+v", findings)
+	}
+}
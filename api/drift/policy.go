@@ -0,0 +1,220 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// SeverityNone disables the findings a severity rule matches.
+const SeverityNone = "none"
+
+// Policy is a DriftPolicy or ClusterDriftPolicy as applied by the store: which
+// objects are recorded, which fields are ignored and which severity findings
+// are raised with.
+type Policy struct {
+	// Name is the name of the policy object.
+	Name string
+	// Namespace is the namespace of a DriftPolicy, which only applies to the
+	// objects in it, or "" for a ClusterDriftPolicy.
+	Namespace     string
+	Targets       []PolicyTarget
+	IgnoreRules   []IgnoreRule
+	SeverityRules []SeverityRule
+}
+
+// PolicyTarget selects objects by kind, namespace and labels. Empty fields
+// match every object.
+type PolicyTarget struct {
+	Kinds      []string
+	Namespaces []string
+	Selector   labels.Selector
+}
+
+// SeverityRule sets the severity of the findings of a type about objects of a
+// kind. An empty or "*" FindingType or Kind matches all.
+type SeverityRule struct {
+	FindingType string `json:"findingType"`
+	Kind        string `json:"kind"`
+	Severity    string `json:"severity"`
+}
+
+// recordedKinds are the types of the records of every kind kube-drift
+// can watch. Targets select among these; other kinds cannot be watched.
+var recordedKinds = map[string]bool{
+	"clusterrole": true, "clusterrolebinding": true, "configmap": true, "cronjob": true,
+	"daemonset": true, "deployment": true, "endpoints": true, "endpointslice": true,
+	"event": true, "horizontalpodautoscaler": true, "ingress": true, "job": true,
+	"limitrange": true, "namespace": true, "networkpolicy": true, "node": true,
+	"persistentvolume": true, "persistentvolumeclaim": true, "pod": true, "replicaset": true,
+	"resourcequota": true, "role": true, "rolebinding": true, "secret": true,
+	"service": true, "statefulset": true, "storageclass": true,
+}
+
+// Validate checks the kinds of the targets, the paths of the ignore rules and
+// the severities of p. A target of a kind that is not recorded would select
+// nothing, leaving everything else in scope of p unrecorded.
+func (p Policy) Validate() error {
+	var unknown []string
+	for _, target := range p.Targets {
+		for _, kind := range target.Kinds {
+			if !recordedKinds[strings.ToLower(kind)] {
+				unknown = append(unknown, kind)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown target kinds %s: kube-drift does not record them", strings.Join(unknown, ", "))
+	}
+	for _, rule := range p.IgnoreRules {
+		if _, err := parsePath(rule.Path); err != nil {
+			return fmt.Errorf("invalid ignore rule %q for kind %s: %v", rule.Path, rule.Kind, err)
+		}
+	}
+	for _, rule := range p.SeverityRules {
+		switch rule.Severity {
+		case SeverityInfo, SeverityWarning, SeverityCritical, SeverityNone:
+		default:
+			return fmt.Errorf("invalid severity %q", rule.Severity)
+		}
+	}
+	return nil
+}
+
+// SetPolicies replaces the policies applied by the store. They take effect on
+// the next write; the watchers of the kinds they target are reconfigured from
+// Watched.
+func (s *Store) SetPolicies(policies []Policy) {
+	sorted := append([]Policy(nil), policies...)
+	// the policies of a namespace come before the cluster policies
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if (sorted[i].Namespace == "") != (sorted[j].Namespace == "") {
+			return sorted[i].Namespace != ""
+		}
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	var ignore []IgnoreRule
+	for _, p := range sorted {
+		for _, rule := range p.IgnoreRules {
+			rule.Namespace = p.Namespace
+			ignore = append(ignore, rule)
+		}
+	}
+
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.policies = sorted
+	s.policyIgnore = ignore
+}
+
+// ignoreRules returns the rules applied when comparing and diffing records:
+// those set on the store followed by those of its policies.
+func (s *Store) ignoreRules() []IgnoreRule {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	return append(s.ignore[:len(s.ignore):len(s.ignore)], s.policyIgnore...)
+}
+
+// applies reports whether p applies to objects in namespace.
+func (p Policy) applies(namespace string) bool {
+	return p.Namespace == "" || p.Namespace == namespace
+}
+
+// Targeted reports whether drift is recorded: when it matches a target of any
+// policy applying to it, or when no policy applying to it has targets.
+func (s *Store) Targeted(drift KubeDrift) bool {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+
+	targeted := true
+	for _, p := range s.policies {
+		if !p.applies(drift.MetaData.Namespace) || len(p.Targets) == 0 {
+			continue
+		}
+		targeted = false
+		for _, target := range p.Targets {
+			if target.matches(p.Namespace, drift) {
+				return true
+			}
+		}
+	}
+	return targeted
+}
+
+// Watched reports whether objects of kind may be targeted by the policies, so
+// that kind needs to be watched. It need not be only when a cluster policy has
+// targets, leaving no object untargeted by default, and no target of any
+// policy selects kind.
+func (s *Store) Watched(kind string) bool {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+
+	restricted := false
+	for _, p := range s.policies {
+		if p.Namespace == "" && len(p.Targets) > 0 {
+			restricted = true
+		}
+		for _, target := range p.Targets {
+			if len(target.Kinds) == 0 || containsFold(target.Kinds, kind) {
+				return true
+			}
+		}
+	}
+	return !restricted
+}
+
+// matches reports whether drift matches t. The namespaces of a target of a
+// namespace policy are ignored.
+func (t PolicyTarget) matches(namespace string, drift KubeDrift) bool {
+	if len(t.Kinds) > 0 && !containsFold(t.Kinds, drift.Type) {
+		return false
+	}
+	if namespace == "" && len(t.Namespaces) > 0 && !contains(t.Namespaces, drift.MetaData.Namespace) {
+		return false
+	}
+	return t.Selector == nil || t.Selector.Matches(labels.Set(drift.MetaData.Labels))
+}
+
+// severity returns the severity f is raised with: that of the first severity
+// rule of a policy applying to it that matches, or its own.
+func (s *Store) severity(f Finding) string {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+
+	for _, p := range s.policies {
+		if !p.applies(f.Namespace) {
+			continue
+		}
+		for _, rule := range p.SeverityRules {
+			if (rule.FindingType == "" || rule.FindingType == "*" || rule.FindingType == f.Type) &&
+				(rule.Kind == "" || rule.Kind == "*" || strings.EqualFold(rule.Kind, f.Kind)) {
+				return rule.Severity
+			}
+		}
+	}
+	return f.Severity
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package provider
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func labelledConfigMap(namespace, name string, labels map[string]string, data string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, UID: types.UID(namespace + "-" + name), Labels: labels},
+		Data:       map[string]string{"key": data},
+	}
+}
+
+func TestPolicyTargets(t *testing.T) {
+	store := newTestStore(t)
+	store.SetPolicies([]Policy{
+		{Name: "workloads", Targets: []PolicyTarget{{Kinds: []string{"Deployment"}}}},
+		{Name: "shop", Namespace: "team-a", Targets: []PolicyTarget{{
+			Kinds:    []string{"configmap"},
+			Selector: labels.SelectorFromSet(labels.Set{"app": "shop"}),
+		}}},
+	})
+
+	for _, c := range []struct {
+		obj      interface{}
+		targeted bool
+	}{
+		{labelledConfigMap("team-a", "shop", map[string]string{"app": "shop"}, "a"), true},
+		{labelledConfigMap("team-a", "other", map[string]string{"app": "other"}, "a"), false},
+		{labelledConfigMap("team-b", "shop", map[string]string{"app": "shop"}, "a"), false},
+	} {
+		drift := *New(c.obj, "update")
+		if err := store.Write(context.Background(), drift); err != nil {
+			t.Fatal(err)
+		}
+		_, err := store.GetDriftByKey(drift.GetKey())
+		if recorded := err == nil; recorded != c.targeted {
+			t.Errorf("%s: expected recorded %v, got %v", drift.GetKey(), c.targeted, recorded)
+		}
+	}
+
+	store.SetPolicies(nil)
+	drift := *New(labelledConfigMap("team-b", "shop", nil, "a"), "update")
+	if !store.Targeted(drift) {
+		t.Errorf("expected every object to be targeted without policies")
+	}
+}
+
+func TestPolicyWatchedKinds(t *testing.T) {
+	store := newTestStore(t)
+	shop := Policy{Name: "shop", Namespace: "team-a", Targets: []PolicyTarget{{Kinds: []string{"ConfigMap"}}}}
+	store.SetPolicies([]Policy{shop})
+	// objects outside team-a are still recorded
+	if !store.Watched("secret") {
+		t.Errorf("expected every kind to be watched without a cluster policy with targets")
+	}
+
+	store.SetPolicies([]Policy{shop, {Name: "workloads", Targets: []PolicyTarget{{Kinds: []string{"Deployment"}}}}})
+	for kind, watched := range map[string]bool{"deployment": true, "configmap": true, "secret": false} {
+		if got := store.Watched(kind); got != watched {
+			t.Errorf("%s: expected watched %v, got %v", kind, watched, got)
+		}
+	}
+}
+
+func TestPolicyIgnoreRules(t *testing.T) {
+	store := newTestStore(t)
+	store.SetPolicies([]Policy{{
+		Name:        "data",
+		Namespace:   "team-a",
+		IgnoreRules: []IgnoreRule{{Kind: "configmap", Path: "$.data"}},
+	}})
+
+	for _, namespace := range []string{"team-a", "team-b"} {
+		saveAll(t, store, labelledConfigMap(namespace, "settings", nil, "a"), labelledConfigMap(namespace, "settings", nil, "b"))
+	}
+	if h, _ := store.GetHistory("configmap", "team-a", "settings"); len(h) != 1 {
+		t.Errorf("expected the ignored change in team-a to be deduplicated, got %d versions", len(h))
+	}
+	if h, _ := store.GetHistory("configmap", "team-b", "settings"); len(h) != 2 {
+		t.Errorf("expected the change in team-b to be recorded, got %d versions", len(h))
+	}
+}
+
+func TestPolicySeverityRules(t *testing.T) {
+	store := newTestStore(t)
+	store.SetPolicies([]Policy{
+		{Name: "defaults", SeverityRules: []SeverityRule{
+			{FindingType: "QuotaExhausted", Severity: SeverityWarning},
+			{FindingType: "NamespaceTerminating", Severity: SeverityNone},
+		}},
+		{Name: "strict", Namespace: "team-a", SeverityRules: []SeverityRule{
+			{Kind: "resourcequota", Severity: SeverityInfo},
+		}},
+	})
+
+	for _, f := range []Finding{
+		{Type: "QuotaExhausted", Severity: SeverityCritical, Kind: "ResourceQuota", Namespace: "team-a", Name: "compute"},
+		{Type: "QuotaExhausted", Severity: SeverityCritical, Kind: "ResourceQuota", Namespace: "team-b", Name: "compute"},
+		{Type: "NamespaceTerminating", Severity: SeverityWarning, Kind: "Namespace", Name: "team-c"},
+	} {
+		if err := store.SaveFinding(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	severities := map[string]string{}
+	findings, _ := store.GetFindings("/")
+	for _, f := range findings {
+		severities[f.Namespace+"/"+f.Type] = f.Severity
+	}
+	want := map[string]string{"team-a/QuotaExhausted": SeverityInfo, "team-b/QuotaExhausted": SeverityWarning}
+	if len(severities) != len(want) {
+		t.Errorf("unexpected findings %v", severities)
+	}
+	for key, severity := range want {
+		if severities[key] != severity {
+			t.Errorf("%s: expected severity %s, got %s", key, severity, severities[key])
+		}
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	if err := (Policy{IgnoreRules: []IgnoreRule{{Kind: "*", Path: "$.data["}}}).Validate(); err == nil {
+		t.Errorf("expected an invalid path to be rejected")
+	}
+	if err := (Policy{SeverityRules: []SeverityRule{{Severity: "fatal"}}}).Validate(); err == nil {
+		t.Errorf("expected an invalid severity to be rejected")
+	}
+	err := (Policy{Targets: []PolicyTarget{{Kinds: []string{"Deployment", "Deploymnet"}}}}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "Deploymnet") || strings.Contains(err.Error(), "Deployment,") {
+		t.Errorf("expected only the unknown kind to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,242 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+func (p *KubeDrift) newNamespace(eventType string, o *v1.Namespace) {
+	p.Type = "namespace"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newResourceQuota(eventType string, o *v1.ResourceQuota) {
+	p.Type = "resourcequota"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newLimitRange(eventType string, o *v1.LimitRange) {
+	p.Type = "limitrange"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.SetKey()
+}
+
+// checkNamespace raises a NamespaceTerminating finding when a namespace starts
+// terminating, naming the conditions holding up its deletion, until it is
+// deleted.
+func (s *Store) checkNamespace(b *batch, drift KubeDrift) error {
+	var status v1.NamespaceStatus
+	if err := convert(drift.Status, &status); err != nil {
+		return err
+	}
+	finding := Finding{
+		Type:     "NamespaceTerminating",
+		Severity: SeverityWarning,
+		Kind:     "Namespace",
+		Name:     drift.MetaData.Name,
+		UID:      drift.MetaData.UID,
+	}
+	if status.Phase != v1.NamespaceTerminating || drift.EventType == EventTypeDeleted {
+		return s.clearFinding(b, finding.GetKey())
+	}
+	finding.Message = "namespace is terminating"
+	if drift.MetaData.DeletionTimestamp != nil {
+		finding.Message += " since " + drift.MetaData.DeletionTimestamp.UTC().Format(time.RFC3339)
+	}
+	var blocking []string
+	for _, c := range status.Conditions {
+		if c.Status == v1.ConditionTrue {
+			blocking = append(blocking, fmt.Sprintf("%s: %s", c.Type, c.Message))
+		}
+	}
+	if len(blocking) > 0 {
+		finding.Message += "; " + strings.Join(blocking, "; ")
+	}
+	if f, err := s.getFinding(b, finding.GetKey()); err == nil && f.Message == finding.Message {
+		return nil
+	}
+	return s.saveFinding(b, finding)
+}
+
+// QuotaPoint is the usage of a ResourceQuota at the time it was observed,
+// with what changed since it was observed before.
+type QuotaPoint struct {
+	Time      time.Time         `json:"time"`
+	Quota     string            `json:"quota"`
+	Hard      map[string]string `json:"hard"`
+	Used      map[string]string `json:"used"`
+	Exhausted []string          `json:"exhausted,omitempty"`
+	Changes   []string          `json:"changes,omitempty"`
+}
+
+// GetQuotaUsage returns the usage of the quotas of a namespace observed within
+// [since, until), oldest first.
+func (s *Store) GetQuotaUsage(namespace string, since, until time.Time) ([]QuotaPoint, error) {
+	versions, err := s.getHistoryRange(fmt.Sprintf("/history/resourcequota/%s/", namespace), since, until)
+	if err != nil {
+		return nil, err
+	}
+
+	var points []QuotaPoint
+	last := map[string]KubeDrift{}
+	for _, version := range versions {
+		if version.EventType == EventTypeDeleted {
+			// a quota recreated later starts over
+			delete(last, version.MetaData.Name)
+			continue
+		}
+		var prev *KubeDrift
+		if p, ok := last[version.MetaData.Name]; ok {
+			prev = &p
+		}
+		last[version.MetaData.Name] = version
+
+		point, err := s.quotaPoint(prev, version)
+		if err != nil {
+			klog.Errorf("error reading quota usage of %s: %v", version.GetKey(), err)
+			continue
+		}
+		points = append(points, point)
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Time.Before(points[j].Time)
+	})
+	return points, nil
+}
+
+// quotaPoint returns the usage of a quota and what changed since prev: its
+// limits, its usage and the LimitRanges of its namespace, whose defaults
+// raise the requests of new pods.
+func (s *Store) quotaPoint(prev *KubeDrift, drift KubeDrift) (QuotaPoint, error) {
+	point := QuotaPoint{Time: drift.ObservedAt, Quota: drift.MetaData.Name}
+	var status, before v1.ResourceQuotaStatus
+	if err := convert(drift.Status, &status); err != nil {
+		return point, err
+	}
+	point.Hard, point.Used = quantities(status.Hard), quantities(status.Used)
+	point.Exhausted = exhausted(status)
+	if prev == nil {
+		return point, nil
+	}
+
+	if err := convert(prev.Status, &before); err != nil {
+		return point, err
+	}
+	point.Changes = append(quantityChanges("hard", before.Hard, status.Hard),
+		quantityChanges("used", before.Used, status.Used)...)
+
+	limitRanges, err := s.getHistoryRange(fmt.Sprintf("/history/limitrange/%s/", drift.MetaData.Namespace),
+		prev.ObservedAt, drift.ObservedAt)
+	if err != nil {
+		return point, err
+	}
+	for _, lr := range limitRanges {
+		point.Changes = append(point.Changes, fmt.Sprintf("limitrange %s changed at %s",
+			lr.MetaData.Name, lr.ObservedAt.Format(time.RFC3339)))
+	}
+	return point, nil
+}
+
+func quantities(list v1.ResourceList) map[string]string {
+	m := map[string]string{}
+	for name, q := range list {
+		m[string(name)] = q.String()
+	}
+	return m
+}
+
+// exhausted returns the resources of a quota whose usage reached their limit.
+func exhausted(status v1.ResourceQuotaStatus) []string {
+	var names []string
+	for name, hard := range status.Hard {
+		used, ok := status.Used[name]
+		if ok && !hard.IsZero() && used.Cmp(hard) >= 0 {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// quantityChanges describes the quantities that differ between two lists,
+// e.g. "used pods 9 -> 10".
+func quantityChanges(field string, before, after v1.ResourceList) []string {
+	names := map[v1.ResourceName]bool{}
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+
+	var changes []string
+	for name := range names {
+		b, inBefore := before[name]
+		a, inAfter := after[name]
+		switch {
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s %s set to %s", field, name, a.String()))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s %s removed", field, name))
+		case b.Cmp(a) != 0:
+			changes = append(changes, fmt.Sprintf("%s %s %s -> %s", field, name, b.String(), a.String()))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// checkQuota raises a QuotaExhausted finding when the usage of a quota reaches
+// one of its limits, describing what changed, until it is below them again or
+// deleted.
+func (s *Store) checkQuota(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	point, err := s.quotaPoint(prev, drift)
+	if err != nil {
+		return err
+	}
+	finding := Finding{
+		Type:      "QuotaExhausted",
+		Severity:  SeverityCritical,
+		Kind:      "ResourceQuota",
+		Namespace: drift.MetaData.Namespace,
+		Name:      drift.MetaData.Name,
+		UID:       drift.MetaData.UID,
+	}
+	if len(point.Exhausted) == 0 || drift.EventType == EventTypeDeleted {
+		return s.clearFinding(b, finding.GetKey())
+	}
+	if prev != nil {
+		var before v1.ResourceQuotaStatus
+		if err := convert(prev.Status, &before); err != nil {
+			return err
+		}
+		if strings.Join(exhausted(before), ",") == strings.Join(point.Exhausted, ",") {
+			return nil
+		}
+	}
+
+	var limits []string
+	for _, name := range point.Exhausted {
+		limits = append(limits, fmt.Sprintf("%s %s/%s", name, point.Used[name], point.Hard[name]))
+	}
+	finding.Message = "quota exhausted: " + strings.Join(limits, ", ")
+	if len(point.Changes) > 0 {
+		finding.Message += "; changed: " + strings.Join(point.Changes, ", ")
+	}
+	return s.saveFinding(b, finding)
+}
@@ -0,0 +1,139 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func teamQuota(hardPods, usedPods string) *v1.ResourceQuota {
+	hard := v1.ResourceList{v1.ResourcePods: resource.MustParse(hardPods)}
+	return &v1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: "team-a", UID: "uid-quota"},
+		Spec:       v1.ResourceQuotaSpec{Hard: hard},
+		Status: v1.ResourceQuotaStatus{
+			Hard: hard,
+			Used: v1.ResourceList{v1.ResourcePods: resource.MustParse(usedPods)},
+		},
+	}
+}
+
+func TestQuotaUsage(t *testing.T) {
+	store := newTestStore(t)
+	limits := &v1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{Name: "defaults", Namespace: "team-a", UID: "uid-limits"},
+		Spec: v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{{
+			Type:           v1.LimitTypeContainer,
+			DefaultRequest: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")},
+		}}},
+	}
+	saveAll(t, store, teamQuota("10", "8"), limits, teamQuota("10", "10"))
+
+	findings, _ := store.GetFindings("/QuotaExhausted/")
+	if len(findings) != 1 || findings[0].Message != "quota exhausted: pods 10/10; changed: used pods 8 -> 10, "+
+		"limitrange defaults changed at "+findingTime(t, store) {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+
+	saveAll(t, store, teamQuota("12", "10"))
+	if f, _ := store.GetFindings("/QuotaExhausted/"); len(f) != 0 {
+		t.Errorf("expected the finding to clear once the quota is raised, got %+v", f)
+	}
+
+	points, err := store.GetQuotaUsage("team-a", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exhausted [][]string
+	for _, p := range points {
+		exhausted = append(exhausted, p.Exhausted)
+	}
+	if !reflect.DeepEqual(exhausted, [][]string{nil, {"pods"}, nil}) {
+		t.Errorf("unexpected exhausted resources %q", exhausted)
+	}
+	if !reflect.DeepEqual(points[2].Changes, []string{"hard pods 10 -> 12"}) {
+		t.Errorf("unexpected changes %q", points[2].Changes)
+	}
+}
+
+func TestDeletedQuota(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store, teamQuota("10", "8"), teamQuota("10", "10"))
+	if f, _ := store.GetFindings("/QuotaExhausted/"); len(f) != 1 {
+		t.Fatalf("expected the quota to be exhausted, got %+v", f)
+	}
+
+	if err := store.WriteDeletion(context.Background(), "resourcequota", "team-a", "compute"); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := store.GetFindings("/QuotaExhausted/"); len(f) != 0 {
+		t.Errorf("expected the finding to clear once the quota was deleted, got %+v", f)
+	}
+	points, err := store.GetQuotaUsage("team-a", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 {
+		t.Errorf("expected the deletion not to be a usage point, got %+v", points)
+	}
+}
+
+// findingTime returns the observation time of the limit range as formatted in
+// finding messages.
+func findingTime(t *testing.T, store *Store) string {
+	t.Helper()
+	versions, err := store.GetHistory("limitrange", "team-a", "defaults")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("expected one version of the limit range, got %d: %v", len(versions), err)
+	}
+	return versions[0].ObservedAt.Format(time.RFC3339)
+}
+
+func TestNamespaceTerminating(t *testing.T) {
+	store := newTestStore(t)
+	deleted := metav1.NewTime(time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC))
+	namespace := &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "team-a", UID: "uid-ns"},
+		Status:     v1.NamespaceStatus{Phase: v1.NamespaceActive},
+	}
+	saveAll(t, store, namespace)
+
+	terminating := namespace.DeepCopy()
+	terminating.DeletionTimestamp = &deleted
+	terminating.Status = v1.NamespaceStatus{
+		Phase: v1.NamespaceTerminating,
+		Conditions: []v1.NamespaceCondition{{
+			Type:    v1.NamespaceFinalizersRemaining,
+			Status:  v1.ConditionTrue,
+			Message: "Some content in the namespace has finalizers remaining: kubernetes.io/pvc-protection in 1 resource instances",
+		}},
+	}
+	saveAll(t, store, terminating)
+
+	findings, _ := store.GetFindings("/NamespaceTerminating/")
+	want := "namespace is terminating since 2021-10-01T12:00:00Z; NamespaceFinalizersRemaining: " +
+		"Some content in the namespace has finalizers remaining: kubernetes.io/pvc-protection in 1 resource instances"
+	if len(findings) != 1 || findings[0].Message != want {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+
+	// the end of the namespace is recorded and resolves the finding
+	if err := store.WriteDeletion(context.Background(), "namespace", "", "team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if findings, _ := store.GetFindings("/NamespaceTerminating/"); len(findings) != 0 {
+		t.Errorf("expected the finding to clear once the namespace was deleted, got %+v", findings)
+	}
+	history, err := store.GetHistory("namespace", "none", "team-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[2].EventType != EventTypeDeleted {
+		t.Errorf("expected the history of the namespace to end with its deletion, got %+v", history)
+	}
+}
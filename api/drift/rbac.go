@@ -0,0 +1,553 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb/util"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/klog/v2"
+)
+
+// RoleSpec is the recorded content of a Role or ClusterRole, which have no
+// spec of their own.
+type RoleSpec struct {
+	Rules           []rbacv1.PolicyRule     `json:"rules"`
+	AggregationRule *rbacv1.AggregationRule `json:"aggregationRule,omitempty"`
+}
+
+// RoleBindingSpec is the recorded content of a RoleBinding or
+// ClusterRoleBinding.
+type RoleBindingSpec struct {
+	Subjects []rbacv1.Subject `json:"subjects,omitempty"`
+	RoleRef  rbacv1.RoleRef   `json:"roleRef"`
+}
+
+func (p *KubeDrift) newRole(eventType string, o *rbacv1.Role) {
+	p.Type = "role"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = RoleSpec{Rules: o.Rules}
+	p.SetKey()
+}
+
+// newClusterRole records the rules of a ClusterRole, which for an aggregated
+// role include those the controller aggregated into it.
+func (p *KubeDrift) newClusterRole(eventType string, o *rbacv1.ClusterRole) {
+	p.Type = "clusterrole"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = RoleSpec{Rules: o.Rules, AggregationRule: o.AggregationRule}
+	p.SetKey()
+}
+
+func (p *KubeDrift) newRoleBinding(eventType string, o *rbacv1.RoleBinding) {
+	p.Type = "rolebinding"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = RoleBindingSpec{Subjects: o.Subjects, RoleRef: o.RoleRef}
+	p.SetKey()
+}
+
+func (p *KubeDrift) newClusterRoleBinding(eventType string, o *rbacv1.ClusterRoleBinding) {
+	p.Type = "clusterrolebinding"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = RoleBindingSpec{Subjects: o.Subjects, RoleRef: o.RoleRef}
+	p.SetKey()
+}
+
+// rbacKinds maps the recorded RBAC types to their kinds.
+var rbacKinds = map[string]string{
+	"role":               "Role",
+	"clusterrole":        "ClusterRole",
+	"rolebinding":        "RoleBinding",
+	"clusterrolebinding": "ClusterRoleBinding",
+}
+
+// Permission is a verb a subject may use on a resource, or a non-resource URL,
+// within a namespace, or within every namespace when Namespace is "*". Values
+// are taken literally from rules, so a "*" is a wildcard permission of its
+// own rather than expanded.
+type Permission struct {
+	Namespace      string `json:"namespace,omitempty"`
+	APIGroup       string `json:"apiGroup,omitempty"`
+	Resource       string `json:"resource,omitempty"`
+	ResourceName   string `json:"resourceName,omitempty"`
+	NonResourceURL string `json:"nonResourceURL,omitempty"`
+	Verb           string `json:"verb"`
+}
+
+func (p Permission) String() string {
+	if p.NonResourceURL != "" {
+		return fmt.Sprintf("%s %s", p.Verb, p.NonResourceURL)
+	}
+	resource := p.Resource
+	if p.APIGroup != "" {
+		resource = p.APIGroup + "/" + resource
+	}
+	if p.ResourceName != "" {
+		resource += "/" + p.ResourceName
+	}
+	if p.Namespace == "*" {
+		return fmt.Sprintf("%s %s cluster-wide", p.Verb, resource)
+	}
+	return fmt.Sprintf("%s %s in %s", p.Verb, resource, p.Namespace)
+}
+
+// sensitive reports whether a permission allows reading secrets, escalating
+// privileges or acting on anything.
+func (p Permission) sensitive() bool {
+	switch p.Verb {
+	case "*", "escalate", "bind", "impersonate":
+		return true
+	}
+	return p.Resource == "*" || p.Resource == "secrets" || p.NonResourceURL == "*"
+}
+
+// SubjectPermissions are the permissions a subject gained and lost.
+type SubjectPermissions struct {
+	Subject string       `json:"subject"`
+	Gained  []Permission `json:"gained,omitempty"`
+	Lost    []Permission `json:"lost,omitempty"`
+}
+
+// PermissionChange records how a change of a role or binding changed the
+// effective permissions of the subjects it applies to.
+type PermissionChange struct {
+	Kind      string               `json:"kind"`
+	Namespace string               `json:"namespace"`
+	Name      string               `json:"name"`
+	Subjects  []SubjectPermissions `json:"subjects"`
+	ChangedAt time.Time            `json:"changedAt"`
+}
+
+func (c *PermissionChange) GetKey() string {
+	return fmt.Sprintf("%s%019d/%s/%s/%s", permissionChangePrefix, c.ChangedAt.UnixNano(), c.Kind, c.Namespace, c.Name)
+}
+
+const permissionChangePrefix = "/permissionchange/"
+
+// subjectName names a subject, e.g. User:alice or ServiceAccount:ci/deployer.
+// Service accounts without a namespace are in that of the binding.
+func subjectName(subject rbacv1.Subject, namespace string) string {
+	if subject.Kind == rbacv1.ServiceAccountKind {
+		if subject.Namespace != "" {
+			namespace = subject.Namespace
+		}
+		return fmt.Sprintf("%s:%s/%s", subject.Kind, namespace, subject.Name)
+	}
+	return fmt.Sprintf("%s:%s", subject.Kind, subject.Name)
+}
+
+// rbacState is the latest record of every role and binding, keyed by type,
+// namespace and name.
+type rbacState map[string]KubeDrift
+
+func rbacStateKey(drift KubeDrift) string {
+	return fmt.Sprintf("%s/%s/%s", drift.Type, drift.MetaData.Namespace, drift.MetaData.Name)
+}
+
+// rbacState reads the latest record of every live role and binding of the
+// store. An object recreated with a new UID is represented by its latest
+// record, and one whose latest record is a tombstone is left out.
+func (s *Store) rbacState(b *batch) (rbacState, error) {
+	state := rbacState{}
+	for t := range rbacKinds {
+		records, err := s.getDriftByKeyPrefix(b, "/"+t+"/")
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			key := rbacStateKey(record)
+			if cur, ok := state[key]; !ok || cur.ObservedAt.Before(record.ObservedAt) {
+				state[key] = record
+			}
+		}
+	}
+	for key, record := range state {
+		if record.EventType == EventTypeDeleted {
+			delete(state, key)
+		}
+	}
+	return state, nil
+}
+
+// initialSync reports whether an object first seen was listed by the initial
+// sync of the watches: created before the store was opened. Creation times
+// are kept to the second.
+func (s *Store) initialSync(drift KubeDrift) bool {
+	return drift.MetaData.CreationTimestamp.Time.Before(s.openedAt.Truncate(time.Second))
+}
+
+// without returns state without the role or binding of drift.
+func (state rbacState) without(drift KubeDrift) rbacState {
+	updated := rbacState{}
+	for k, v := range state {
+		updated[k] = v
+	}
+	delete(updated, rbacStateKey(drift))
+	return updated
+}
+
+// with returns state updated with drift, without it when drift is a tombstone.
+func (state rbacState) with(drift KubeDrift) rbacState {
+	updated := state.without(drift)
+	if drift.EventType != EventTypeDeleted {
+		updated[rbacStateKey(drift)] = drift
+	}
+	return updated
+}
+
+// bindings returns the RoleBindings and ClusterRoleBindings of state.
+func (state rbacState) bindings() []KubeDrift {
+	var bindings []KubeDrift
+	for _, record := range state {
+		if record.Type == "rolebinding" || record.Type == "clusterrolebinding" {
+			bindings = append(bindings, record)
+		}
+	}
+	return bindings
+}
+
+// roleRef returns the state key of the role a binding refers to.
+func roleRef(binding KubeDrift, spec RoleBindingSpec) string {
+	if spec.RoleRef.Kind == "Role" {
+		return fmt.Sprintf("role/%s/%s", binding.MetaData.Namespace, spec.RoleRef.Name)
+	}
+	return fmt.Sprintf("clusterrole/none/%s", spec.RoleRef.Name)
+}
+
+// permissions returns the effective permissions of subjects in state, each
+// the union of the rules of every role bound to the subject.
+func (state rbacState) permissions(subjects map[string]bool) (map[string]map[Permission]bool, error) {
+	effective := map[string]map[Permission]bool{}
+	for subject := range subjects {
+		effective[subject] = map[Permission]bool{}
+	}
+
+	for _, binding := range state.bindings() {
+		spec := RoleBindingSpec{}
+		if err := convert(binding.Spec, &spec); err != nil {
+			return nil, err
+		}
+		var bound []string
+		for _, subject := range spec.Subjects {
+			if name := subjectName(subject, binding.MetaData.Namespace); subjects[name] {
+				bound = append(bound, name)
+			}
+		}
+		role, ok := state[roleRef(binding, spec)]
+		if len(bound) == 0 || !ok {
+			continue
+		}
+		roleSpec := RoleSpec{}
+		if err := convert(role.Spec, &roleSpec); err != nil {
+			return nil, err
+		}
+
+		namespace := "*"
+		if binding.Type == "rolebinding" {
+			namespace = binding.MetaData.Namespace
+		}
+		for _, permission := range expandRules(roleSpec.Rules, namespace) {
+			for _, subject := range bound {
+				effective[subject][permission] = true
+			}
+		}
+	}
+	return effective, nil
+}
+
+// expandRules expands policy rules into the permissions they grant within a
+// namespace.
+func expandRules(rules []rbacv1.PolicyRule, namespace string) []Permission {
+	var permissions []Permission
+	for _, rule := range rules {
+		for _, verb := range rule.Verbs {
+			for _, url := range rule.NonResourceURLs {
+				permissions = append(permissions, Permission{Namespace: "*", NonResourceURL: url, Verb: verb})
+			}
+			names := rule.ResourceNames
+			if len(names) == 0 {
+				names = []string{""}
+			}
+			for _, group := range rule.APIGroups {
+				for _, resource := range rule.Resources {
+					for _, name := range names {
+						permissions = append(permissions, Permission{
+							Namespace:    namespace,
+							APIGroup:     group,
+							Resource:     resource,
+							ResourceName: name,
+							Verb:         verb,
+						})
+					}
+				}
+			}
+		}
+	}
+	return permissions
+}
+
+// affectedSubjects returns the subjects whose permissions a change of drift
+// may change: those of a binding, or those bound to a role.
+func (state rbacState) affectedSubjects(drift KubeDrift) (map[string]bool, error) {
+	subjects := map[string]bool{}
+	key := rbacStateKey(drift)
+	for _, binding := range state.bindings() {
+		spec := RoleBindingSpec{}
+		if err := convert(binding.Spec, &spec); err != nil {
+			return nil, err
+		}
+		if rbacStateKey(binding) != key && roleRef(binding, spec) != key {
+			continue
+		}
+		for _, subject := range spec.Subjects {
+			subjects[subjectName(subject, binding.MetaData.Namespace)] = true
+		}
+	}
+	return subjects, nil
+}
+
+// trackPermissions records a PermissionChange when a change or deletion of a
+// role or binding changed the effective permissions of a subject, and raises
+// a PermissionsGained finding when one gained any.
+func (s *Store) trackPermissions(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if prev == nil && s.initialSync(drift) {
+		// existing roles and bindings are first seen when kube-drift starts,
+		// without anything about them having changed
+		return nil
+	}
+	before, err := s.rbacState(b)
+	if err != nil {
+		return err
+	}
+	if prev != nil {
+		before = before.with(*prev)
+	} else {
+		// a role or binding created, or recreated with a new UID, since
+		// kube-drift started did not exist before
+		before = before.without(drift)
+	}
+	after := before.with(drift)
+
+	subjects, err := before.affectedSubjects(drift)
+	if err != nil {
+		return err
+	}
+	afterSubjects, err := after.affectedSubjects(drift)
+	if err != nil {
+		return err
+	}
+	for subject := range afterSubjects {
+		subjects[subject] = true
+	}
+	if len(subjects) == 0 {
+		return nil
+	}
+
+	beforePermissions, err := before.permissions(subjects)
+	if err != nil {
+		return err
+	}
+	afterPermissions, err := after.permissions(subjects)
+	if err != nil {
+		return err
+	}
+
+	change := PermissionChange{
+		Kind:      rbacKinds[drift.Type],
+		Namespace: drift.MetaData.Namespace,
+		Name:      drift.MetaData.Name,
+		ChangedAt: time.Now().UTC(),
+	}
+	for subject := range subjects {
+		diff := SubjectPermissions{
+			Subject: subject,
+			Gained:  missing(afterPermissions[subject], beforePermissions[subject]),
+			Lost:    missing(beforePermissions[subject], afterPermissions[subject]),
+		}
+		if len(diff.Gained) > 0 || len(diff.Lost) > 0 {
+			change.Subjects = append(change.Subjects, diff)
+		}
+	}
+	if len(change.Subjects) == 0 {
+		return nil
+	}
+	sort.Slice(change.Subjects, func(i, j int) bool {
+		return change.Subjects[i].Subject < change.Subjects[j].Subject
+	})
+
+	data, err := s.encode(change)
+	if err != nil {
+		return err
+	}
+	if err := s.set(b, change.GetKey(), data); err != nil {
+		return err
+	}
+	klog.Infof("permission change %s: %d subjects", change.GetKey(), len(change.Subjects))
+	return s.reportGainedPermissions(b, drift, change)
+}
+
+// missing returns the permissions of a not in b, sorted.
+func missing(a, b map[Permission]bool) []Permission {
+	var permissions []Permission
+	for p := range a {
+		if !b[p] {
+			permissions = append(permissions, p)
+		}
+	}
+	sortPermissions(permissions)
+	return permissions
+}
+
+func sortPermissions(permissions []Permission) {
+	sort.Slice(permissions, func(i, j int) bool {
+		return permissions[i].String() < permissions[j].String()
+	})
+}
+
+func (s *Store) reportGainedPermissions(b *batch, drift KubeDrift, change PermissionChange) error {
+	finding := Finding{
+		Type:      "PermissionsGained",
+		Severity:  SeverityWarning,
+		Kind:      change.Kind,
+		Namespace: change.Namespace,
+		Name:      change.Name,
+		UID:       drift.MetaData.UID,
+	}
+	var gained []string
+	for _, subject := range change.Subjects {
+		if len(subject.Gained) == 0 {
+			continue
+		}
+		var permissions []string
+		for _, p := range subject.Gained {
+			permissions = append(permissions, p.String())
+			if p.sensitive() {
+				finding.Severity = SeverityCritical
+			}
+		}
+		gained = append(gained, fmt.Sprintf("%s gained %s", subject.Subject, strings.Join(permissions, ", ")))
+	}
+	if len(gained) == 0 {
+		return nil
+	}
+	finding.Message = strings.Join(gained, "; ")
+	return s.saveFinding(b, finding)
+}
+
+// GetPermissionChanges returns the permission changes made within
+// [since, until), oldest first, optionally only those of a subject.
+func (s *Store) GetPermissionChanges(subject string, since, until time.Time) ([]PermissionChange, error) {
+	var changes []PermissionChange
+
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(permissionChangePrefix)), nil)
+	for iter.Next() {
+		change := PermissionChange{}
+		if err := s.unmarshal(iter.Value(), &change); err != nil {
+			klog.Errorf("error decoding permission change %s: %v", iter.Key(), err)
+			continue
+		}
+		if !inRange(change.ChangedAt, since, until) {
+			continue
+		}
+		if subject != "" {
+			var subjects []SubjectPermissions
+			for _, sp := range change.Subjects {
+				if sp.Subject == subject {
+					subjects = append(subjects, sp)
+				}
+			}
+			if len(subjects) == 0 {
+				continue
+			}
+			change.Subjects = subjects
+		}
+		changes = append(changes, change)
+	}
+	iter.Release()
+
+	return changes, iter.Error()
+}
+
+// PermissionReport summarizes the net permissions each subject gained and lost
+// within a time range: a permission gained and lost again is left out.
+type PermissionReport struct {
+	Since    time.Time            `json:"since,omitempty"`
+	Until    time.Time            `json:"until,omitempty"`
+	Changes  int                  `json:"changes"`
+	Subjects []SubjectPermissions `json:"subjects"`
+}
+
+// GetPermissionReport returns the report of the permission changes made within
+// [since, until).
+func (s *Store) GetPermissionReport(since, until time.Time) (PermissionReport, error) {
+	report := PermissionReport{Since: since, Until: until}
+	changes, err := s.GetPermissionChanges("", since, until)
+	if err != nil {
+		return report, err
+	}
+	report.Changes = len(changes)
+
+	// net is true for a permission gained and false for one lost
+	net := map[string]map[Permission]bool{}
+	for _, change := range changes {
+		for _, sp := range change.Subjects {
+			if net[sp.Subject] == nil {
+				net[sp.Subject] = map[Permission]bool{}
+			}
+			for _, p := range sp.Gained {
+				if gained, ok := net[sp.Subject][p]; ok && !gained {
+					delete(net[sp.Subject], p)
+				} else {
+					net[sp.Subject][p] = true
+				}
+			}
+			for _, p := range sp.Lost {
+				if gained, ok := net[sp.Subject][p]; ok && gained {
+					delete(net[sp.Subject], p)
+				} else {
+					net[sp.Subject][p] = false
+				}
+			}
+		}
+	}
+
+	for subject, permissions := range net {
+		sp := SubjectPermissions{Subject: subject}
+		for p, gained := range permissions {
+			if gained {
+				sp.Gained = append(sp.Gained, p)
+			} else {
+				sp.Lost = append(sp.Lost, p)
+			}
+		}
+		if len(sp.Gained) == 0 && len(sp.Lost) == 0 {
+			continue
+		}
+		sortPermissions(sp.Gained)
+		sortPermissions(sp.Lost)
+		report.Subjects = append(report.Subjects, sp)
+	}
+	sort.Slice(report.Subjects, func(i, j int) bool {
+		return report.Subjects[i].Subject < report.Subjects[j].Subject
+	})
+	return report, nil
+}
+
+// GetPermissions returns the current effective permissions of a subject.
+func (s *Store) GetPermissions(subject string) ([]Permission, error) {
+	state, err := s.rbacState(nil)
+	if err != nil {
+		return nil, err
+	}
+	effective, err := state.permissions(map[string]bool{subject: true})
+	if err != nil {
+		return nil, err
+	}
+	return missing(effective[subject], nil), nil
+}
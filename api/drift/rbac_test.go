@@ -0,0 +1,169 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func deployerRole(verbs ...string) *rbacv1.Role {
+	return &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "deployer", Namespace: "ci", UID: "uid-role", CreationTimestamp: metav1.Now()},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{"apps"},
+			Resources: []string{"deployments"},
+			Verbs:     verbs,
+		}},
+	}
+}
+
+func deployerBinding(subjects ...rbacv1.Subject) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "deployer", Namespace: "ci", UID: "uid-binding", CreationTimestamp: metav1.Now()},
+		Subjects:   subjects,
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: "deployer"},
+	}
+}
+
+func permissionStrings(permissions []Permission) []string {
+	var s []string
+	for _, p := range permissions {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+func TestPermissionChanges(t *testing.T) {
+	store := newTestStore(t)
+	ci := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci"}
+	alice := rbacv1.Subject{Kind: rbacv1.UserKind, Name: "alice"}
+
+	saveAll(t, store, deployerRole("get"), deployerBinding(ci))
+	saveAll(t, store, deployerRole("get", "update"))
+	saveAll(t, store, deployerBinding(alice))
+
+	changes, err := store.GetPermissionChanges("", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 permission changes, got %+v", changes)
+	}
+	updated := changes[1]
+	if updated.Kind != "Role" || len(updated.Subjects) != 1 || updated.Subjects[0].Subject != "ServiceAccount:ci/ci" ||
+		!reflect.DeepEqual(permissionStrings(updated.Subjects[0].Gained), []string{"update apps/deployments in ci"}) {
+		t.Errorf("unexpected change of the role %+v", updated)
+	}
+	rebound := changes[2]
+	if len(rebound.Subjects) != 2 || rebound.Subjects[0].Subject != "ServiceAccount:ci/ci" ||
+		len(rebound.Subjects[0].Lost) != 2 || len(rebound.Subjects[1].Gained) != 2 {
+		t.Errorf("unexpected change of the binding %+v", rebound)
+	}
+
+	aliceChanges, _ := store.GetPermissionChanges("User:alice", time.Time{}, time.Time{})
+	if len(aliceChanges) != 1 {
+		t.Errorf("expected one change for alice, got %+v", aliceChanges)
+	}
+
+	// ci gained and lost get, so only alice appears in the report
+	report, err := store.GetPermissionReport(time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Changes != 3 || len(report.Subjects) != 1 || report.Subjects[0].Subject != "User:alice" {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	current, err := store.GetPermissions("User:alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"get apps/deployments in ci", "update apps/deployments in ci"}
+	if !reflect.DeepEqual(permissionStrings(current), want) {
+		t.Errorf("unexpected permissions %q", permissionStrings(current))
+	}
+}
+
+func TestClusterRoleEscalation(t *testing.T) {
+	store := newTestStore(t)
+	view := func(resources ...string) *rbacv1.ClusterRole {
+		return &rbacv1.ClusterRole{
+			ObjectMeta: metav1.ObjectMeta{Name: "view", UID: "uid-view", CreationTimestamp: metav1.Now()},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: resources, Verbs: []string{"get"}}},
+		}
+	}
+	binding := &rbacv1.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "viewers", UID: "uid-viewers", CreationTimestamp: metav1.Now()},
+		Subjects:   []rbacv1.Subject{{Kind: rbacv1.GroupKind, Name: "viewers"}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: "view"},
+	}
+	saveAll(t, store, view("pods"), binding)
+
+	findings, _ := store.GetFindings("/PermissionsGained/ClusterRoleBinding/")
+	if len(findings) != 1 || findings[0].Severity != SeverityWarning ||
+		findings[0].Message != "Group:viewers gained get pods cluster-wide" {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+
+	saveAll(t, store, view("pods", "secrets"))
+	findings, _ = store.GetFindings("/PermissionsGained/ClusterRole/")
+	if len(findings) != 1 || findings[0].Severity != SeverityCritical ||
+		findings[0].Message != "Group:viewers gained get secrets cluster-wide" {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
+
+func TestDeletedBindingLosesPermissions(t *testing.T) {
+	store := newTestStore(t)
+	ci := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci"}
+	saveAll(t, store, deployerRole("get"), deployerBinding(ci))
+
+	if err := store.WriteDeletion(context.Background(), "rolebinding", "ci", "deployer"); err != nil {
+		t.Fatal(err)
+	}
+	current, err := store.GetPermissions("ServiceAccount:ci/ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(current) != 0 {
+		t.Errorf("expected no permissions once the binding was deleted, got %q", permissionStrings(current))
+	}
+
+	changes, err := store.GetPermissionChanges("ServiceAccount:ci/ci", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes[1].Kind != "RoleBinding" ||
+		!reflect.DeepEqual(permissionStrings(changes[1].Subjects[0].Lost), []string{"get apps/deployments in ci"}) {
+		t.Errorf("expected the deletion to be recorded as a loss, got %+v", changes)
+	}
+}
+
+func TestInitialSyncNotGained(t *testing.T) {
+	store := newTestStore(t)
+	ci := rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "ci"}
+	existing := deployerBinding(ci)
+	existing.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	saveAll(t, store, deployerRole("get"), existing)
+
+	// the roles and bindings listed when kube-drift starts have not changed
+	if changes, _ := store.GetPermissionChanges("", time.Time{}, time.Time{}); len(changes) != 0 {
+		t.Errorf("expected no changes for the initial sync, got %+v", changes)
+	}
+
+	// but one deleted and recreated since is granted anew
+	if err := store.WriteDeletion(context.Background(), "rolebinding", "ci", "deployer"); err != nil {
+		t.Fatal(err)
+	}
+	recreated := deployerBinding(ci)
+	recreated.UID = "uid-binding-2"
+	saveAll(t, store, recreated)
+	findings, _ := store.GetFindings("/PermissionsGained/RoleBinding/")
+	if len(findings) != 1 || findings[0].Message != "ServiceAccount:ci/ci gained get apps/deployments in ci" {
+		t.Errorf("expected the recreated binding to be reported, got %+v", findings)
+	}
+}
@@ -0,0 +1,319 @@
+package provider
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// marshalRecordProto encodes p as a Record of record.proto.
+func marshalRecordProto(p KubeDrift) ([]byte, error) {
+	var b []byte
+	b = appendStringField(b, 1, p.Type)
+	b = appendStringField(b, 2, p.EventType)
+	meta, err := marshalObjectMetaProto(p.MetaData)
+	if err != nil {
+		return nil, err
+	}
+	b = appendMessageField(b, 3, meta)
+	for i, v := range []interface{}{p.Spec, p.Status, p.Event} {
+		if v == nil {
+			continue
+		}
+		doc, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessageField(b, protowire.Number(4+i), doc)
+	}
+	for _, image := range p.Images {
+		var m []byte
+		m = appendStringField(m, 1, image.Container)
+		m = appendStringField(m, 2, image.Image)
+		m = appendStringField(m, 3, image.ImageID)
+		m = appendStringField(m, 4, image.Digest)
+		b = appendMessageField(b, 7, m)
+	}
+	for _, ref := range p.ConfigRefs {
+		var m []byte
+		m = appendStringField(m, 1, ref.Kind)
+		m = appendStringField(m, 2, ref.Name)
+		b = appendMessageField(b, 8, m)
+	}
+	for _, claim := range p.Claims {
+		b = protowire.AppendTag(b, 9, protowire.BytesType)
+		b = protowire.AppendString(b, claim)
+	}
+	b = appendStringField(b, 10, p.ReplicasManager)
+	b = appendMapField(b, 11, p.Data)
+	b = appendStringField(b, 12, p.NodeName)
+	b = appendTimeField(b, 13, p.ObservedAt)
+	b = appendTimeField(b, 14, p.LastSeen)
+	b = appendVarintField(b, 15, uint64(p.SeenCount))
+	b = appendStringField(b, 16, p.ContentHash)
+	return b, nil
+}
+
+func marshalObjectMetaProto(m ObjectMeta) ([]byte, error) {
+	var b []byte
+	b = appendStringField(b, 1, m.Name)
+	b = appendStringField(b, 2, m.GenerateName)
+	b = appendStringField(b, 3, m.Namespace)
+	b = appendStringField(b, 5, string(m.UID))
+	b = appendStringField(b, 6, m.ResourceVersion)
+	b = appendVarintField(b, 7, uint64(m.Generation))
+	b = appendTimeField(b, 8, m.CreationTimestamp.Time)
+	if m.DeletionTimestamp != nil {
+		b = appendTimeField(b, 9, m.DeletionTimestamp.Time)
+	}
+	if m.DeletionGracePeriodSeconds != nil {
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*m.DeletionGracePeriodSeconds))
+	}
+	b = appendMapField(b, 11, m.Labels)
+	b = appendMapField(b, 12, m.Annotations)
+	for i := range m.OwnerReferences {
+		ref, err := m.OwnerReferences[i].Marshal()
+		if err != nil {
+			return nil, err
+		}
+		b = appendMessageField(b, 13, ref)
+	}
+	for _, f := range m.Finalizers {
+		b = protowire.AppendTag(b, 14, protowire.BytesType)
+		b = protowire.AppendString(b, f)
+	}
+	b = appendStringField(b, 15, m.ClusterName)
+	return b, nil
+}
+
+// unmarshalRecordProto decodes a Record of record.proto.
+func unmarshalRecordProto(data []byte) (KubeDrift, error) {
+	p := KubeDrift{}
+	err := walkFields(data, func(num protowire.Number, v []byte, x uint64) error {
+		var err error
+		switch num {
+		case 1:
+			p.Type = string(v)
+		case 2:
+			p.EventType = string(v)
+		case 3:
+			p.MetaData, err = unmarshalObjectMetaProto(v)
+		case 4:
+			err = json.Unmarshal(v, &p.Spec)
+		case 5:
+			err = json.Unmarshal(v, &p.Status)
+		case 6:
+			err = json.Unmarshal(v, &p.Event)
+		case 7:
+			image := ContainerImage{}
+			err = walkFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					image.Container = string(v)
+				case 2:
+					image.Image = string(v)
+				case 3:
+					image.ImageID = string(v)
+				case 4:
+					image.Digest = string(v)
+				}
+				return nil
+			})
+			p.Images = append(p.Images, image)
+		case 8:
+			ref := ConfigRef{}
+			err = walkFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				switch num {
+				case 1:
+					ref.Kind = string(v)
+				case 2:
+					ref.Name = string(v)
+				}
+				return nil
+			})
+			p.ConfigRefs = append(p.ConfigRefs, ref)
+		case 9:
+			p.Claims = append(p.Claims, string(v))
+		case 10:
+			p.ReplicasManager = string(v)
+		case 11:
+			p.Data, err = addMapEntry(p.Data, v)
+		case 12:
+			p.NodeName = string(v)
+		case 13:
+			p.ObservedAt, err = unmarshalTime(v)
+		case 14:
+			p.LastSeen, err = unmarshalTime(v)
+		case 15:
+			p.SeenCount = int(x)
+		case 16:
+			p.ContentHash = string(v)
+		}
+		return err
+	})
+	return p, err
+}
+
+func unmarshalObjectMetaProto(data []byte) (ObjectMeta, error) {
+	m := ObjectMeta{}
+	err := walkFields(data, func(num protowire.Number, v []byte, x uint64) error {
+		var err error
+		switch num {
+		case 1:
+			m.Name = string(v)
+		case 2:
+			m.GenerateName = string(v)
+		case 3:
+			m.Namespace = string(v)
+		case 5:
+			m.UID = types.UID(v)
+		case 6:
+			m.ResourceVersion = string(v)
+		case 7:
+			m.Generation = int64(x)
+		case 8:
+			var t time.Time
+			t, err = unmarshalTime(v)
+			// API times are read in the local zone, as by the API machinery
+			m.CreationTimestamp = metav1.NewTime(t.Local())
+		case 9:
+			var t time.Time
+			t, err = unmarshalTime(v)
+			deleted := metav1.NewTime(t.Local())
+			m.DeletionTimestamp = &deleted
+		case 10:
+			seconds := int64(x)
+			m.DeletionGracePeriodSeconds = &seconds
+		case 11:
+			m.Labels, err = addMapEntry(m.Labels, v)
+		case 12:
+			m.Annotations, err = addMapEntry(m.Annotations, v)
+		case 13:
+			ref := metav1.OwnerReference{}
+			err = ref.Unmarshal(v)
+			m.OwnerReferences = append(m.OwnerReferences, ref)
+		case 14:
+			m.Finalizers = append(m.Finalizers, string(v))
+		case 15:
+			m.ClusterName = string(v)
+		}
+		return err
+	})
+	return m, err
+}
+
+// walkFields calls field with the number and value of every field of a
+// message: the content of a length-delimited field, or a varint.
+func walkFields(b []byte, field func(num protowire.Number, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v []byte
+		var x uint64
+		switch typ {
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := field(num, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendStringField(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendVarintField(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendMessageField(b []byte, num protowire.Number, m []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m)
+}
+
+// appendTimeField appends t as a google.protobuf.Timestamp, unless it is zero.
+func appendTimeField(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	m = appendVarintField(m, 1, uint64(t.Unix()))
+	m = appendVarintField(m, 2, uint64(t.Nanosecond()))
+	return appendMessageField(b, num, m)
+}
+
+func unmarshalTime(data []byte) (time.Time, error) {
+	var seconds, nanos int64
+	err := walkFields(data, func(num protowire.Number, _ []byte, x uint64) error {
+		switch num {
+		case 1:
+			seconds = int64(x)
+		case 2:
+			nanos = int64(x)
+		}
+		return nil
+	})
+	return time.Unix(seconds, nanos).UTC(), err
+}
+
+// appendMapField appends the entries of a map<string, string>, sorted by key
+// so that equal maps encode the same.
+func appendMapField(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendStringField(entry, 1, k)
+		entry = appendStringField(entry, 2, m[k])
+		b = appendMessageField(b, num, entry)
+	}
+	return b
+}
+
+func addMapEntry(m map[string]string, entry []byte) (map[string]string, error) {
+	var k, v string
+	err := walkFields(entry, func(num protowire.Number, value []byte, _ uint64) error {
+		switch num {
+		case 1:
+			k = string(value)
+		case 2:
+			v = string(value)
+		}
+		return nil
+	})
+	if m == nil {
+		m = map[string]string{}
+	}
+	m[k] = v
+	return m, err
+}
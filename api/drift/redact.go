@@ -0,0 +1,232 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/yaml"
+)
+
+// RedactedValue replaces redacted values, or the parts of them matching a
+// redaction pattern.
+const RedactedValue = "[redacted]"
+
+// RedactionRule masks values of drift records of a kind as they are built by
+// New, before they are stored or served. A Kind of "*" applies to all kinds.
+//
+// Path is a JSONPath, as for ignore rules, selecting the values a rule applies
+// to; without a Path it applies to the whole record. Without a Pattern every
+// string under the selected values is replaced; with one, only the parts of
+// them matching the regular expression are. The type, name, namespace and uid
+// of a record are never redacted, so it keeps its key.
+type RedactionRule struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// secretPatterns match credentials commonly found in annotations and event
+// messages: assignments to password or token like names, bearer tokens, JWTs
+// and AWS access key ids.
+const secretPatterns = `(?i:\b(?:password|passwd|pwd|secret|token|api[_-]?key)\s*[:=]\s*[^\s,;"']+)` +
+	`|(?i:\bbearer\s+[A-Za-z0-9._~+/-]+=*)` +
+	`|\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+` +
+	`|\bAKIA[0-9A-Z]{16}\b`
+
+// DefaultRedactionRules mask the last applied configuration, which holds the
+// full spec, the env values of pod templates, and credentials in annotations
+// and event messages.
+var DefaultRedactionRules = []RedactionRule{
+	{Kind: "*", Path: "$.metaData.annotations['kubectl.kubernetes.io/last-applied-configuration']"},
+	{Kind: "*", Path: "$.spec.template.spec.containers[*].env[*].value"},
+	{Kind: "*", Path: "$.spec.template.spec.initContainers[*].env[*].value"},
+	{Kind: "cronjob", Path: "$.spec.jobTemplate.spec.template.spec.containers[*].env[*].value"},
+	{Kind: "cronjob", Path: "$.spec.jobTemplate.spec.template.spec.initContainers[*].env[*].value"},
+	{Kind: "*", Path: "$.metaData.annotations", Pattern: secretPatterns},
+	{Kind: "event", Path: "$.event.message", Pattern: secretPatterns},
+}
+
+var redactedFields = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kube_drift_redacted_fields_total",
+	Help: "Number of values of drift records masked by redaction rules.",
+}, []string{"kind"})
+
+func init() {
+	metrics.Registry.MustRegister(redactedFields)
+}
+
+type redaction struct {
+	kind     string
+	segments []string
+	pattern  *regexp.Regexp
+}
+
+// redactions are the compiled rules applied by New.
+var redactions = mustCompileRedactions(DefaultRedactionRules)
+
+func compileRedactions(rules []RedactionRule) ([]redaction, error) {
+	var compiled []redaction
+	for _, rule := range rules {
+		r := redaction{kind: rule.Kind}
+		var err error
+		if rule.Path != "" {
+			if r.segments, err = parsePath(rule.Path); err != nil {
+				return nil, fmt.Errorf("invalid redaction rule path %q for kind %s: %v", rule.Path, rule.Kind, err)
+			}
+		}
+		if rule.Pattern != "" {
+			if r.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return nil, fmt.Errorf("invalid redaction rule pattern %q for kind %s: %v", rule.Pattern, rule.Kind, err)
+			}
+		}
+		if r.segments == nil && r.pattern == nil {
+			return nil, fmt.Errorf("redaction rule for kind %s has neither a path nor a pattern", rule.Kind)
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+func mustCompileRedactions(rules []RedactionRule) []redaction {
+	compiled, err := compileRedactions(rules)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// LoadRedactionRules reads a list of redaction rules from a JSON or YAML file.
+func LoadRedactionRules(path string) ([]RedactionRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []RedactionRule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	if _, err := compileRedactions(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SetRedactionRules replaces the rules applied by New. It is called before
+// any object is recorded.
+func SetRedactionRules(rules []RedactionRule) error {
+	compiled, err := compileRedactions(rules)
+	if err != nil {
+		return err
+	}
+	redactions = compiled
+	return nil
+}
+
+// redact applies the redaction rules for the kind of p to it.
+func (p *KubeDrift) redact() {
+	var applicable []redaction
+	for _, r := range redactions {
+		if r.kind == "*" || r.kind == p.Type {
+			applicable = append(applicable, r)
+		}
+	}
+	if len(applicable) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(p)
+	if err != nil {
+		klog.Errorf("error redacting %s: %v", p.GetKey(), err)
+		return
+	}
+	var obj interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		klog.Errorf("error redacting %s: %v", p.GetKey(), err)
+		return
+	}
+
+	masked := 0
+	for _, r := range applicable {
+		obj = redactPath(obj, r.segments, func(v interface{}) interface{} {
+			return redactValue(v, r.pattern, &masked)
+		})
+	}
+	if masked == 0 {
+		return
+	}
+
+	if data, err = json.Marshal(obj); err != nil {
+		klog.Errorf("error redacting %s: %v", p.GetKey(), err)
+		return
+	}
+	redacted := KubeDrift{}
+	if err := json.Unmarshal(data, &redacted); err != nil {
+		klog.Errorf("error redacting %s: %v", p.GetKey(), err)
+		return
+	}
+	redacted.Type = p.Type
+	redacted.MetaData.Name = p.MetaData.Name
+	redacted.MetaData.Namespace = p.MetaData.Namespace
+	redacted.MetaData.UID = p.MetaData.UID
+	redacted.SetKey()
+	*p = redacted
+	redactedFields.WithLabelValues(p.Type).Add(float64(masked))
+}
+
+// redactPath replaces the values at segments of obj with fn of them, expanding
+// * over every key of an object or element of an array.
+func redactPath(obj interface{}, segments []string, fn func(interface{}) interface{}) interface{} {
+	if len(segments) == 0 {
+		return fn(obj)
+	}
+	segment := segments[0]
+
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if segment == "*" || segment == k {
+				v[k] = redactPath(child, segments[1:], fn)
+			}
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(segment)
+		for j := range v {
+			if segment == "*" || (err == nil && i == j) {
+				v[j] = redactPath(v[j], segments[1:], fn)
+			}
+		}
+	}
+	return obj
+}
+
+// redactValue replaces every string under v, or the parts of it matching
+// pattern, counting the strings it changed.
+func redactValue(v interface{}, pattern *regexp.Regexp, masked *int) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = redactValue(child, pattern, masked)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = redactValue(child, pattern, masked)
+		}
+	case string:
+		redacted := RedactedValue
+		if pattern != nil {
+			redacted = pattern.ReplaceAllString(t, RedactedValue)
+		}
+		if redacted != t {
+			*masked++
+		}
+		return redacted
+	}
+	return v
+}
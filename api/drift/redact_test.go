@@ -0,0 +1,57 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRedaction(t *testing.T) {
+	defer SetRedactionRules(DefaultRedactionRules)
+	rules := append(DefaultRedactionRules,
+		RedactionRule{Kind: "pod", Path: "$.metaData.labels['team-oncall']"},
+		RedactionRule{Kind: "pod", Pattern: `internal\.example\.com`},
+	)
+	if err := SetRedactionRules(rules); err != nil {
+		t.Fatal(err)
+	}
+
+	pod := testPod("web-1", "registry.internal.example.com/web:1.0", "")
+	pod.Labels = map[string]string{"app": "checkout", "team-oncall": "alice"}
+	pod.Annotations = map[string]string{
+		"kubectl.kubernetes.io/last-applied-configuration": `{"spec":{"containers":[{"env":[{"name":"DB_PASSWORD","value":"hunter2"}]}]}}`,
+		"ci/trigger": "curl -H 'Authorization: Bearer abc.def-123' https://ci",
+		"owner":      "payments",
+	}
+	drift := New(pod, "update")
+
+	got := drift.Marshal()
+	for _, secret := range []string{"hunter2", "alice", "abc.def-123", "internal.example.com"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("%q was not redacted from %s", secret, got)
+		}
+	}
+	if drift.MetaData.Annotations["owner"] != "payments" || drift.MetaData.Labels["app"] != "checkout" {
+		t.Errorf("values matching no rule were redacted: %+v", drift.MetaData)
+	}
+	if drift.Images[0].Image != "registry."+RedactedValue+"/web:1.0" {
+		t.Errorf("unexpected redacted image %q", drift.Images[0].Image)
+	}
+	if drift.GetKey() != "/pod/default/web-1/uid-web-1" {
+		t.Errorf("redaction changed the key to %s", drift.GetKey())
+	}
+
+	event := New(&v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-1.1", Namespace: "default", UID: "uid-event"},
+		Message:    "Readiness probe failed: login with password=s3cr3t refused",
+	}, "update")
+	if msg := event.Event.(map[string]interface{})["message"]; msg != "Readiness probe failed: login with "+RedactedValue+" refused" {
+		t.Errorf("unexpected redacted event message %q", msg)
+	}
+
+	if err := SetRedactionRules([]RedactionRule{{Kind: "*"}}); err == nil {
+		t.Error("expected an error for a rule without path or pattern")
+	}
+}
@@ -0,0 +1,131 @@
+package provider
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// severityRank orders findings from the most to the least severe.
+var severityRank = map[string]int{SeverityCritical: 0, SeverityWarning: 1, SeverityInfo: 2}
+
+// GetReportFindings returns the findings about the objects of a namespace,
+// most severe and oldest first, including the findings about images its pods
+// run. With a policy, only the findings about objects a target of the
+// DriftPolicy of that name in the namespace matches are returned.
+func (s *Store) GetReportFindings(namespace, policy string) ([]Finding, error) {
+	findings, err := s.GetFindings("/")
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []PolicyTarget
+	if policy != "" {
+		p, ok := s.getPolicy(namespace, policy)
+		if !ok {
+			return nil, fmt.Errorf("policy %s/%s is not applied", namespace, policy)
+		}
+		targets = p.Targets
+	}
+
+	var report []Finding
+	for _, f := range findings {
+		if f.Namespace != namespace && f.Namespace != "" {
+			continue
+		}
+		records := s.findingRecords(f, namespace)
+		if f.Namespace == "" && len(records) == 0 {
+			// a finding about cluster objects, or about images no pod of
+			// the namespace runs
+			continue
+		}
+		if len(targets) > 0 && !targetsMatch(targets, namespace, records) {
+			continue
+		}
+		report = append(report, f)
+	}
+	sort.SliceStable(report, func(i, j int) bool {
+		if severityRank[report[i].Severity] != severityRank[report[j].Severity] {
+			return severityRank[report[i].Severity] < severityRank[report[j].Severity]
+		}
+		return report[i].FirstSeen.Before(report[j].FirstSeen)
+	})
+	return report, nil
+}
+
+// getPolicy returns the policy of a namespace with a name.
+func (s *Store) getPolicy(namespace, name string) (Policy, bool) {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	for _, p := range s.policies {
+		if p.Namespace == namespace && p.Name == name {
+			return p, true
+		}
+	}
+	return Policy{}, false
+}
+
+// findingRecords returns the latest records, in namespace, of the objects a
+// finding is about: the pods running the image of an image finding, or else
+// the object of the finding, whose kind is that of its record type.
+func (s *Store) findingRecords(f Finding, namespace string) []KubeDrift {
+	if f.Kind == "Image" {
+		image, err := url.PathUnescape(f.Name)
+		if err != nil {
+			return nil
+		}
+		images, err := s.getImageRecords(nil, image)
+		if err != nil {
+			return nil
+		}
+		var records []KubeDrift
+		for _, r := range images {
+			if r.Namespace != namespace {
+				continue
+			}
+			for _, pod := range r.Pods {
+				if latest, ok := s.latestRecord("pod", namespace, pod); ok {
+					records = append(records, latest)
+				}
+			}
+		}
+		return records
+	}
+
+	kind := strings.ToLower(f.Kind)
+	if !recordedKinds[kind] || f.Namespace != namespace {
+		return nil
+	}
+	if latest, ok := s.latestRecord(kind, namespace, f.Name); ok {
+		return []KubeDrift{latest}
+	}
+	return nil
+}
+
+// latestRecord returns the record of an object last observed.
+func (s *Store) latestRecord(kind, namespace, name string) (KubeDrift, bool) {
+	records, err := s.GetDriftByKeyPrefix(fmt.Sprintf("/%s/%s/%s/", kind, namespace, name))
+	if err != nil || len(records) == 0 {
+		return KubeDrift{}, false
+	}
+	latest := records[0]
+	for _, r := range records[1:] {
+		if r.ObservedAt.After(latest.ObservedAt) {
+			latest = r
+		}
+	}
+	return latest, true
+}
+
+// targetsMatch reports whether one of targets matches one of records.
+func targetsMatch(targets []PolicyTarget, namespace string, records []KubeDrift) bool {
+	for _, r := range records {
+		for _, target := range targets {
+			if target.matches(namespace, r) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package provider
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestReportFindings(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store,
+		labelledConfigMap("team-a", "shop", map[string]string{"app": "shop"}, "a"),
+		labelledConfigMap("team-a", "billing", map[string]string{"app": "billing"}, "a"))
+	for _, f := range []Finding{
+		{Type: "StaleConfig", Severity: SeverityWarning, Kind: "ConfigMap", Namespace: "team-a", Name: "shop"},
+		{Type: "StaleConfig", Severity: SeverityCritical, Kind: "ConfigMap", Namespace: "team-a", Name: "billing"},
+		{Type: "StaleConfig", Severity: SeverityCritical, Kind: "ConfigMap", Namespace: "team-b", Name: "shop"},
+	} {
+		if err := store.SaveFinding(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	findings, err := store.GetReportFindings("team-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 || findings[0].Name != "billing" || findings[1].Name != "shop" {
+		t.Errorf("expected the findings of team-a, most severe first, got %+v", findings)
+	}
+
+	if _, err := store.GetReportFindings("team-a", "shop"); err == nil {
+		t.Errorf("expected a report of a policy not applied to fail")
+	}
+	store.SetPolicies([]Policy{{Name: "shop", Namespace: "team-a", Targets: []PolicyTarget{{
+		Selector: labels.SelectorFromSet(labels.Set{"app": "shop"}),
+	}}}})
+	findings, err = store.GetReportFindings("team-a", "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Name != "shop" {
+		t.Errorf("expected only the findings about objects the policy targets, got %+v", findings)
+	}
+}
+
+func TestReportImageFindings(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store,
+		testPod("web-1", "nginx:1.21", "docker-pullable://nginx@sha256:aaa"),
+		testPod("web-2", "nginx:1.21", "docker-pullable://nginx@sha256:bbb"))
+
+	findings, err := store.GetReportFindings("default", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 2 {
+		t.Errorf("expected the mismatches of the workload and of the image it runs, got %+v", findings)
+	}
+	if findings, _ := store.GetReportFindings("team-b", ""); len(findings) != 0 {
+		t.Errorf("expected no findings about images team-b does not run, got %+v", findings)
+	}
+
+	// the replica set of the pods is not recorded, so only the finding about
+	// the image the targeted pods run is reported
+	store.SetPolicies([]Policy{{Name: "pods", Namespace: "default", Targets: []PolicyTarget{{Kinds: []string{"Pod"}}}}})
+	findings, err = store.GetReportFindings("default", "pods")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Type != "ImageTagDigestMismatch" {
+		t.Errorf("expected the image finding of the targeted pods, got %+v", findings)
+	}
+}
@@ -0,0 +1,337 @@
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+func (p *KubeDrift) newPersistentVolumeClaim(eventType string, o *v1.PersistentVolumeClaim) {
+	p.Type = "persistentvolumeclaim"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newPersistentVolume(eventType string, o *v1.PersistentVolume) {
+	p.Type = "persistentvolume"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+// StorageClassSpec is the recorded content of a StorageClass, which has no
+// spec of its own.
+type StorageClassSpec struct {
+	Provisioner          string                            `json:"provisioner"`
+	Parameters           map[string]string                 `json:"parameters,omitempty"`
+	ReclaimPolicy        *v1.PersistentVolumeReclaimPolicy `json:"reclaimPolicy,omitempty"`
+	MountOptions         []string                          `json:"mountOptions,omitempty"`
+	AllowVolumeExpansion *bool                             `json:"allowVolumeExpansion,omitempty"`
+	VolumeBindingMode    *storagev1.VolumeBindingMode      `json:"volumeBindingMode,omitempty"`
+	AllowedTopologies    []v1.TopologySelectorTerm         `json:"allowedTopologies,omitempty"`
+}
+
+func (p *KubeDrift) newStorageClass(eventType string, o *storagev1.StorageClass) {
+	p.Type = "storageclass"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = StorageClassSpec{
+		Provisioner:          o.Provisioner,
+		Parameters:           o.Parameters,
+		ReclaimPolicy:        o.ReclaimPolicy,
+		MountOptions:         o.MountOptions,
+		AllowVolumeExpansion: o.AllowVolumeExpansion,
+		VolumeBindingMode:    o.VolumeBindingMode,
+		AllowedTopologies:    o.AllowedTopologies,
+	}
+	p.SetKey()
+}
+
+// volumeClaims returns the names of the PersistentVolumeClaims a pod mounts.
+func volumeClaims(o v1.Pod) []string {
+	var claims []string
+	for _, vol := range o.Spec.Volumes {
+		if vol.PersistentVolumeClaim != nil {
+			claims = appendUnique(claims, vol.PersistentVolumeClaim.ClaimName)
+		}
+	}
+	return claims
+}
+
+// VolumeUsage links a PersistentVolumeClaim to the volume bound to it and the
+// pods mounting it.
+type VolumeUsage struct {
+	Claim  KubeDrift   `json:"claim"`
+	Volume *KubeDrift  `json:"volume,omitempty"`
+	Pods   []KubeDrift `json:"pods"`
+}
+
+// GetVolumeUsage returns the claim of a namespace, its volume and the pods of
+// the store mounting it.
+func (s *Store) GetVolumeUsage(namespace, claim string) (VolumeUsage, error) {
+	usage := VolumeUsage{}
+	claims, err := s.GetDriftByKeyPrefix(fmt.Sprintf("/persistentvolumeclaim/%s/%s/", namespace, claim))
+	if err != nil {
+		return usage, err
+	}
+	if len(claims) == 0 {
+		return usage, leveldb.ErrNotFound
+	}
+	usage.Claim = claims[len(claims)-1]
+
+	spec := v1.PersistentVolumeClaimSpec{}
+	if err := convert(usage.Claim.Spec, &spec); err != nil {
+		return usage, err
+	}
+	if spec.VolumeName != "" {
+		volumes, err := s.GetDriftByKeyPrefix(fmt.Sprintf("/persistentvolume/none/%s/", spec.VolumeName))
+		if err != nil {
+			return usage, err
+		}
+		if len(volumes) > 0 {
+			usage.Volume = &volumes[len(volumes)-1]
+		}
+	}
+
+	usage.Pods, err = s.podsMounting(nil, namespace, claim)
+	return usage, err
+}
+
+// podsMounting returns the live pods of a namespace that mount a claim.
+func (s *Store) podsMounting(b *batch, namespace, claim string) ([]KubeDrift, error) {
+	pods, err := s.getDriftByKeyPrefix(b, fmt.Sprintf("/pod/%s/", namespace))
+	if err != nil {
+		return nil, err
+	}
+	var mounting []KubeDrift
+	for _, pod := range pods {
+		if pod.EventType == EventTypeDeleted {
+			continue
+		}
+		for _, c := range pod.Claims {
+			if c == claim {
+				mounting = append(mounting, pod)
+				break
+			}
+		}
+	}
+	return mounting, nil
+}
+
+// mountedBy returns a description of the pods mounting a claim for finding
+// messages, looked up only when a finding is saved.
+func (s *Store) mountedBy(b *batch, namespace, claim string) func() string {
+	return func() string {
+		pods, err := s.podsMounting(b, namespace, claim)
+		if err != nil || len(pods) == 0 {
+			return ""
+		}
+		var names []string
+		for _, pod := range pods {
+			names = append(names, pod.MetaData.Name)
+		}
+		sort.Strings(names)
+		return "; mounted by pods " + strings.Join(names, ", ")
+	}
+}
+
+func noPods() string {
+	return ""
+}
+
+// storageKinds are the kinds of the findings about claims and volumes by the
+// type of their records.
+var storageKinds = map[string]string{
+	"persistentvolumeclaim": "PersistentVolumeClaim",
+	"persistentvolume":      "PersistentVolume",
+}
+
+// checkStorage detects phase transitions, resizes and reclaim policy changes
+// of claims, volumes and storage classes.
+func (s *Store) checkStorage(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if drift.EventType == EventTypeDeleted && drift.Type != "storageclass" {
+		// a released volume is deleted by its reclaim policy, and a claim
+		// once no longer needed: neither is left unbound
+		finding := Finding{Type: "VolumeUnbound", Kind: storageKinds[drift.Type],
+			Namespace: drift.MetaData.Namespace, Name: drift.MetaData.Name}
+		return s.clearFinding(b, finding.GetKey())
+	}
+	switch drift.Type {
+	case "persistentvolumeclaim":
+		return s.checkClaim(b, prev, drift)
+	case "persistentvolume":
+		return s.checkVolume(b, prev, drift)
+	case "storageclass":
+		return s.checkStorageClass(b, prev, drift)
+	}
+	return nil
+}
+
+func (s *Store) checkClaim(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	var status v1.PersistentVolumeClaimStatus
+	var spec v1.PersistentVolumeClaimSpec
+	if err := convert(drift.Status, &status); err != nil {
+		return err
+	}
+	if err := convert(drift.Spec, &spec); err != nil {
+		return err
+	}
+	finding := Finding{
+		Kind:      "PersistentVolumeClaim",
+		Namespace: drift.MetaData.Namespace,
+		Name:      drift.MetaData.Name,
+		UID:       drift.MetaData.UID,
+	}
+	pods := s.mountedBy(b, drift.MetaData.Namespace, drift.MetaData.Name)
+
+	var before v1.PersistentVolumeClaimStatus
+	if prev != nil {
+		if err := convert(prev.Status, &before); err != nil {
+			return err
+		}
+	}
+	if err := s.updatePhaseFinding(b, finding, string(before.Phase), string(status.Phase),
+		fmt.Sprintf("volume %s", spec.VolumeName), pods); err != nil {
+		return err
+	}
+	if prev != nil {
+		return s.checkResize(b, finding, before.Capacity, status.Capacity, pods)
+	}
+	return nil
+}
+
+func (s *Store) checkVolume(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	var status v1.PersistentVolumeStatus
+	var spec v1.PersistentVolumeSpec
+	if err := convert(drift.Status, &status); err != nil {
+		return err
+	}
+	if err := convert(drift.Spec, &spec); err != nil {
+		return err
+	}
+	finding := Finding{
+		Kind: "PersistentVolume",
+		Name: drift.MetaData.Name,
+		UID:  drift.MetaData.UID,
+	}
+	claim, pods := "no claim", noPods
+	if spec.ClaimRef != nil {
+		claim = fmt.Sprintf("claim %s/%s", spec.ClaimRef.Namespace, spec.ClaimRef.Name)
+		pods = s.mountedBy(b, spec.ClaimRef.Namespace, spec.ClaimRef.Name)
+	}
+
+	var beforeStatus v1.PersistentVolumeStatus
+	var beforeSpec v1.PersistentVolumeSpec
+	if prev != nil {
+		if err := convert(prev.Status, &beforeStatus); err != nil {
+			return err
+		}
+		if err := convert(prev.Spec, &beforeSpec); err != nil {
+			return err
+		}
+	}
+	if err := s.updatePhaseFinding(b, finding, string(beforeStatus.Phase), string(status.Phase), claim, pods); err != nil {
+		return err
+	}
+	if prev == nil {
+		return nil
+	}
+	if err := s.checkResize(b, finding, beforeSpec.Capacity, spec.Capacity, pods); err != nil {
+		return err
+	}
+	return s.checkReclaimPolicy(b, finding, string(beforeSpec.PersistentVolumeReclaimPolicy),
+		string(spec.PersistentVolumeReclaimPolicy), pods)
+}
+
+// checkStorageClass compares a storage class with its previous record, which
+// has a different UID when the class was recreated to change its immutable
+// reclaim policy.
+func (s *Store) checkStorageClass(b *batch, prev *KubeDrift, drift KubeDrift) error {
+	if prev == nil {
+		classes, err := s.getDriftByKeyPrefix(b, fmt.Sprintf("/storageclass/none/%s/", drift.MetaData.Name))
+		if err != nil {
+			return err
+		}
+		for i := range classes {
+			if classes[i].MetaData.UID != drift.MetaData.UID {
+				prev = &classes[i]
+			}
+		}
+		if prev == nil {
+			return nil
+		}
+	}
+	var before, after StorageClassSpec
+	if err := convert(prev.Spec, &before); err != nil {
+		return err
+	}
+	if err := convert(drift.Spec, &after); err != nil {
+		return err
+	}
+	return s.checkReclaimPolicy(b, Finding{
+		Kind: "StorageClass",
+		Name: drift.MetaData.Name,
+		UID:  drift.MetaData.UID,
+	}, reclaimPolicy(before.ReclaimPolicy), reclaimPolicy(after.ReclaimPolicy), noPods)
+}
+
+// reclaimPolicy returns the reclaim policy of a storage class, which defaults
+// to Delete.
+func reclaimPolicy(p *v1.PersistentVolumeReclaimPolicy) string {
+	if p == nil {
+		return string(v1.PersistentVolumeReclaimDelete)
+	}
+	return string(*p)
+}
+
+// updatePhaseFinding reports a claim or volume that left the Bound phase,
+// until it is bound again or deleted.
+func (s *Store) updatePhaseFinding(b *batch, finding Finding, before, after, boundTo string, pods func() string) error {
+	finding.Type = "VolumeUnbound"
+	switch {
+	case after == string(v1.ClaimBound):
+		return s.clearFinding(b, finding.GetKey())
+	case before != string(v1.ClaimBound):
+		return nil
+	}
+	finding.Severity = SeverityWarning
+	if after == string(v1.ClaimLost) || after == string(v1.VolumeFailed) {
+		finding.Severity = SeverityCritical
+	}
+	finding.Message = fmt.Sprintf("phase changed from %s to %s, was bound to %s%s", before, after, boundTo, pods())
+	return s.saveFinding(b, finding)
+}
+
+func (s *Store) checkResize(b *batch, finding Finding, before, after v1.ResourceList, pods func() string) error {
+	from, to := before[v1.ResourceStorage], after[v1.ResourceStorage]
+	if from.IsZero() || to.IsZero() || from.Cmp(to) == 0 {
+		return nil
+	}
+	finding.Type = "VolumeResized"
+	finding.Severity = SeverityInfo
+	finding.Message = fmt.Sprintf("capacity changed from %s to %s%s", from.String(), to.String(), pods())
+	return s.saveFinding(b, finding)
+}
+
+func (s *Store) checkReclaimPolicy(b *batch, finding Finding, before, after string, pods func() string) error {
+	if before == "" || before == after {
+		return nil
+	}
+	finding.Type = "ReclaimPolicyChanged"
+	finding.Severity = SeverityWarning
+	if after == string(v1.PersistentVolumeReclaimDelete) {
+		// released volumes are now deleted along with their data
+		finding.Severity = SeverityCritical
+	}
+	finding.Message = fmt.Sprintf("reclaim policy changed from %s to %s%s", before, after, pods())
+	return s.saveFinding(b, finding)
+}
@@ -0,0 +1,150 @@
+package provider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func claim(phase v1.PersistentVolumeClaimPhase, capacity string) *v1.PersistentVolumeClaim {
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default", UID: "uid-pvc"},
+		Spec:       v1.PersistentVolumeClaimSpec{VolumeName: "pv-1"},
+		Status: v1.PersistentVolumeClaimStatus{
+			Phase:    phase,
+			Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)},
+		},
+	}
+}
+
+func volume(phase v1.PersistentVolumePhase, policy v1.PersistentVolumeReclaimPolicy) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1", UID: "uid-pv"},
+		Spec: v1.PersistentVolumeSpec{
+			Capacity:                      v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")},
+			ClaimRef:                      &v1.ObjectReference{Namespace: "default", Name: "data"},
+			PersistentVolumeReclaimPolicy: policy,
+		},
+		Status: v1.PersistentVolumeStatus{Phase: phase},
+	}
+}
+
+func saveAll(t *testing.T, store *Store, objects ...interface{}) {
+	t.Helper()
+	for _, obj := range objects {
+		if err := store.Save(*New(obj, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestClaimLostAndResized(t *testing.T) {
+	store := newTestStore(t)
+	pod := testPod("db-0", "postgres:14", "")
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{
+		PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+	}}}
+	saveAll(t, store, pod, claim(v1.ClaimBound, "10Gi"), claim(v1.ClaimBound, "20Gi"), claim(v1.ClaimLost, "20Gi"))
+
+	findings, err := store.GetFindings("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range findings {
+		got[f.Type] = f.Severity + ": " + f.Message
+	}
+	want := map[string]string{
+		"VolumeUnbound": "critical: phase changed from Bound to Lost, was bound to volume pv-1; mounted by pods db-0",
+		"VolumeResized": "info: capacity changed from 10Gi to 20Gi; mounted by pods db-0",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected findings %v", got)
+	}
+
+	saveAll(t, store, volume(v1.VolumeBound, v1.PersistentVolumeReclaimRetain))
+	usage, err := store.GetVolumeUsage("default", "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Volume == nil || usage.Volume.MetaData.Name != "pv-1" || len(usage.Pods) != 1 || usage.Pods[0].MetaData.Name != "db-0" {
+		t.Errorf("unexpected volume usage %+v", usage)
+	}
+
+	saveAll(t, store, claim(v1.ClaimBound, "20Gi"))
+	if f, _ := store.GetFindings("/VolumeUnbound/"); len(f) != 0 {
+		t.Errorf("expected the finding to clear once the claim is bound again, got %+v", f)
+	}
+}
+
+func TestVolumeReleasedAndReclaimPolicy(t *testing.T) {
+	store := newTestStore(t)
+	saveAll(t, store,
+		volume(v1.VolumeBound, v1.PersistentVolumeReclaimRetain),
+		volume(v1.VolumeBound, v1.PersistentVolumeReclaimDelete),
+		volume(v1.VolumeReleased, v1.PersistentVolumeReclaimDelete),
+	)
+
+	released, _ := store.GetFindings("/VolumeUnbound/PersistentVolume/")
+	if len(released) != 1 || released[0].Severity != SeverityWarning ||
+		released[0].Message != "phase changed from Bound to Released, was bound to claim default/data" {
+		t.Errorf("unexpected findings %+v", released)
+	}
+	policy, _ := store.GetFindings("/ReclaimPolicyChanged/")
+	if len(policy) != 1 || policy[0].Severity != SeverityCritical {
+		t.Errorf("unexpected findings %+v", policy)
+	}
+}
+
+func TestDeletedVolumeNotUnbound(t *testing.T) {
+	store := newTestStore(t)
+	ctx := context.Background()
+	pod := testPod("db-0", "postgres:14", "")
+	pod.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{
+		PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"},
+	}}}
+	saveAll(t, store, pod, volume(v1.VolumeBound, v1.PersistentVolumeReclaimDelete))
+
+	// the pod is gone by the time its volume is released
+	if err := store.WriteDeletion(ctx, "pod", "default", "db-0"); err != nil {
+		t.Fatal(err)
+	}
+	saveAll(t, store, volume(v1.VolumeReleased, v1.PersistentVolumeReclaimDelete))
+	released, _ := store.GetFindings("/VolumeUnbound/PersistentVolume/")
+	if len(released) != 1 || released[0].Message != "phase changed from Bound to Released, was bound to claim default/data" {
+		t.Fatalf("expected the deleted pod not to be named, got %+v", released)
+	}
+
+	// the Delete reclaim policy then deletes the volume
+	if err := store.WriteDeletion(ctx, "persistentvolume", "", "pv-1"); err != nil {
+		t.Fatal(err)
+	}
+	if f, _ := store.GetFindings("/VolumeUnbound/"); len(f) != 0 {
+		t.Errorf("expected the finding to clear once the volume was deleted, got %+v", f)
+	}
+}
+
+func TestStorageClassRecreated(t *testing.T) {
+	store := newTestStore(t)
+	retain, remove := v1.PersistentVolumeReclaimRetain, v1.PersistentVolumeReclaimDelete
+	class := func(uid string, policy *v1.PersistentVolumeReclaimPolicy) *storagev1.StorageClass {
+		return &storagev1.StorageClass{
+			ObjectMeta:    metav1.ObjectMeta{Name: "fast", UID: types.UID(uid)},
+			Provisioner:   "ebs.csi.aws.com",
+			ReclaimPolicy: policy,
+		}
+	}
+	// the reclaim policy is immutable, so the class is recreated to change it
+	saveAll(t, store, class("uid-1", &retain), class("uid-2", &remove))
+
+	findings, _ := store.GetFindings("/ReclaimPolicyChanged/StorageClass/")
+	if len(findings) != 1 || findings[0].Message != "reclaim policy changed from Retain to Delete" {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
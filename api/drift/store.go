@@ -2,10 +2,14 @@ package provider
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
 	"k8s.io/klog/v2"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,11 +17,50 @@ type Store struct {
 	db     *leveldb.DB
 	path   string
 	window time.Duration
+	ignore []IgnoreRule
+	codec  Codec
+
+	// policyMu guards ignore and the policies, which the DriftPolicy
+	// controller replaces while objects are written.
+	policyMu     sync.RWMutex
+	policies     []Policy
+	policyIgnore []IgnoreRule
+
+	indexedLabels []string
+
+	pipelineOpts PipelineOptions
+	queue        chan writeRequest
+
+	retention time.Duration
+	archive   ObjectStore
+	segments  segmentCache
+
+	keys *Keyring
+
+	// openedAt is when the store was opened, before the manager starts: the
+	// objects created before it are listed by the initial sync of the watches.
+	openedAt time.Time
+
+	// writeMu is held for reading by every write, and for writing while
+	// values are re-encrypted.
+	writeMu sync.RWMutex
 }
 
+// New opens the store at path. A store LevelDB reports as corrupted, such as
+// after the process was killed mid-write, is recovered from its table files;
+// entries lost or damaged in the recovery are reported by Verify. A store that
+// cannot be recovered is left untouched for the operator to move aside.
 func (s *Store) New(path string) error {
 	db, err := leveldb.OpenFile(path, nil)
-
+	if errors.IsCorrupted(err) {
+		klog.Errorf("store %s is corrupted, attempting recovery: %v", path, err)
+		db, err = leveldb.RecoverFile(path, nil)
+		if err != nil {
+			return fmt.Errorf("store %s is corrupted and could not be recovered: %v; "+
+				"move it aside to start with an empty store, then import a previous export into it", path, err)
+		}
+		klog.Warningf("store %s recovered, run verify to check its entries", path)
+	}
 	if err != nil {
 		return err
 	}
@@ -25,40 +68,155 @@ func (s *Store) New(path string) error {
 	s.db = db
 	s.path = path
 	s.window = time.Minute * 6
+	s.ignore = DefaultIgnoreRules
+	s.codec = DefaultCodec
+	s.indexedLabels = DefaultIndexedLabels
+	s.openedAt = time.Now().UTC()
 
 	return nil
 }
 
+// writeBatch, put and delete write to the db, held back while values are
+// re-encrypted.
+func (s *Store) writeBatch(batch *leveldb.Batch) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	return s.db.Write(batch, nil)
+}
+
+func (s *Store) put(key, value []byte) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	return s.db.Put(key, value, nil)
+}
+
+func (s *Store) delete(key []byte) error {
+	s.writeMu.RLock()
+	defer s.writeMu.RUnlock()
+	return s.db.Delete(key, nil)
+}
+
 func (s *Store) Close() {
 	s.db.Close()
 }
 
+// Save writes drift, its index entries, its new version, if it changed, and
+// the records and findings its detectors update, in a single atomic batch.
 func (s *Store) Save(drift KubeDrift) error {
+	b := newBatch(nil)
+	if err := s.prepare(b, &drift); err != nil {
+		return err
+	}
+	return s.writeBatch(&b.Batch)
+}
+
+// prepare queues on b the writes saving drift, reading the records they build
+// on through b. Nothing is queued when it returns an error.
+func (s *Store) prepare(parent *batch, drift *KubeDrift) error {
 	drift.SetKey() //fmt.Sprintf("%s/%s/%s", event, p.Namespace, p.UID)
-	data, err := json.Marshal(drift)
+	drift.ObservedAt = time.Now().UTC()
+
+	var prev *KubeDrift
+	latest := KubeDrift{}
+	data, err := s.get(parent, drift.GetKey())
+	if err == nil {
+		if err := s.unmarshal(data, &latest); err != nil {
+			klog.Errorf("error decoding latest record of %s, saving it as new: %v", drift.GetKey(), err)
+		} else {
+			prev = &latest
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
 
+	b := newBatch(parent)
+	switch drift.Type {
+	case "pod":
+		if err := s.trackImages(b, prev, *drift); err != nil {
+			klog.Errorf("error tracking images for %s: %v", drift.GetKey(), err)
+		}
+		if err := s.checkPodConfig(b, *drift); err != nil {
+			klog.Errorf("error checking config of %s: %v", drift.GetKey(), err)
+		}
+	case "configmap", "secret":
+		if err := s.trackConfig(b, prev, *drift); err != nil {
+			klog.Errorf("error tracking config change of %s: %v", drift.GetKey(), err)
+		}
+	case "service", "endpoints", "endpointslice", "networkpolicy":
+		if err := s.checkNetwork(b, prev, *drift); err != nil {
+			klog.Errorf("error checking network change of %s: %v", drift.GetKey(), err)
+		}
+	case "persistentvolumeclaim", "persistentvolume", "storageclass":
+		if err := s.checkStorage(b, prev, *drift); err != nil {
+			klog.Errorf("error checking storage change of %s: %v", drift.GetKey(), err)
+		}
+	case "event":
+		if err := s.mergeEvent(b, *drift); err != nil {
+			klog.Errorf("error merging event %s into its series: %v", drift.GetKey(), err)
+		}
+	case "namespace":
+		if err := s.checkNamespace(b, *drift); err != nil {
+			klog.Errorf("error checking namespace %s: %v", drift.GetKey(), err)
+		}
+	case "resourcequota":
+		if err := s.checkQuota(b, prev, *drift); err != nil {
+			klog.Errorf("error checking quota usage of %s: %v", drift.GetKey(), err)
+		}
+	case "role", "clusterrole", "rolebinding", "clusterrolebinding":
+		if err := s.trackPermissions(b, prev, *drift); err != nil {
+			klog.Errorf("error tracking permission change of %s: %v", drift.GetKey(), err)
+		}
+	}
+
+	unchanged, err := s.dedup(prev, drift)
 	if err != nil {
 		return err
 	}
 
-	err = s.db.Put([]byte(drift.GetKey()), data, nil)
+	doc, err := json.Marshal(drift)
 	if err != nil {
-		klog.Error(err)
+		return err
 	}
-	klog.Infof("saved drift: %s", drift.GetKey())
-	return nil
+	if data, err = s.encodeRecord(*drift, doc); err != nil {
+		return err
+	}
+
+	if unchanged {
+		klog.Infof("no change to drift: %s (seen %d times)", drift.GetKey(), drift.SeenCount)
+	} else {
+		if err := s.saveVersion(b, *drift, doc); err != nil {
+			return err
+		}
+		klog.Infof("saved drift: %s", drift.GetKey())
+	}
+	b.Put([]byte(drift.GetKey()), data)
+	s.updateIndexes(b, prev, *drift)
+	return b.appendTo(parent)
 }
 
 func (s *Store) GetDriftByKey(key string) (KubeDrift, error) {
 
 	drift := KubeDrift{}
 
+	if strings.HasPrefix(key, "/history/") {
+		versions, err := s.getHistoryByKeyPrefix(historyObjectPrefix(key))
+		if err != nil {
+			return drift, err
+		}
+		for _, v := range versions {
+			if v.historyKey() == key {
+				return v, nil
+			}
+		}
+		return drift, leveldb.ErrNotFound
+	}
+
 	data, err := s.db.Get([]byte(key), nil)
 	if err != nil {
 		return drift, err
 	}
 
-	err = json.Unmarshal(data, &drift)
+	err = s.unmarshal(data, &drift)
 	//drift = Deserialize(data)
 
 	return drift, nil
@@ -66,6 +224,10 @@ func (s *Store) GetDriftByKey(key string) (KubeDrift, error) {
 
 func (s *Store) GetDriftByKeyPrefix(keyPrefix string) ([]KubeDrift, error) {
 	klog.Infof("get drift by key prefix: %s", keyPrefix)
+	if strings.HasPrefix(keyPrefix, "/history/") {
+		return s.getHistoryByKeyPrefix(keyPrefix)
+	}
+
 	var iter iterator.Iterator
 	//iter = c.db.NewIterator(nil, nil)
 	iter = s.db.NewIterator(util.BytesPrefix([]byte(keyPrefix)), nil)
@@ -85,7 +247,7 @@ func (s *Store) GetDrifts(iter iterator.Iterator) ([]KubeDrift, []KubeDrift, err
 
 	for iter.Next() {
 		drift := KubeDrift{}
-		json.Unmarshal(iter.Value(), &drift)
+		s.unmarshal(iter.Value(), &drift)
 		entries = append(entries, drift)
 		cnt++
 	}
@@ -100,11 +262,11 @@ func (s *Store) GetDrifts(iter iterator.Iterator) ([]KubeDrift, []KubeDrift, err
 }
 
 func (s *Store) SaveDrift(drift KubeDrift) error {
-	data, err := json.Marshal(drift)
+	data, err := s.encode(drift)
 	if err != nil {
 		return err
 	}
-	err = s.db.Put([]byte(drift.GetKey()), data, nil)
+	err = s.put([]byte(drift.GetKey()), data)
 	if err != nil {
 		return err
 	}
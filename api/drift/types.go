@@ -1,12 +1,17 @@
 package provider
 
 import (
-	"bytes"
-	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/klog/v2"
@@ -62,13 +67,32 @@ type ObjectMeta struct {
 	ClusterName                string                  `json:"clusterName,omitempty" protobuf:"bytes,15,opt,name=clusterName"`
 }
 
+// ContainerImage pairs the image a container was specified with and the digest it is running.
+type ContainerImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	ImageID   string `json:"imageID,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
 type KubeDrift struct {
-	key       string
-	Type      string      `json:"type"`
-	EventType string      `json:"eventType"`
-	MetaData  ObjectMeta  `json:"metaData"`
-	Status    interface{} `json:"status,omitempty" protobuf:"bytes,3,opt,name=status"`
-	Event     interface{} `json:"event,omitempty" protobuf:"bytes,3,opt,name=event"`
+	key             string
+	Type            string            `json:"type"`
+	EventType       string            `json:"eventType"`
+	MetaData        ObjectMeta        `json:"metaData"`
+	Spec            interface{}       `json:"spec,omitempty"`
+	Status          interface{}       `json:"status,omitempty" protobuf:"bytes,3,opt,name=status"`
+	Event           interface{}       `json:"event,omitempty" protobuf:"bytes,3,opt,name=event"`
+	Images          []ContainerImage  `json:"images,omitempty"`
+	ConfigRefs      []ConfigRef       `json:"configRefs,omitempty"`
+	Claims          []string          `json:"claims,omitempty"`
+	ReplicasManager string            `json:"replicasManager,omitempty"`
+	Data            map[string]string `json:"data,omitempty"`
+	NodeName        string            `json:"nodeName,omitempty"`
+	ObservedAt      time.Time         `json:"observedAt,omitempty"`
+	LastSeen        time.Time         `json:"lastSeen,omitempty"`
+	SeenCount       int               `json:"seenCount,omitempty"`
+	ContentHash     string            `json:"contentHash,omitempty"`
 }
 
 func (p *KubeDrift) SetKey() {
@@ -102,36 +126,160 @@ func New(drift interface{}, eventType string) *KubeDrift {
 	case *v1.Event:
 		o := (drift).(*v1.Event)
 		p.newEvent(eventType, o)
+	case *eventsv1.Event:
+		o := (drift).(*eventsv1.Event)
+		p.newEventsV1Event(eventType, o)
 	case *appsv1.Deployment:
 		o := (drift).(*appsv1.Deployment)
 		p.newDeployment(eventType, o)
+	case *appsv1.StatefulSet:
+		o := (drift).(*appsv1.StatefulSet)
+		p.newStatefulSet(eventType, o)
+	case *appsv1.DaemonSet:
+		o := (drift).(*appsv1.DaemonSet)
+		p.newDaemonSet(eventType, o)
+	case *appsv1.ReplicaSet:
+		o := (drift).(*appsv1.ReplicaSet)
+		p.newReplicaSet(eventType, o)
+	case *batchv1.Job:
+		o := (drift).(*batchv1.Job)
+		p.newJob(eventType, o)
+	case *batchv1.CronJob:
+		o := (drift).(*batchv1.CronJob)
+		p.newCronJob(eventType, o)
+	case *autoscalingv2beta2.HorizontalPodAutoscaler:
+		o := (drift).(*autoscalingv2beta2.HorizontalPodAutoscaler)
+		p.newHorizontalPodAutoscaler(eventType, o)
+	case *v1.Service:
+		o := (drift).(*v1.Service)
+		p.newService(eventType, o)
+	case *v1.Endpoints:
+		o := (drift).(*v1.Endpoints)
+		p.newEndpoints(eventType, o)
+	case *discoveryv1.EndpointSlice:
+		o := (drift).(*discoveryv1.EndpointSlice)
+		p.newEndpointSlice(eventType, o)
+	case *networkingv1.Ingress:
+		o := (drift).(*networkingv1.Ingress)
+		p.newIngress(eventType, o)
+	case *networkingv1.NetworkPolicy:
+		o := (drift).(*networkingv1.NetworkPolicy)
+		p.newNetworkPolicy(eventType, o)
+	case *v1.PersistentVolumeClaim:
+		o := (drift).(*v1.PersistentVolumeClaim)
+		p.newPersistentVolumeClaim(eventType, o)
+	case *v1.PersistentVolume:
+		o := (drift).(*v1.PersistentVolume)
+		p.newPersistentVolume(eventType, o)
+	case *storagev1.StorageClass:
+		o := (drift).(*storagev1.StorageClass)
+		p.newStorageClass(eventType, o)
+	case *rbacv1.Role:
+		o := (drift).(*rbacv1.Role)
+		p.newRole(eventType, o)
+	case *rbacv1.ClusterRole:
+		o := (drift).(*rbacv1.ClusterRole)
+		p.newClusterRole(eventType, o)
+	case *rbacv1.RoleBinding:
+		o := (drift).(*rbacv1.RoleBinding)
+		p.newRoleBinding(eventType, o)
+	case *rbacv1.ClusterRoleBinding:
+		o := (drift).(*rbacv1.ClusterRoleBinding)
+		p.newClusterRoleBinding(eventType, o)
+	case *v1.Namespace:
+		o := (drift).(*v1.Namespace)
+		p.newNamespace(eventType, o)
+	case *v1.ResourceQuota:
+		o := (drift).(*v1.ResourceQuota)
+		p.newResourceQuota(eventType, o)
+	case *v1.LimitRange:
+		o := (drift).(*v1.LimitRange)
+		p.newLimitRange(eventType, o)
+	case *v1.ConfigMap:
+		o := (drift).(*v1.ConfigMap)
+		p.newConfigMap(eventType, o)
+	case *v1.Secret:
+		o := (drift).(*v1.Secret)
+		p.newSecret(eventType, o)
 	default:
 		klog.Infof("I don't know about type %T!\n", v)
 	}
+	p.redact()
 
 	klog.Infof("%+v", string(p.Marshal()))
 	return p
 }
 
+func newObjectMeta(o metav1.ObjectMeta) ObjectMeta {
+	return ObjectMeta{
+		Name:                       o.Name,
+		GenerateName:               o.GenerateName,
+		Namespace:                  o.Namespace,
+		UID:                        o.UID,
+		ResourceVersion:            o.ResourceVersion,
+		Generation:                 o.Generation,
+		CreationTimestamp:          o.CreationTimestamp,
+		DeletionTimestamp:          o.DeletionTimestamp,
+		DeletionGracePeriodSeconds: o.DeletionGracePeriodSeconds,
+		Labels:                     o.Labels,
+		Annotations:                o.Annotations,
+		OwnerReferences:            o.OwnerReferences,
+		Finalizers:                 o.Finalizers,
+		ClusterName:                o.ClusterName,
+	}
+}
+
 func (p *KubeDrift) newDeployment(eventType string, o *appsv1.Deployment) {
 	p.Type = "deployment"
 	p.EventType = eventType
-	p.MetaData = ObjectMeta{
-		Name:                       o.ObjectMeta.Name,
-		GenerateName:               o.ObjectMeta.GenerateName,
-		Namespace:                  o.ObjectMeta.Namespace,
-		UID:                        o.ObjectMeta.UID,
-		ResourceVersion:            o.ObjectMeta.ResourceVersion,
-		Generation:                 o.ObjectMeta.Generation,
-		CreationTimestamp:          o.ObjectMeta.CreationTimestamp,
-		DeletionTimestamp:          o.ObjectMeta.DeletionTimestamp,
-		DeletionGracePeriodSeconds: o.ObjectMeta.DeletionGracePeriodSeconds,
-		Labels:                     o.ObjectMeta.Labels,
-		Annotations:                o.ObjectMeta.Annotations,
-		OwnerReferences:            o.ObjectMeta.OwnerReferences,
-		Finalizers:                 o.ObjectMeta.Finalizers,
-		ClusterName:                o.ObjectMeta.ClusterName,
-	}
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.ReplicasManager = replicasManager(o.ObjectMeta)
+	p.SetKey()
+}
+
+func (p *KubeDrift) newStatefulSet(eventType string, o *appsv1.StatefulSet) {
+	p.Type = "statefulset"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newDaemonSet(eventType string, o *appsv1.DaemonSet) {
+	p.Type = "daemonset"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newReplicaSet(eventType string, o *appsv1.ReplicaSet) {
+	p.Type = "replicaset"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newJob(eventType string, o *batchv1.Job) {
+	p.Type = "job"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
+	p.Status = o.Status
+	p.SetKey()
+}
+
+func (p *KubeDrift) newCronJob(eventType string, o *batchv1.CronJob) {
+	p.Type = "cronjob"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Spec = o.Spec
 	p.Status = o.Status
 	p.SetKey()
 }
@@ -140,27 +288,12 @@ func (p *KubeDrift) newEvent(eventType string, o *v1.Event) {
 	p.Type = "event"
 	p.EventType = eventType
 	p.newEventDetails(o)
-	p.MetaData = ObjectMeta{
-		Name:                       o.ObjectMeta.Name,
-		GenerateName:               o.ObjectMeta.GenerateName,
-		Namespace:                  o.ObjectMeta.Namespace,
-		UID:                        o.ObjectMeta.UID,
-		ResourceVersion:            o.ObjectMeta.ResourceVersion,
-		Generation:                 o.ObjectMeta.Generation,
-		CreationTimestamp:          o.ObjectMeta.CreationTimestamp,
-		DeletionTimestamp:          o.ObjectMeta.DeletionTimestamp,
-		DeletionGracePeriodSeconds: o.ObjectMeta.DeletionGracePeriodSeconds,
-		Labels:                     o.ObjectMeta.Labels,
-		Annotations:                o.ObjectMeta.Annotations,
-		OwnerReferences:            o.ObjectMeta.OwnerReferences,
-		Finalizers:                 o.ObjectMeta.Finalizers,
-		ClusterName:                o.ObjectMeta.ClusterName,
-	}
+	p.MetaData = newObjectMeta(o.ObjectMeta)
 	p.SetKey()
 }
 
 func (p *KubeDrift) newEventDetails(o *v1.Event) {
-	p.Event = Event{
+	p.Event = normalizeEvent(Event{
 		InvolvedObject:      o.InvolvedObject,
 		Reason:              o.Reason,
 		Message:             o.Message,
@@ -175,28 +308,13 @@ func (p *KubeDrift) newEventDetails(o *v1.Event) {
 		Related:             o.Related,
 		ReportingController: o.ReportingController,
 		ReportingInstance:   o.ReportingInstance,
-	}
+	})
 }
 
 func (p *KubeDrift) newNode(eventType string, o *v1.Node) {
 	p.Type = "node"
 	p.EventType = eventType
-	p.MetaData = ObjectMeta{
-		Name:                       o.ObjectMeta.Name,
-		GenerateName:               o.ObjectMeta.GenerateName,
-		Namespace:                  o.ObjectMeta.Namespace,
-		UID:                        o.ObjectMeta.UID,
-		ResourceVersion:            o.ObjectMeta.ResourceVersion,
-		Generation:                 o.ObjectMeta.Generation,
-		CreationTimestamp:          o.ObjectMeta.CreationTimestamp,
-		DeletionTimestamp:          o.ObjectMeta.DeletionTimestamp,
-		DeletionGracePeriodSeconds: o.ObjectMeta.DeletionGracePeriodSeconds,
-		Labels:                     o.ObjectMeta.Labels,
-		Annotations:                o.ObjectMeta.Annotations,
-		OwnerReferences:            o.ObjectMeta.OwnerReferences,
-		Finalizers:                 o.ObjectMeta.Finalizers,
-		ClusterName:                o.ObjectMeta.ClusterName,
-	}
+	p.MetaData = newObjectMeta(o.ObjectMeta)
 	p.Status = o.Status
 	p.SetKey()
 }
@@ -204,23 +322,43 @@ func (p *KubeDrift) newNode(eventType string, o *v1.Node) {
 func (p *KubeDrift) newPod(eventType string, o v1.Pod) {
 	p.Type = "pod"
 	p.EventType = eventType
-	p.MetaData = ObjectMeta{
-		Name:                       o.ObjectMeta.Name,
-		GenerateName:               o.ObjectMeta.GenerateName,
-		Namespace:                  o.ObjectMeta.Namespace,
-		UID:                        o.ObjectMeta.UID,
-		ResourceVersion:            o.ObjectMeta.ResourceVersion,
-		Generation:                 o.ObjectMeta.Generation,
-		CreationTimestamp:          o.ObjectMeta.CreationTimestamp,
-		DeletionTimestamp:          o.ObjectMeta.DeletionTimestamp,
-		DeletionGracePeriodSeconds: o.ObjectMeta.DeletionGracePeriodSeconds,
-		Labels:                     o.ObjectMeta.Labels,
-		Annotations:                o.ObjectMeta.Annotations,
-		OwnerReferences:            o.ObjectMeta.OwnerReferences,
-		Finalizers:                 o.ObjectMeta.Finalizers,
-		ClusterName:                o.ObjectMeta.ClusterName,
-	}
+	p.MetaData = newObjectMeta(o.ObjectMeta)
 	p.Status = o.Status
+	p.Images = containerImages(o)
+	p.ConfigRefs = configRefs(o)
+	p.Claims = volumeClaims(o)
+	p.NodeName = o.Spec.NodeName
+	p.SetKey()
+}
+
+func (p *KubeDrift) newConfigMap(eventType string, o *v1.ConfigMap) {
+	p.Type = "configmap"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.Data = map[string]string{}
+	for k, v := range o.Data {
+		p.Data[k] = v
+	}
+	for k, v := range o.BinaryData {
+		p.Data[k] = hashValue(v)
+	}
+	p.SetKey()
+}
+
+// newSecret records only a keyed hash of each secret value, never the value
+// itself.
+func (p *KubeDrift) newSecret(eventType string, o *v1.Secret) {
+	p.Type = "secret"
+	p.EventType = eventType
+	p.MetaData = newObjectMeta(o.ObjectMeta)
+	p.MetaData.Annotations = withoutLastApplied(o.Annotations)
+	p.Data = map[string]string{}
+	for k, v := range o.Data {
+		p.Data[k] = hashSecret(v)
+	}
+	for k, v := range o.StringData {
+		p.Data[k] = hashSecret([]byte(v))
+	}
 	p.SetKey()
 }
 
@@ -241,19 +379,16 @@ func Marshal(e v1.Event) string {
 }
 
 func (p *KubeDrift) Serialize() []byte {
-	buf := bytes.Buffer{}
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(p)
+	data, err := DefaultCodec.Marshal(p)
 	if err != nil {
 		fmt.Printf("error encoding object: %v", err)
 	}
-	return buf.Bytes()
+	return data
 }
 
 func Deserialize(data []byte) KubeDrift {
 	obj := KubeDrift{}
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&obj)
+	err := Unmarshal(data, &obj)
 	if err != nil {
 		fmt.Printf("error decoding object: %v", err)
 	}
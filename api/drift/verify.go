@@ -0,0 +1,176 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"k8s.io/klog/v2"
+)
+
+// Entries failing verification are moved under /quarantine, keeping their
+// original key and raw value, so they can be inspected or restored by hand.
+const quarantinePrefix = "/quarantine"
+
+// VerifyProblem is an entry that failed verification.
+type VerifyProblem struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	Action  string `json:"action,omitempty"`
+}
+
+// VerifyReport is the result of verifying a store.
+type VerifyReport struct {
+	Checked  int             `json:"checked"`
+	Problems []VerifyProblem `json:"problems"`
+	Repaired bool            `json:"repaired"`
+}
+
+// Verify checks that every entry of the store decodes, that history delta
+// chains apply, and that the secondary indexes match the records. With repair,
+// undecodable entries are quarantined, stale index entries are deleted and
+// missing ones are added, in a single batch. Entries sealed with a key the
+// store does not hold are reported but never quarantined, and neither are the
+// index entries of such records, since they cannot be checked without the key.
+func (s *Store) Verify(repair bool) (VerifyReport, error) {
+	report := VerifyReport{Repaired: repair}
+
+	snap, err := s.db.GetSnapshot()
+	if err != nil {
+		return report, err
+	}
+	defer snap.Release()
+
+	batch := new(leveldb.Batch)
+	problem := func(key, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, VerifyProblem{Key: key, Problem: fmt.Sprintf(format, args...)})
+	}
+	quarantine := func(key string, value []byte) {
+		report.Problems[len(report.Problems)-1].Action = "quarantined"
+		batch.Put([]byte(quarantinePrefix+key), append([]byte{}, value...))
+		batch.Delete([]byte(key))
+	}
+
+	docs := map[string][]byte{}
+	wantIndex := map[string]bool{}
+	sealedRecords := map[string]bool{}
+	var indexEntries []string
+
+	iter := snap.NewIterator(nil, nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		value := iter.Value()
+		report.Checked++
+
+		switch {
+		case strings.HasPrefix(key, quarantinePrefix+"/"):
+			report.Checked--
+		case strings.HasPrefix(key, indexPrefix):
+			indexEntries = append(indexEntries, key)
+		case key == schemaVersionKey:
+			if _, err := strconv.Atoi(string(value)); err != nil {
+				problem(key, "invalid schema version %q", value)
+			}
+		case s.missingKey(value) != "":
+			problem(key, "sealed with key %q, unreadable without it", s.missingKey(value))
+			if isRecordKey(key) {
+				sealedRecords[key] = true
+			}
+		case strings.HasPrefix(key, "/history/"):
+			rec, err := s.decodeVersion(value)
+			if err == nil {
+				_, err = versionDoc(historyObjectPrefix(key), rec, docs)
+			}
+			if err != nil {
+				problem(key, "undecodable version: %v", err)
+				quarantine(key, value)
+			}
+		case isRecordKey(key):
+			drift := KubeDrift{}
+			if err := s.unmarshal(value, &drift); err != nil {
+				problem(key, "undecodable record: %v", err)
+				quarantine(key, value)
+				continue
+			}
+			if drift.GetKey() != key {
+				problem(key, "record of %s stored under the wrong key", drift.GetKey())
+				quarantine(key, value)
+				continue
+			}
+			for _, k := range s.indexKeys(drift) {
+				wantIndex[k] = true
+			}
+		default:
+			doc, err := s.decode(value)
+			if err == nil && !json.Valid(doc) {
+				err = fmt.Errorf("invalid JSON")
+			}
+			if err != nil {
+				problem(key, "undecodable value: %v", err)
+				quarantine(key, value)
+			}
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return report, err
+	}
+
+	for _, k := range indexEntries {
+		if sealedRecords[indexedRecordKey(k)] {
+			continue
+		}
+		if wantIndex[k] {
+			delete(wantIndex, k)
+			continue
+		}
+		problem(k, "index entry does not match its record")
+		report.Problems[len(report.Problems)-1].Action = "deleted"
+		batch.Delete([]byte(k))
+	}
+	for _, k := range keys(wantIndex) {
+		problem(k, "index entry missing")
+		report.Problems[len(report.Problems)-1].Action = "added"
+		batch.Put([]byte(k), nil)
+	}
+
+	if !repair {
+		for i := range report.Problems {
+			report.Problems[i].Action = ""
+		}
+		return report, nil
+	}
+	if batch.Len() > 0 {
+		if err := s.writeBatch(batch); err != nil {
+			return report, err
+		}
+		klog.Infof("verify: repaired %d problems", len(report.Problems))
+	}
+	return report, nil
+}
+
+// missingKey returns the id of the key value is sealed with, if the store does
+// not hold it.
+func (s *Store) missingKey(value []byte) string {
+	id, ok := sealedWith(value)
+	if !ok || (s.keys != nil && s.keys.aeads[id] != nil) {
+		return ""
+	}
+	return id
+}
+
+// indexedRecordKey returns the key of the record an index entry points to.
+func indexedRecordKey(entry string) string {
+	entry = strings.TrimPrefix(entry, indexPrefix)
+	// skip the index name and its escaped value
+	for i := 0; i < 2; i++ {
+		j := strings.Index(entry, "/")
+		if j < 0 {
+			return ""
+		}
+		entry = entry[j+1:]
+	}
+	return "/" + entry
+}
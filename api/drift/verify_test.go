@@ -0,0 +1,119 @@
+package provider
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAndRepair(t *testing.T) {
+	store := newTestStore(t)
+	web := indexedPod("web-1", "node-7", "uid-rs")
+	if err := store.Save(web); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(indexedPod("web-2", "node-7", "uid-rs")); err != nil {
+		t.Fatal(err)
+	}
+
+	if report, err := store.Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("expected a clean store, got %+v, %v", report, err)
+	}
+
+	// a torn record, an index entry for a record that was never written and a
+	// lost index entry
+	store.db.Put([]byte("/pod/default/web-3/uid-web-3"), []byte("KD\x01\x00\x01garbage"), nil)
+	store.db.Put([]byte(indexKeyPrefix(indexNode, "node-7")+"/pod/default/ghost/uid-ghost"), nil, nil)
+	store.db.Delete([]byte(indexKeyPrefix(indexNode, "node-7")+web.GetKey()), nil)
+
+	report, err := store.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 3 {
+		t.Fatalf("expected 3 problems, got %+v", report.Problems)
+	}
+	if ok, _ := store.db.Has([]byte("/pod/default/web-3/uid-web-3"), nil); !ok {
+		t.Fatal("verify without repair changed the store")
+	}
+
+	if _, err := store.Verify(true); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = store.Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("expected a clean store after repair, got %+v, %v", report.Problems, err)
+	}
+	if ok, _ := store.db.Has([]byte(quarantinePrefix+"/pod/default/web-3/uid-web-3"), nil); !ok {
+		t.Error("torn record was not quarantined")
+	}
+	if got := queryNames(t, store, IndexQuery{Node: "node-7"}); got != "web-1,web-2" {
+		t.Errorf("pods on node-7 after repair: got %s", got)
+	}
+}
+
+func TestVerifyKeepsSealedValuesWithoutKeys(t *testing.T) {
+	store := newTestStore(t)
+	keys, err := NewKeyring(map[string][]byte{"k1": testKey(1)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SetKeyring(keys)
+	web := indexedPod("web-1", "node-7", "uid-rs")
+	if err := store.Save(web); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetKeyring(nil)
+	report, err := store.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) == 0 {
+		t.Fatal("expected the sealed record to be reported")
+	}
+	for _, p := range report.Problems {
+		if !strings.Contains(p.Problem, `sealed with key "k1"`) || p.Action != "" {
+			t.Errorf("expected only unreadable sealed values, left in place, got %+v", p)
+		}
+	}
+	if ok, _ := store.db.Has([]byte(web.GetKey()), nil); !ok {
+		t.Error("sealed record was quarantined")
+	}
+
+	store.SetKeyring(keys)
+	if report, err = store.Verify(false); err != nil || len(report.Problems) != 0 {
+		t.Errorf("expected a clean store with the key, got %+v, %v", report.Problems, err)
+	}
+}
+
+func TestNewRecoversCorruptedStore(t *testing.T) {
+	dir := t.TempDir()
+	store := &Store{}
+	if err := store.New(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(indexedPod("web-1", "node-7", "uid-rs")); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	manifests, _ := filepath.Glob(filepath.Join(dir, "MANIFEST-*"))
+	if len(manifests) == 0 {
+		t.Fatal("no manifest")
+	}
+	for _, m := range manifests {
+		if err := ioutil.WriteFile(m, []byte(strings.Repeat("\xff", 64)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recovered := &Store{}
+	if err := recovered.New(dir); err != nil {
+		t.Fatalf("expected the store to be recovered, got %v", err)
+	}
+	defer recovered.Close()
+	if _, err := recovered.GetDriftByKey("/pod/default/web-1/uid-web-1"); err != nil {
+		t.Errorf("record lost in recovery: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package provider
+
+import (
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func podTemplate(image string) v1.PodTemplateSpec {
+	return v1.PodTemplateSpec{
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "web",
+				Image: image,
+				Env:   []v1.EnvVar{{Name: "DB_PASSWORD", Value: "hunter2"}},
+			}},
+		},
+	}
+}
+
+func ownedBy(kind, name, uid string) []metav1.OwnerReference {
+	controller := true
+	return []metav1.OwnerReference{{Kind: kind, Name: name, UID: types.UID(uid), Controller: &controller}}
+}
+
+func TestDeploymentRollout(t *testing.T) {
+	store := newTestStore(t)
+
+	for _, image := range []string{"nginx:1.21", "nginx:1.22"} {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", UID: "uid-deploy"},
+			Spec:       appsv1.DeploymentSpec{Template: podTemplate(image)},
+		}
+		if err := store.Save(*New(deployment, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rs := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "web-5d4f", Namespace: "default", UID: "uid-rs",
+			OwnerReferences: ownedBy("Deployment", "web", "uid-deploy")},
+		Spec: appsv1.ReplicaSetSpec{Template: podTemplate("nginx:1.22")},
+	}
+	if err := store.Save(*New(rs, "update")); err != nil {
+		t.Fatal(err)
+	}
+	pod := testPod("web-1", "nginx:1.22", "")
+	pod.OwnerReferences = ownedBy("ReplicaSet", "web-5d4f", "uid-rs")
+	if err := store.Save(*New(pod, "update")); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs, err := store.GetDiffs("deployment", "default", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 1 || len(diffs[0].Changes) != 1 || diffs[0].Changes[0].Path != "$.spec.template.spec.containers[0].image" {
+		t.Fatalf("expected the image change of the rollout, got %+v", diffs)
+	}
+
+	drift, err := store.GetDriftByKey("/replicaset/default/web-5d4f/uid-rs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := drift.Marshal(); strings.Contains(s, "hunter2") {
+		t.Errorf("env value of the pod template was stored: %s", s)
+	}
+
+	// the pod is owned by the replica set, owned in turn by the deployment
+	if got := queryNames(t, store, IndexQuery{Owner: "uid-deploy"}); got != "web-1,web-5d4f" {
+		t.Errorf("records owned by the deployment: got %s", got)
+	}
+}
+
+func TestJobRecords(t *testing.T) {
+	store := newTestStore(t)
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "batch", UID: "uid-cron"},
+		Spec: batchv1.CronJobSpec{
+			Schedule:    "0 * * * *",
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: podTemplate("report:1.0")}},
+		},
+	}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "report-1", Namespace: "batch", UID: "uid-job",
+			OwnerReferences: ownedBy("CronJob", "report", "uid-cron")},
+		Status: batchv1.JobStatus{Failed: 1},
+	}
+	for _, obj := range []interface{}{cronJob, job} {
+		if err := store.Save(*New(obj, "update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	drifts, err := store.GetDriftByKeyPrefix("/cronjob/batch")
+	if err != nil || len(drifts) != 1 {
+		t.Fatalf("expected the cron job, got %+v, %v", drifts, err)
+	}
+	if s := drifts[0].Marshal(); !strings.Contains(s, `"schedule":"0 * * * *"`) || strings.Contains(s, "hunter2") {
+		t.Errorf("unexpected cron job record %s", s)
+	}
+	if got := queryNames(t, store, IndexQuery{Owner: "uid-cron"}); got != "report-1" {
+		t.Errorf("records owned by the cron job: got %s", got)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DriftPolicySpec defines which objects are recorded, which of their fields
+// are ignored when comparing versions and the severity of the findings
+// raised about them.
+type DriftPolicySpec struct {
+	// Targets select the objects recorded. An object is recorded when it
+	// matches a target of any policy applying to it, or when no policy
+	// applying to it has targets. Kinds no object can be targeted in are
+	// not watched.
+	// +optional
+	Targets []DriftTarget `json:"targets,omitempty"`
+
+	// IgnoreFields are removed from the records of the objects the policy
+	// applies to before they are compared or diffed.
+	// +optional
+	IgnoreFields []IgnoreField `json:"ignoreFields,omitempty"`
+
+	// SeverityRules override the severity of findings. The first matching
+	// rule applies, the rules of a DriftPolicy before those of a
+	// ClusterDriftPolicy.
+	// +optional
+	SeverityRules []SeverityRule `json:"severityRules,omitempty"`
+}
+
+// DriftTarget selects objects by kind, namespace and labels. Empty fields
+// match every object.
+type DriftTarget struct {
+	// Kinds of the objects selected, e.g. Deployment or deployment. A policy
+	// with a kind kube-drift does not watch is invalid and not applied.
+	// +optional
+	Kinds []string `json:"kinds,omitempty"`
+
+	// Namespaces of the objects selected. Ignored by a DriftPolicy, which
+	// only selects objects in its own namespace.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Selector matches the labels of the objects selected.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// IgnoreField is a field of the records of a kind ignored when they are
+// compared or diffed.
+type IgnoreField struct {
+	// Kind of the records, or * for all kinds.
+	// +kubebuilder:default="*"
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Path of the field as a JSONPath rooted at the record, e.g.
+	// $.status.conditions[*].lastProbeTime.
+	Path string `json:"path"`
+}
+
+// SeverityRule sets the severity of the findings of a type about objects of
+// a kind.
+type SeverityRule struct {
+	// FindingType matched, e.g. ImageDigestChanged, or * for all types.
+	// +kubebuilder:default="*"
+	// +optional
+	FindingType string `json:"findingType,omitempty"`
+
+	// Kind of the objects matched, or * for all kinds.
+	// +kubebuilder:default="*"
+	// +optional
+	Kind string `json:"kind,omitempty"`
+
+	// Severity of the findings matched. None disables them.
+	// +kubebuilder:validation:Enum=info;warning;critical;none
+	Severity string `json:"severity"`
+}
+
+// DriftPolicyStatus defines the observed state of a policy.
+type DriftPolicyStatus struct {
+	// ObservedGeneration is the generation of the policy last applied.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions of the policy. Ready is true while the policy is applied.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// DriftPolicy configures the recording of the objects of its namespace.
+type DriftPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DriftPolicySpec   `json:"spec,omitempty"`
+	Status DriftPolicyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DriftPolicyList contains a list of DriftPolicy
+type DriftPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DriftPolicy `json:"items"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// ClusterDriftPolicy configures the recording of objects in every namespace
+// and of cluster-scoped objects.
+type ClusterDriftPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DriftPolicySpec   `json:"spec,omitempty"`
+	Status DriftPolicyStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterDriftPolicyList contains a list of ClusterDriftPolicy
+type ClusterDriftPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterDriftPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DriftPolicy{}, &DriftPolicyList{}, &ClusterDriftPolicy{}, &ClusterDriftPolicyList{})
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DriftReportSpec defines which drift a report summarises.
+type DriftReportSpec struct {
+	// Policy is the name of a DriftPolicy in the namespace of the report.
+	// When set, the report only lists the objects its targets select.
+	// +optional
+	Policy string `json:"policy,omitempty"`
+}
+
+// DriftReportSummary counts the drifted objects of a report by severity.
+type DriftReportSummary struct {
+	Critical int `json:"critical"`
+	Warning  int `json:"warning"`
+	Info     int `json:"info"`
+}
+
+// DriftedObject is an object with a finding currently raised about it.
+type DriftedObject struct {
+	Kind        string      `json:"kind"`
+	Name        string      `json:"name"`
+	FindingType string      `json:"findingType"`
+	Severity    string      `json:"severity"`
+	Message     string      `json:"message,omitempty"`
+	FirstSeen   metav1.Time `json:"firstSeen"`
+	LastSeen    metav1.Time `json:"lastSeen"`
+}
+
+// DriftReportStatus lists the currently drifted objects, most severe and
+// oldest first.
+type DriftReportStatus struct {
+	// +optional
+	Summary DriftReportSummary `json:"summary,omitempty"`
+
+	// Objects lists at most 500 drifted objects. The summary counts them all.
+	// +optional
+	Objects []DriftedObject `json:"objects,omitempty"`
+
+	// LastUpdated is when the drifted objects last changed.
+	// +optional
+	LastUpdated *metav1.Time `json:"lastUpdated,omitempty"`
+
+	// Conditions of the report. Ready is false while the report cannot be
+	// updated, such as when its policy is not applied.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Policy",type=string,JSONPath=`.spec.policy`
+//+kubebuilder:printcolumn:name="Critical",type=integer,JSONPath=`.status.summary.critical`
+//+kubebuilder:printcolumn:name="Warning",type=integer,JSONPath=`.status.summary.warning`
+//+kubebuilder:printcolumn:name="Info",type=integer,JSONPath=`.status.summary.info`
+//+kubebuilder:printcolumn:name="Updated",type=date,JSONPath=`.status.lastUpdated`
+
+// DriftReport summarises the drift detected in its namespace.
+type DriftReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DriftReportSpec   `json:"spec,omitempty"`
+	Status DriftReportStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// DriftReportList contains a list of DriftReport
+type DriftReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []DriftReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&DriftReport{}, &DriftReportList{})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+)
+
+// commands run offline against a store that no manager has open, e.g.
+//
+//	kube-drift export --db /tmp/kube-drift --kind pod --gzip --out pods.tar.gz
+//	kube-drift import --db /tmp/kube-drift --in pods.tar.gz
+//	kube-drift verify --db /tmp/kube-drift --repair
+//	kube-drift verify-chain --db /tmp/kube-drift
+//	kube-drift reencrypt --db /tmp/kube-drift --encryption-key-file /etc/kube-drift/keys --encryption-key-id k2
+//	kube-drift permissions-report --db /tmp/kube-drift --since 2021-10-01T00:00:00Z
+//
+// A running manager serves the same through GET /export, POST /import,
+// GET /chain/verify, GET /permissions/report and, without repairs, GET /verify. A manager re-encrypts
+// its store in the background at startup.
+var commands = map[string]func(args []string) error{
+	"export":             exportCommand,
+	"import":             importCommand,
+	"verify":             verifyCommand,
+	"verify-chain":       verifyChainCommand,
+	"reencrypt":          reencryptCommand,
+	"permissions-report": permissionsReportCommand,
+}
+
+// runCommand runs the command named by args[0], if there is one, and reports
+// whether it did.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd(args[1:])
+}
+
+// keyFlags are the flags of the encryption keys of a store.
+type keyFlags struct {
+	file *string
+	id   *string
+}
+
+func addKeyFlags(fs *flag.FlagSet) keyFlags {
+	return keyFlags{
+		file: fs.String("encryption-key-file", "", "File or directory of the keys the store is encrypted with."),
+		id:   fs.String("encryption-key-id", "", "Id of the key new values are encrypted with."),
+	}
+}
+
+func openStore(path string, keys keyFlags) (*provider.Store, error) {
+	store := &provider.Store{}
+	if err := store.New(path); err != nil {
+		return nil, fmt.Errorf("unable to open store %s: %v", path, err)
+	}
+	if *keys.file != "" {
+		keyring, err := provider.LoadKeyring(*keys.file, *keys.id)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("unable to load encryption keys: %v", err)
+		}
+		store.SetKeyring(keyring)
+	}
+	return store, nil
+}
+
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to export.")
+	out := fs.String("out", "-", "File to write the archive to, - for stdout. Archives are not encrypted.")
+	kind := fs.String("kind", "", "Only export records of this kind.")
+	namespace := fs.String("namespace", "", "Only export records of this namespace.")
+	since := fs.String("since", "", "Only export records observed at or after this RFC 3339 time.")
+	until := fs.String("until", "", "Only export records observed before this RFC 3339 time.")
+	compress := fs.Bool("gzip", false, "Gzip the archive.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, err := provider.ParseExportFilter(url.Values{
+		"kind":      {*kind},
+		"namespace": {*namespace},
+		"since":     {*since},
+		"until":     {*until},
+	})
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	manifest, err := store.Export(w, filter, *compress)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records, sha256 %s\n", manifest.Records, manifest.SHA256)
+	return nil
+}
+
+func importCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to import into.")
+	in := fs.String("in", "-", "File to read the archive from, - for stdin.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if _, err := store.Migrate(false); err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	manifest, err := store.Import(r)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported %d records\n", manifest.Records)
+	return nil
+}
+
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to verify.")
+	repair := fs.Bool("repair", false,
+		"Quarantine undecodable entries under /quarantine and rebuild mismatched index entries.")
+	indexLabels := fs.String("index-labels", strings.Join(provider.DefaultIndexedLabels, ","),
+		"Comma separated labels records are indexed by, as configured for the manager.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	store.SetIndexedLabels(strings.Split(*indexLabels, ","))
+
+	report, err := store.Verify(*repair)
+	if err != nil {
+		return err
+	}
+	for _, p := range report.Problems {
+		if p.Action != "" {
+			fmt.Printf("%s: %s (%s)\n", p.Key, p.Problem, p.Action)
+		} else {
+			fmt.Printf("%s: %s\n", p.Key, p.Problem)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "checked %d entries, %d problems\n", report.Checked, len(report.Problems))
+	if len(report.Problems) > 0 && !*repair {
+		return fmt.Errorf("store %s failed verification, run with --repair to quarantine bad entries", *db)
+	}
+	return nil
+}
+
+func verifyChainCommand(args []string) error {
+	fs := flag.NewFlagSet("verify-chain", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to verify.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.VerifyChain()
+	if err != nil {
+		return err
+	}
+	for _, object := range report.Truncated {
+		fmt.Printf("%s: history truncated by retention\n", object)
+	}
+	for _, b := range report.Breaks {
+		fmt.Printf("%s: %s\n", b.Key, b.Problem)
+	}
+	fmt.Fprintf(os.Stderr, "verified %d versions of %d objects (%d unchained) and %d checkpoints, latest %s\n",
+		report.Versions, report.Objects, report.Unchained, report.Checkpoints, report.LatestCheckpoint)
+	if len(report.Breaks) > 0 {
+		return fmt.Errorf("history of store %s has %d chain breaks", *db, len(report.Breaks))
+	}
+	return nil
+}
+
+func reencryptCommand(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to re-encrypt.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *keys.file == "" {
+		return fmt.Errorf("--encryption-key-file is required")
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	n, err := store.Reencrypt(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "re-encrypted %d values\n", n)
+	return nil
+}
+
+func permissionsReportCommand(args []string) error {
+	fs := flag.NewFlagSet("permissions-report", flag.ExitOnError)
+	db := fs.String("db", "/tmp/kube-drift", "Path of the store to report on.")
+	since := fs.String("since", "", "Only report changes made at or after this RFC 3339 time.")
+	until := fs.String("until", "", "Only report changes made before this RFC 3339 time.")
+	asJSON := fs.Bool("json", false, "Write the report as JSON.")
+	keys := addKeyFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filter, err := provider.ParseExportFilter(url.Values{"since": {*since}, "until": {*until}})
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(*db, keys)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.GetPermissionReport(filter.Since, filter.Until)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	for _, subject := range report.Subjects {
+		fmt.Println(subject.Subject)
+		for _, p := range subject.Gained {
+			fmt.Printf("  + %s\n", p)
+		}
+		for _, p := range subject.Lost {
+			fmt.Printf("  - %s\n", p)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d permission changes of %d subjects\n", report.Changes, len(report.Subjects))
+	return nil
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ClusterRoleBindingReconciler reconciles a ClusterRoleBinding object
+type ClusterRoleBindingReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	store  *provider.Store
+}
+
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings,verbs=get;list;watch
+
+// Reconcile records a ClusterRoleBinding, or its deletion, tracking the permissions of its subjects.
+func (r *ClusterRoleBindingReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	_ = log.FromContext(ctx)
+
+	var clusterRoleBinding rbacv1.ClusterRoleBinding
+	if err := r.Get(ctx, req.NamespacedName, &clusterRoleBinding); err != nil {
+		return recordDeletion(ctx, r.store, "clusterrolebinding", req, err)
+	}
+	fmt.Printf("Reconciling ClusterRoleBinding %s\n", req.NamespacedName)
+
+	kubedrift := provider.New(&clusterRoleBinding, "update")
+	if err := r.store.Write(ctx, *kubedrift); err != nil {
+		// requeued with backoff, so a failed or rejected write is retried
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,35 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// recordDeletion handles the error of getting the object of req: an object
+// that is gone is recorded as deleted, so that the detectors no longer count
+// it as live, and any other error is returned to requeue req.
+func recordDeletion(ctx context.Context, store *provider.Store, kind string, req ctrl.Request, err error) (ctrl.Result, error) {
+	if !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, store.WriteDeletion(ctx, kind, req.Namespace, req.Name)
+}
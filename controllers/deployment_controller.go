@@ -19,6 +19,7 @@ package controllers
 import (
 	"context"
 	"fmt"
+	provider "github.com/hugomatus/kube-drift/api/drift"
 	appsv1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -30,6 +31,7 @@ import (
 type DeploymentReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	store  *provider.Store
 }
 
 //+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
@@ -52,17 +54,15 @@ func (r *DeploymentReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	var deployment appsv1.Deployment
 
 	if err := r.Get(ctx, req.NamespacedName, &deployment); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return recordDeletion(ctx, r.store, "deployment", req, err)
 	}
 
 	fmt.Printf("Reconciling Deployment %s/%s\n", deployment.Namespace, deployment.Name)
 
+	kubedrift := provider.New(&deployment, "update")
+	if err := r.store.Write(ctx, *kubedrift); err != nil {
+		// requeued with backoff, so a failed or rejected write is retried
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
-
-// SetupWithManager sets up the controller with the Manager.
-func (r *DeploymentReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&appsv1.Deployment{}).
-		Complete(r)
-}
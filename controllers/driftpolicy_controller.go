@@ -0,0 +1,163 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	driftv1alpha1 "github.com/hugomatus/kube-drift/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// DriftPolicyReconciler reconciles DriftPolicy and ClusterDriftPolicy objects
+type DriftPolicyReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	store    *provider.Store
+	watchers *Watchers
+}
+
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=driftpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=driftpolicies/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=clusterdriftpolicies,verbs=get;list;watch
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=clusterdriftpolicies/status,verbs=get;update;patch
+
+// Reconcile applies every valid policy to the store whenever one changes,
+// starting and stopping the watchers of the kinds they target, and reports on
+// the changed policy whether it is applied. Cluster policies are
+// reconciled under an empty namespace.
+func (r *DriftPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	_ = log.FromContext(ctx)
+	fmt.Printf("Reconciling DriftPolicy %s\n", req.NamespacedName)
+
+	var policies driftv1alpha1.DriftPolicyList
+	if err := r.List(ctx, &policies); err != nil {
+		return ctrl.Result{}, err
+	}
+	var clusterPolicies driftv1alpha1.ClusterDriftPolicyList
+	if err := r.List(ctx, &clusterPolicies); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var applied []provider.Policy
+	var reqErr error
+	for _, p := range policies.Items {
+		policy, err := newPolicy(p.Name, p.Namespace, p.Spec)
+		if p.Namespace == req.Namespace && p.Name == req.Name {
+			reqErr = err
+		}
+		if err != nil {
+			continue
+		}
+		applied = append(applied, policy)
+	}
+	for _, p := range clusterPolicies.Items {
+		policy, err := newPolicy(p.Name, "", p.Spec)
+		if req.Namespace == "" && p.Name == req.Name {
+			reqErr = err
+		}
+		if err != nil {
+			continue
+		}
+		applied = append(applied, policy)
+	}
+	r.store.SetPolicies(applied)
+	if err := r.watchers.Reconfigure(); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var obj client.Object
+	var status *driftv1alpha1.DriftPolicyStatus
+	if req.Namespace == "" {
+		p := &driftv1alpha1.ClusterDriftPolicy{}
+		obj, status = p, &p.Status
+	} else {
+		p := &driftv1alpha1.DriftPolicy{}
+		obj, status = p, &p.Status
+	}
+	if err := r.Get(ctx, req.NamespacedName, obj); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	condition := metav1.Condition{
+		Type:               "Ready",
+		Status:             metav1.ConditionTrue,
+		Reason:             "Applied",
+		Message:            "policy is applied",
+		ObservedGeneration: obj.GetGeneration(),
+	}
+	if reqErr != nil {
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "Invalid", reqErr.Error()
+	}
+	status.ObservedGeneration = obj.GetGeneration()
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return ctrl.Result{}, r.Status().Update(ctx, obj)
+}
+
+// newPolicy converts the spec of a policy to the policy applied by the store.
+func newPolicy(name, namespace string, spec driftv1alpha1.DriftPolicySpec) (provider.Policy, error) {
+	policy := provider.Policy{Name: name, Namespace: namespace}
+	for _, t := range spec.Targets {
+		target := provider.PolicyTarget{Kinds: t.Kinds, Namespaces: t.Namespaces}
+		if t.Selector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(t.Selector)
+			if err != nil {
+				return policy, fmt.Errorf("invalid selector: %v", err)
+			}
+			target.Selector = selector
+		}
+		policy.Targets = append(policy.Targets, target)
+	}
+	for _, f := range spec.IgnoreFields {
+		// records are typed by the lower case kind of their object
+		kind := strings.ToLower(f.Kind)
+		if kind == "" {
+			kind = "*"
+		}
+		policy.IgnoreRules = append(policy.IgnoreRules, provider.IgnoreRule{Kind: kind, Path: f.Path})
+	}
+	for _, rule := range spec.SeverityRules {
+		policy.SeverityRules = append(policy.SeverityRules, provider.SeverityRule{
+			FindingType: rule.FindingType,
+			Kind:        rule.Kind,
+			Severity:    rule.Severity,
+		})
+	}
+	return policy, policy.Validate()
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DriftPolicyReconciler) SetupWithManager(mgr ctrl.Manager, store *provider.Store, watchers *Watchers) error {
+	r.store = store
+	r.watchers = watchers
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&driftv1alpha1.DriftPolicy{}).
+		Watches(&source.Kind{Type: &driftv1alpha1.ClusterDriftPolicy{}}, &handler.EnqueueRequestForObject{}).
+		// status updates do not change the policies applied
+		WithEventFilter(predicate.GenerationChangedPredicate{}).
+		Complete(r)
+}
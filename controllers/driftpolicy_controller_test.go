@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	driftv1alpha1 "github.com/hugomatus/kube-drift/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDriftPolicyReconciler(t *testing.T) {
+	ctx := context.Background()
+	store := newTestStore(t)
+	policy := func(name string, kinds ...string) *driftv1alpha1.DriftPolicy {
+		return &driftv1alpha1.DriftPolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "team-a", Generation: 1},
+			Spec:       driftv1alpha1.DriftPolicySpec{Targets: []driftv1alpha1.DriftTarget{{Kinds: kinds}}},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).
+		WithObjects(policy("workloads", "Deployment"), policy("typo", "Deploymnet")).Build()
+	// the watchers are not started, so reconfiguring them starts no controller
+	r := &DriftPolicyReconciler{Client: c, Scheme: c.Scheme(), store: store, watchers: &Watchers{Store: store}}
+
+	for _, name := range []string{"workloads", "typo"} {
+		req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "team-a", Name: name}}
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var applied driftv1alpha1.DriftPolicy
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "team-a", Name: "workloads"}, &applied); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(applied.Status.Conditions, "Ready") || applied.Status.ObservedGeneration != 1 {
+		t.Errorf("expected the valid policy to be applied, got %+v", applied.Status)
+	}
+
+	var invalid driftv1alpha1.DriftPolicy
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "team-a", Name: "typo"}, &invalid); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(invalid.Status.Conditions, "Ready")
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "Invalid" ||
+		!strings.Contains(condition.Message, "Deploymnet") {
+		t.Errorf("expected the unknown kind to be reported, got %+v", condition)
+	}
+
+	// only the valid policy is applied, so deployments in team-a are still recorded
+	deployment := provider.KubeDrift{Type: "deployment"}
+	deployment.MetaData.Namespace = "team-a"
+	if !store.Targeted(deployment) {
+		t.Errorf("expected deployments to be targeted by the valid policy")
+	}
+	configMap := provider.KubeDrift{Type: "configmap"}
+	configMap.MetaData.Namespace = "team-a"
+	if store.Targeted(configMap) {
+		t.Errorf("expected config maps not to be targeted")
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	driftv1alpha1 "github.com/hugomatus/kube-drift/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// NamespaceReportName is the name of the DriftReport of a namespace.
+const NamespaceReportName = "kube-drift"
+
+// maxReportObjects bounds the drifted objects listed in the status of a report.
+const maxReportObjects = 500
+
+var reportLog = ctrl.Log.WithName("driftreport")
+
+// DriftReporter keeps a DriftReport in every namespace with findings and for
+// every DriftPolicy, and updates the status of all reports, including those
+// created by users, from the findings of the store.
+type DriftReporter struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Store    *provider.Store
+	Interval time.Duration
+}
+
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=driftreports,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=drift.kubedrift.io,resources=driftreports/status,verbs=get;update;patch
+
+// Start updates the reports every interval until ctx is done.
+func (r *DriftReporter) Start(ctx context.Context) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		if err := r.report(ctx); err != nil {
+			reportLog.Error(err, "unable to update drift reports")
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// report creates the missing namespace and policy reports and updates the
+// status of every report.
+func (r *DriftReporter) report(ctx context.Context) error {
+	var reports driftv1alpha1.DriftReportList
+	if err := r.List(ctx, &reports); err != nil {
+		return err
+	}
+	existing := map[types.NamespacedName]bool{}
+	for _, report := range reports.Items {
+		existing[types.NamespacedName{Namespace: report.Namespace, Name: report.Name}] = true
+	}
+
+	findings, err := r.Store.GetFindings("/")
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		key := types.NamespacedName{Namespace: f.Namespace, Name: NamespaceReportName}
+		// findings about cluster-scoped objects are in no namespace to report in
+		if f.Namespace == "" || f.Namespace == "none" || existing[key] {
+			continue
+		}
+		existing[key] = true
+		report := driftv1alpha1.DriftReport{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+		r.create(ctx, &reports, report)
+	}
+
+	var policies driftv1alpha1.DriftPolicyList
+	if err := r.List(ctx, &policies); err != nil {
+		return err
+	}
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		key := types.NamespacedName{Namespace: policy.Namespace, Name: policy.Name}
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+		report := driftv1alpha1.DriftReport{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+			Spec:       driftv1alpha1.DriftReportSpec{Policy: policy.Name},
+		}
+		// the report of a policy is deleted with it
+		if err := controllerutil.SetControllerReference(policy, &report, r.Scheme); err != nil {
+			reportLog.Error(err, "unable to create drift report", "namespace", key.Namespace, "name", key.Name)
+			continue
+		}
+		r.create(ctx, &reports, report)
+	}
+
+	for i := range reports.Items {
+		if err := r.updateStatus(ctx, &reports.Items[i]); err != nil {
+			reportLog.Error(err, "unable to update drift report", "namespace", reports.Items[i].Namespace,
+				"name", reports.Items[i].Name)
+		}
+	}
+	return nil
+}
+
+// create creates a report and adds it to reports. A report already created,
+// but not yet in the cache reports were listed from, is updated next time. A
+// report that cannot be created is logged and retried next time, so that it
+// does not keep the other reports from being updated.
+func (r *DriftReporter) create(ctx context.Context, reports *driftv1alpha1.DriftReportList, report driftv1alpha1.DriftReport) {
+	if err := r.Create(ctx, &report); err != nil {
+		if !apierrors.IsAlreadyExists(err) {
+			reportLog.Error(err, "unable to create drift report", "namespace", report.Namespace, "name", report.Name)
+		}
+		return
+	}
+	reports.Items = append(reports.Items, report)
+}
+
+// updateStatus lists the drifted objects of a report in its status, updating
+// it only when they changed.
+func (r *DriftReporter) updateStatus(ctx context.Context, report *driftv1alpha1.DriftReport) error {
+	status := *report.Status.DeepCopy()
+	condition := metav1.Condition{
+		Type:               "Ready",
+		Status:             metav1.ConditionTrue,
+		Reason:             "Updated",
+		Message:            "report is up to date",
+		ObservedGeneration: report.Generation,
+	}
+
+	findings, err := r.Store.GetReportFindings(report.Namespace, report.Spec.Policy)
+	if err != nil {
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, "PolicyNotApplied", err.Error()
+	} else {
+		var summary driftv1alpha1.DriftReportSummary
+		var objects []driftv1alpha1.DriftedObject
+		for _, f := range findings {
+			switch f.Severity {
+			case provider.SeverityCritical:
+				summary.Critical++
+			case provider.SeverityWarning:
+				summary.Warning++
+			case provider.SeverityInfo:
+				summary.Info++
+			}
+			if len(objects) == maxReportObjects {
+				continue
+			}
+			objects = append(objects, driftv1alpha1.DriftedObject{
+				Kind:        f.Kind,
+				Name:        f.Name,
+				FindingType: f.Type,
+				Severity:    f.Severity,
+				Message:     f.Message,
+				// status times are serialized to the second
+				FirstSeen: metav1.NewTime(f.FirstSeen.Truncate(time.Second)),
+				LastSeen:  metav1.NewTime(f.LastSeen.Truncate(time.Second)),
+			})
+		}
+		if status.Summary != summary || !equality.Semantic.DeepEqual(status.Objects, objects) || status.LastUpdated == nil {
+			now := metav1.NewTime(time.Now().Truncate(time.Second))
+			status.Summary, status.Objects, status.LastUpdated = summary, objects, &now
+		}
+	}
+	meta.SetStatusCondition(&status.Conditions, condition)
+
+	if equality.Semantic.DeepEqual(status, report.Status) {
+		return nil
+	}
+	report.Status = status
+	return r.Status().Update(ctx, report)
+}
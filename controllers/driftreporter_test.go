@@ -0,0 +1,114 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	driftv1alpha1 "github.com/hugomatus/kube-drift/api/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := driftv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func newTestStore(t *testing.T) *provider.Store {
+	t.Helper()
+	store := &provider.Store{}
+	if err := store.New(t.TempDir()); err != nil {
+		t.Fatalf("error opening store: %v", err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+// failingCreates fails to create objects in a namespace.
+type failingCreates struct {
+	client.Client
+	namespace string
+}
+
+func (c failingCreates) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if obj.GetNamespace() == c.namespace {
+		return errors.New("create rejected")
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestDriftReporter(t *testing.T) {
+	ctx := context.Background()
+	scheme := newTestScheme(t)
+	store := newTestStore(t)
+	for _, f := range []provider.Finding{
+		{Type: "StaleConfig", Severity: provider.SeverityWarning, Kind: "ConfigMap", Namespace: "team-a", Name: "shop"},
+		{Type: "StaleConfig", Severity: provider.SeverityWarning, Kind: "ConfigMap", Namespace: "broken", Name: "shop"},
+		{Type: "PermissionsGained", Severity: provider.SeverityCritical, Kind: "ClusterRole", Namespace: "none", Name: "view"},
+	} {
+		if err := store.SaveFinding(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &driftv1alpha1.DriftPolicy{ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "team-a", UID: "uid-shop"}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(policy).Build()
+	r := &DriftReporter{Client: failingCreates{Client: c, namespace: "broken"}, Scheme: scheme, Store: store}
+
+	if err := r.report(ctx); err != nil {
+		t.Fatalf("expected a failed create not to fail the update of the reports, got %v", err)
+	}
+
+	var reports driftv1alpha1.DriftReportList
+	if err := c.List(ctx, &reports); err != nil {
+		t.Fatal(err)
+	}
+	got := map[types.NamespacedName]driftv1alpha1.DriftReport{}
+	for _, report := range reports.Items {
+		got[types.NamespacedName{Namespace: report.Namespace, Name: report.Name}] = report
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected only the reports of team-a, got %v", got)
+	}
+
+	namespaceReport, ok := got[types.NamespacedName{Namespace: "team-a", Name: NamespaceReportName}]
+	if !ok || namespaceReport.Status.Summary.Warning != 1 || len(namespaceReport.Status.Objects) != 1 ||
+		!meta.IsStatusConditionTrue(namespaceReport.Status.Conditions, "Ready") {
+		t.Errorf("expected the report of team-a to list its finding, got %+v", namespaceReport)
+	}
+
+	policyReport, ok := got[types.NamespacedName{Namespace: "team-a", Name: "shop"}]
+	if !ok || policyReport.Spec.Policy != "shop" || len(policyReport.OwnerReferences) != 1 {
+		t.Fatalf("expected a report owned by the policy, got %+v", policyReport)
+	}
+	// the policy was never applied to the store
+	condition := meta.FindStatusCondition(policyReport.Status.Conditions, "Ready")
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != "PolicyNotApplied" {
+		t.Errorf("expected the report of a policy not applied not to be ready, got %+v", condition)
+	}
+}
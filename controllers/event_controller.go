@@ -19,6 +19,7 @@ package controllers
 import (
 	"context"
 	"fmt"
+	provider "github.com/hugomatus/kube-drift/api/drift"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -30,6 +31,7 @@ import (
 type EventReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	store  *provider.Store
 }
 
 //+kubebuilder:rbac:groups=core,resources=events,verbs=get;list;watch;create;update;patch;delete
@@ -51,15 +53,14 @@ func (r *EventReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	// TODO(user): your logic here
 	event := &corev1.Event{}
 	if err := r.Get(ctx, req.NamespacedName, event); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+		return recordDeletion(ctx, r.store, "event", req, err)
 	}
 	fmt.Printf("Reconciling Event %s/%s\n Reason: %s Message: %s", event.Namespace, event.Name, event.Reason, event.Message)
-	return ctrl.Result{}, nil
-}
 
-// SetupWithManager sets up the controller with the Manager.
-func (r *EventReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Event{}).
-		Complete(r)
+	kubedrift := provider.New(event, "update")
+	if err := r.store.Write(ctx, *kubedrift); err != nil {
+		// requeued with backoff, so a failed or rejected write is retried
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
 }
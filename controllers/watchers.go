@@ -0,0 +1,325 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	provider "github.com/hugomatus/kube-drift/api/drift"
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2beta2 "k8s.io/api/autoscaling/v2beta2"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	eventsv1 "k8s.io/api/events/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+var watchLog = ctrl.Log.WithName("watchers")
+
+// watchedKind is a kind recorded by a controller of its own.
+type watchedKind struct {
+	object     func() client.Object
+	reconciler func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler
+}
+
+// watchedKinds are the controllers of the recorded kinds, by record type. The
+// event controller is chosen by the events API.
+var watchedKinds = map[string]watchedKind{
+	"pod": {
+		object: func() client.Object { return &corev1.Pod{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &PodReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"deployment": {
+		object: func() client.Object { return &appsv1.Deployment{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &DeploymentReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"horizontalpodautoscaler": {
+		object: func() client.Object { return &autoscalingv2beta2.HorizontalPodAutoscaler{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &HorizontalPodAutoscalerReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"statefulset": {
+		object: func() client.Object { return &appsv1.StatefulSet{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &StatefulSetReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"daemonset": {
+		object: func() client.Object { return &appsv1.DaemonSet{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &DaemonSetReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"replicaset": {
+		object: func() client.Object { return &appsv1.ReplicaSet{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ReplicaSetReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"job": {
+		object: func() client.Object { return &batchv1.Job{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &JobReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"cronjob": {
+		object: func() client.Object { return &batchv1.CronJob{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &CronJobReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"service": {
+		object: func() client.Object { return &corev1.Service{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ServiceReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"endpoints": {
+		object: func() client.Object { return &corev1.Endpoints{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &EndpointsReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"endpointslice": {
+		object: func() client.Object { return &discoveryv1.EndpointSlice{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &EndpointSliceReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"ingress": {
+		object: func() client.Object { return &networkingv1.Ingress{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &IngressReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"networkpolicy": {
+		object: func() client.Object { return &networkingv1.NetworkPolicy{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &NetworkPolicyReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"persistentvolumeclaim": {
+		object: func() client.Object { return &corev1.PersistentVolumeClaim{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &PersistentVolumeClaimReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"persistentvolume": {
+		object: func() client.Object { return &corev1.PersistentVolume{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &PersistentVolumeReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"storageclass": {
+		object: func() client.Object { return &storagev1.StorageClass{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &StorageClassReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"namespace": {
+		object: func() client.Object { return &corev1.Namespace{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &NamespaceReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"resourcequota": {
+		object: func() client.Object { return &corev1.ResourceQuota{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ResourceQuotaReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"limitrange": {
+		object: func() client.Object { return &corev1.LimitRange{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &LimitRangeReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"role": {
+		object: func() client.Object { return &rbacv1.Role{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &RoleReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"clusterrole": {
+		object: func() client.Object { return &rbacv1.ClusterRole{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ClusterRoleReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"rolebinding": {
+		object: func() client.Object { return &rbacv1.RoleBinding{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &RoleBindingReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"clusterrolebinding": {
+		object: func() client.Object { return &rbacv1.ClusterRoleBinding{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ClusterRoleBindingReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"configmap": {
+		object: func() client.Object { return &corev1.ConfigMap{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &ConfigMapReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"secret": {
+		object: func() client.Object { return &corev1.Secret{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &SecretReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+}
+
+// eventKinds are the event controllers, by events API.
+var eventKinds = map[string]watchedKind{
+	"core/v1": {
+		object: func() client.Object { return &corev1.Event{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &EventReconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+	"events.k8s.io/v1": {
+		object: func() client.Object { return &eventsv1.Event{} },
+		reconciler: func(c client.Client, scheme *runtime.Scheme, store *provider.Store) reconcile.Reconciler {
+			return &EventsV1Reconciler{Client: c, Scheme: scheme, store: store}
+		},
+	},
+}
+
+// Watchers runs the controller of every recorded kind some policy may target,
+// and reconfigures them whenever the policies applied to the store change:
+// the controllers of kinds no longer targeted are stopped, and those of kinds
+// targeted again are started, without restarting the manager. Each controller
+// watches its kind on a cache of its own, which stops with it, so a kind that
+// is not targeted is not watched and its detectors do not run.
+type Watchers struct {
+	Manager ctrl.Manager
+	Store   *provider.Store
+
+	kinds map[string]watchedKind
+
+	mu sync.Mutex
+	// ctx is the context of the manager, set once started
+	ctx     context.Context
+	running map[string]context.CancelFunc
+}
+
+// NewWatchers returns the watchers of the recorded kinds, with the event
+// controller of eventsAPI, core/v1 or events.k8s.io/v1.
+func NewWatchers(mgr ctrl.Manager, store *provider.Store, eventsAPI string) (*Watchers, error) {
+	event, ok := eventKinds[eventsAPI]
+	if !ok {
+		return nil, fmt.Errorf("unknown events API %q", eventsAPI)
+	}
+	kinds := map[string]watchedKind{"event": event}
+	for kind, w := range watchedKinds {
+		kinds[kind] = w
+	}
+	return &Watchers{Manager: mgr, Store: store, kinds: kinds, running: map[string]context.CancelFunc{}}, nil
+}
+
+// Start starts the controllers of the kinds targeted and stops them all once
+// ctx is done.
+func (w *Watchers) Start(ctx context.Context) error {
+	w.mu.Lock()
+	w.ctx = ctx
+	w.mu.Unlock()
+	if err := w.Reconfigure(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Reconfigure starts and stops the controllers to match the kinds the
+// policies of the store may target. It does nothing until the watchers are
+// started.
+func (w *Watchers) Reconfigure() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx == nil {
+		return nil
+	}
+	for kind, k := range w.kinds {
+		cancel, running := w.running[kind]
+		switch watched := w.Store.Watched(kind); {
+		case watched && !running:
+			if err := w.start(kind, k); err != nil {
+				return fmt.Errorf("unable to watch %s: %v", kind, err)
+			}
+			watchLog.Info("watching", "kind", kind)
+		case !watched && running:
+			cancel()
+			delete(w.running, kind)
+			watchLog.Info("stopped watching", "kind", kind)
+		}
+	}
+	return nil
+}
+
+// start runs the controller of a kind, on a cache of its own, until it is
+// stopped or the manager is.
+func (w *Watchers) start(kind string, k watchedKind) error {
+	c, err := cluster.New(w.Manager.GetConfig(), func(o *cluster.Options) {
+		o.Scheme = w.Manager.GetScheme()
+	})
+	if err != nil {
+		return err
+	}
+	r := k.reconciler(c.GetClient(), w.Manager.GetScheme(), w.Store)
+	ctl, err := controller.NewUnmanaged(kind, w.Manager, controller.Options{Reconciler: r})
+	if err != nil {
+		return err
+	}
+	if err := ctl.Watch(source.NewKindWithCache(k.object(), c.GetCache()), &handler.EnqueueRequestForObject{}); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(w.ctx)
+	go func() {
+		if err := c.Start(ctx); err != nil {
+			watchLog.Error(err, "cache stopped", "kind", kind)
+		}
+	}()
+	go func() {
+		if err := ctl.Start(ctx); err != nil {
+			watchLog.Error(err, "controller stopped", "kind", kind)
+		}
+	}()
+	w.running[kind] = cancel
+	return nil
+}
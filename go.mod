@@ -3,16 +3,23 @@ module github.com/hugomatus/kube-drift
 go 1.16
 
 require (
+	github.com/evanphx/json-patch v4.11.0+incompatible
+	github.com/golang/snappy v0.0.0-20180518054509-2e65f85255db
 	github.com/gorilla/handlers v1.4.0
 	github.com/gorilla/mux v1.8.0
+	github.com/klauspost/compress v1.13.6
 	github.com/mattn/go-sqlite3 v1.14.9
 	github.com/onsi/ginkgo v1.16.4
 	github.com/onsi/gomega v1.15.0
+	github.com/prometheus/client_golang v1.11.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/syndtr/goleveldb v1.0.0
+	gomodules.xyz/jsonpatch/v2 v2.2.0
+	google.golang.org/protobuf v1.26.0
 	k8s.io/api v0.22.1
 	k8s.io/apimachinery v0.22.1
 	k8s.io/client-go v0.22.1
-	k8s.io/klog/v2 v2.9.0 // indirect
+	k8s.io/klog/v2 v2.9.0
 	sigs.k8s.io/controller-runtime v0.10.0
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -17,24 +17,34 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/hugomatus/kube-drift/api"
 	provider "github.com/hugomatus/kube-drift/api/drift"
+	driftv1alpha1 "github.com/hugomatus/kube-drift/api/v1alpha1"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 
 	"github.com/hugomatus/kube-drift/controllers"
 	//+kubebuilder:scaffold:imports
@@ -48,26 +58,173 @@ var (
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
+	utilruntime.Must(driftv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if ran, err := runCommand(os.Args[1:]); ran {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var storePath string
+	var ignoreRulesPath string
+	var redactionRulesPath string
+	var storeEncoding string
+	var storeCompression string
+	var migrateDryRun bool
+	var historyRetention time.Duration
+	var retentionInterval time.Duration
+	var archive provider.S3Config
+	var indexLabels string
+	var checkpointInterval time.Duration
+	var encryptionKeyFile string
+	var encryptionKeySecret string
+	var encryptionKeyID string
+	var eventsAPI string
+	var reportInterval time.Duration
+	var secretHashKeyFile string
+	pipeline := provider.DefaultPipelineOptions
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&storePath, "store-path", "/tmp/kube-drift", "Path of the LevelDB store.")
+	flag.StringVar(&ignoreRulesPath, "ignore-rules", "",
+		"Path to a YAML or JSON file of additional ignore rules applied when comparing and diffing objects.")
+	flag.StringVar(&redactionRulesPath, "redaction-rules", "",
+		"Path to a YAML or JSON file of additional redaction rules masking sensitive values before they are stored.")
+	flag.StringVar(&storeEncoding, "store-encoding", "json", "Encoding of stored records: json or protobuf.")
+	flag.StringVar(&storeCompression, "store-compression", "snappy", "Compression of stored records: none, snappy or zstd.")
+	flag.BoolVar(&migrateDryRun, "migrate-dry-run", false,
+		"Report the store migrations that would run at startup and exit without applying them.")
+	flag.DurationVar(&historyRetention, "history-retention", 0,
+		"How long history versions are kept in the local store. Older versions are archived, or deleted without an archive. 0 keeps them forever.")
+	flag.DurationVar(&retentionInterval, "retention-interval", time.Hour, "How often history retention is applied.")
+	flag.StringVar(&archive.Endpoint, "archive-endpoint", "",
+		"URL of an S3-compatible service to archive aged-out history to, e.g. http://minio:9000. "+
+			"Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.")
+	flag.StringVar(&archive.Region, "archive-region", "us-east-1", "Region of the archive bucket.")
+	flag.StringVar(&archive.Bucket, "archive-bucket", "", "Bucket to archive aged-out history to.")
+	flag.StringVar(&archive.Prefix, "archive-prefix", "kube-drift/", "Prefix of the archived segments in the bucket.")
+	flag.StringVar(&indexLabels, "index-labels", strings.Join(provider.DefaultIndexedLabels, ","),
+		"Comma separated labels records are indexed by.")
+	flag.DurationVar(&checkpointInterval, "checkpoint-interval", time.Hour,
+		"How often a checkpoint of the history hash chains is recorded, and published to the archive if one is configured. 0 disables checkpoints.")
+	flag.IntVar(&pipeline.QueueSize, "write-queue-size", pipeline.QueueSize,
+		"Number of store writes queued before reconcilers are held back.")
+	flag.IntVar(&pipeline.MaxBatch, "write-batch-size", pipeline.MaxBatch, "Most store writes committed in one batch.")
+	flag.DurationVar(&pipeline.EnqueueTimeout, "write-enqueue-timeout", pipeline.EnqueueTimeout,
+		"How long a reconciler waits for room in a full write queue before its object is requeued.")
+	flag.StringVar(&encryptionKeyFile, "encryption-key-file", "",
+		"File holding a key to encrypt the store with, or a directory of keys such as a mounted Secret.")
+	flag.StringVar(&encryptionKeySecret, "encryption-key-secret", "",
+		"Secret, as namespace/name, holding keys to encrypt the store with.")
+	flag.StringVar(&encryptionKeyID, "encryption-key-id", "",
+		"Id of the key new values are encrypted with, required when several keys are loaded. "+
+			"Values encrypted with the other keys are re-encrypted in the background.")
+	flag.StringVar(&eventsAPI, "events-api", "core/v1",
+		"API events are watched through: core/v1 or events.k8s.io/v1. Both record the same events.")
+	flag.StringVar(&secretHashKeyFile, "secret-hash-key-file", "",
+		"File holding the key Secret values are hashed with. Without it a key generated and kept in the store is used.")
+	flag.DurationVar(&reportInterval, "report-interval", time.Minute,
+		"How often the DriftReports of namespaces and DriftPolicies are updated from the findings. 0 disables them.")
 	opts := zap.Options{
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
 	flag.Parse()
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	store := &provider.Store{}
-	store.New("/tmp/kube-drift")
+	if err := store.New(storePath); err != nil {
+		setupLog.Error(err, "unable to open store", "path", storePath)
+		os.Exit(1)
+	}
+	codec, err := provider.ParseCodec(storeEncoding, storeCompression)
+	if err != nil {
+		setupLog.Error(err, "invalid store codec")
+		os.Exit(1)
+	}
+	store.SetCodec(codec)
+	if encryptionKeyFile != "" || encryptionKeySecret != "" {
+		keys, err := loadKeyring(encryptionKeyFile, encryptionKeySecret, encryptionKeyID)
+		if err != nil {
+			setupLog.Error(err, "unable to load encryption keys")
+			os.Exit(1)
+		}
+		store.SetKeyring(keys)
+		setupLog.Info("store encryption enabled", "primaryKey", keys.Primary())
+	}
+
+	results, err := store.Migrate(migrateDryRun)
+	if err != nil {
+		setupLog.Error(err, "unable to migrate store")
+		os.Exit(1)
+	}
+	for _, r := range results {
+		setupLog.Info("store migration", "version", r.Version, "description", r.Description, "changed", r.Changed, "dryRun", r.DryRun)
+	}
+	if migrateDryRun {
+		os.Exit(0)
+	}
+	if secretHashKeyFile != "" {
+		key, err := ioutil.ReadFile(secretHashKeyFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load secret hash key", "path", secretHashKeyFile)
+			os.Exit(1)
+		}
+		provider.SetSecretHashKey(key)
+	} else if err := store.LoadSecretHashKey(); err != nil {
+		setupLog.Error(err, "unable to load secret hash key")
+		os.Exit(1)
+	}
+	if ignoreRulesPath != "" {
+		rules, err := provider.LoadIgnoreRules(ignoreRulesPath)
+		if err != nil {
+			setupLog.Error(err, "unable to load ignore rules", "path", ignoreRulesPath)
+			os.Exit(1)
+		}
+		store.SetIgnoreRules(append(provider.DefaultIgnoreRules, rules...))
+	}
+	if redactionRulesPath != "" {
+		rules, err := provider.LoadRedactionRules(redactionRulesPath)
+		if err != nil {
+			setupLog.Error(err, "unable to load redaction rules", "path", redactionRulesPath)
+			os.Exit(1)
+		}
+		if err := provider.SetRedactionRules(append(provider.DefaultRedactionRules, rules...)); err != nil {
+			setupLog.Error(err, "invalid redaction rules", "path", redactionRulesPath)
+			os.Exit(1)
+		}
+	}
+	store.SetIndexedLabels(strings.Split(indexLabels, ","))
+	store.EnablePipeline(pipeline)
+	store.SetRetention(historyRetention)
+	if archive.Endpoint != "" {
+		archive.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		archive.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		objects, err := provider.NewS3ObjectStore(archive)
+		if err != nil {
+			setupLog.Error(err, "invalid archive")
+			os.Exit(1)
+		}
+		store.SetArchive(objects)
+		added, err := store.RebuildArchiveIndex(context.Background())
+		if err != nil {
+			setupLog.Error(err, "unable to index archive", "bucket", archive.Bucket)
+			os.Exit(1)
+		}
+		setupLog.Info("indexed archive", "bucket", archive.Bucket, "added", added)
+	}
 	go func() {
 		setupLog.Info("Start API Server::ListenAndServe on port 8001")
 		r := mux.NewRouter()
@@ -82,7 +239,6 @@ func main() {
 
 	/*	store := &provider.Store{}
 		store.New("/tmp/kube-drift")*/
-	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
@@ -97,18 +253,15 @@ func main() {
 		os.Exit(1)
 	}
 	//+kubebuilder:scaffold:builder
-	if err = (&controllers.PodReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr, store); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Pod")
+	// the controllers of the recorded kinds are started and stopped by the
+	// watchers, from the kinds the drift policies target
+	watchers, err := controllers.NewWatchers(mgr, store, eventsAPI)
+	if err != nil {
+		setupLog.Error(err, "unable to create watchers")
 		os.Exit(1)
 	}
-	if err = (&controllers.EventReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Event")
+	if err := mgr.Add(watchers); err != nil {
+		setupLog.Error(err, "unable to set up watchers")
 		os.Exit(1)
 	}
 	if err = (&controllers.NodeReconciler{
@@ -119,13 +272,49 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controllers.DeploymentReconciler{
+	if err = (&controllers.DriftPolicyReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Deployment")
+	}).SetupWithManager(mgr, store, watchers); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "DriftPolicy")
+		os.Exit(1)
+	}
+
+	if reportInterval > 0 {
+		if err := mgr.Add(&controllers.DriftReporter{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Store:    store,
+			Interval: reportInterval,
+		}); err != nil {
+			setupLog.Error(err, "unable to set up drift reports")
+			os.Exit(1)
+		}
+	}
+	if err := mgr.Add(manager.RunnableFunc(store.RunPipeline)); err != nil {
+		setupLog.Error(err, "unable to set up store write pipeline")
+		os.Exit(1)
+	}
+	if checkpointInterval > 0 {
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return store.RunCheckpoints(ctx, checkpointInterval)
+		})); err != nil {
+			setupLog.Error(err, "unable to set up chain checkpoints")
+			os.Exit(1)
+		}
+	}
+	if err := mgr.Add(manager.RunnableFunc(store.RunReencrypt)); err != nil {
+		setupLog.Error(err, "unable to set up store re-encryption")
 		os.Exit(1)
 	}
+	if historyRetention > 0 {
+		if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			return store.RunRetention(ctx, retentionInterval)
+		})); err != nil {
+			setupLog.Error(err, "unable to set up history retention")
+			os.Exit(1)
+		}
+	}
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
@@ -143,3 +332,24 @@ func main() {
 	}
 
 }
+
+// loadKeyring loads the store encryption keys from a file or directory, or
+// from a Secret given as namespace/name.
+func loadKeyring(path, secret, primary string) (*provider.Keyring, error) {
+	if path != "" {
+		return provider.LoadKeyring(path, primary)
+	}
+	parts := strings.SplitN(secret, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid secret %q, expected namespace/name", secret)
+	}
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	s := &corev1.Secret{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: parts[0], Name: parts[1]}, s); err != nil {
+		return nil, err
+	}
+	return provider.NewKeyring(s.Data, primary)
+}